@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/nattc"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func (o benchOptions) validate() error {
+	var errs config.Errors
+	if o.pings < 1 {
+		errs.Add("pings", "must be at least 1")
+	}
+	if o.pingInterval < 0 {
+		errs.Add("ping-interval", "must not be negative")
+	} else if o.pings > 1 && time.Duration(o.pings-1)*o.pingInterval > tunnel.MaxBenchDuration {
+		errs.Add("ping-interval", "pings must be sent within %s", tunnel.MaxBenchDuration)
+	}
+	if o.duration < 100*time.Millisecond || o.duration > tunnel.MaxBenchDuration {
+		errs.Add("duration", "must be between 100ms and %s", tunnel.MaxBenchDuration)
+	}
+	if o.format != "table" && o.format != "json" {
+		errs.Add("format", "must be table or json")
+	}
+	return errs.Err()
+}
+
+// runBench measures the tunnel to natts and writes the report to w
+func runBench(w io.Writer, cfg *settings, opts benchOptions) error {
+	report, err := nattc.RunBench(cfg.clientConfig(), nattc.BenchOptions{
+		Pings:        opts.pings,
+		PingInterval: opts.pingInterval,
+		Duration:     opts.duration,
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Profile string `json:"profile"`
+			*nattc.BenchReport
+		}{cfg.KCP.Profile, report})
+	}
+	printBench(w, cfg.KCP.Profile, report)
+	return nil
+}
+
+func printBench(w io.Writer, profile string, r *nattc.BenchReport) {
+	compression := r.Compression
+	if compression == "" {
+		compression = "off"
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Target\t%s\n", r.Target)
+	fmt.Fprintf(tw, "KCP\t%s profile, %s, compression %s\n", profile, r.FEC, compression)
+	fmt.Fprintf(tw, "RTT\tmin %.2fms  avg %.2fms  p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms  jitter %.2fms  (%d pings)\n",
+		r.RTT.Min, r.RTT.Avg, r.RTT.P50, r.RTT.P90, r.RTT.P99, r.RTT.Max, r.RTT.Jitter, r.RTT.Samples)
+	fmt.Fprintf(tw, "Download\t%s/s  (%s in %.1fs)\n", formatBytes(r.Download.BytesPerSecond), formatBytes(float64(r.Download.Bytes)), r.Download.Seconds)
+	fmt.Fprintf(tw, "Upload\t%s/s  (%s in %.1fs)\n", formatBytes(r.Upload.BytesPerSecond), formatBytes(float64(r.Upload.Bytes)), r.Upload.Seconds)
+	fmt.Fprintf(tw, "Segments\t%d sent, %d received\n", r.KCP.SegmentsSent, r.KCP.SegmentsReceived)
+	fmt.Fprintf(tw, "Retransmitted\t%d  (%d fast, %d after a timeout, loss %.2f%%)\n",
+		r.KCP.Retransmitted, r.KCP.FastRetransmitted, r.KCP.Lost, 100*r.KCP.LossRate)
+	fmt.Fprintf(tw, "Duplicates\t%d received\n", r.KCP.Duplicates)
+	fmt.Fprintf(tw, "FEC recovered\t%d\n", r.KCP.FECRecovered)
+	tw.Flush()
+}
+
+// formatBytes formats n bytes with a binary unit
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
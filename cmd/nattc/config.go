@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/nattc"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// settings is the effective nattc configuration. Its TOML form is the config file format.
+type settings struct {
+	Target          string                 `toml:"target"`
+	Listen          string                 `toml:"listen"`
+	Service         string                 `toml:"service"`
+	Socks           string                 `toml:"socks"`
+	Metrics         string                 `toml:"metrics"`
+	Forwards        []nattc.Forward        `toml:"forwards"`
+	UDPForwards     []nattc.Forward        `toml:"udp_forwards"`
+	ReverseForwards []nattc.ReverseForward `toml:"reverse_forwards"`
+	AuthKey         *config.Key            `toml:"auth_key"`
+	KCP             config.KCP             `toml:"kcp"`
+	Timeouts        config.Timeouts        `toml:"timeouts"`
+	Shutdown        shutdownSettings       `toml:"shutdown"`
+	Bandwidth       config.Bandwidth       `toml:"bandwidth"`
+	Log             config.Log             `toml:"log"`
+}
+
+type shutdownSettings struct {
+	DrainTimeout time.Duration `toml:"drain_timeout"`
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		Listen:   ":10022",
+		Service:  tunnel.DefaultService,
+		KCP:      config.DefaultKCP(),
+		Timeouts: config.DefaultTimeouts(),
+		Shutdown: shutdownSettings{DrainTimeout: 30 * time.Second},
+		Log:      config.DefaultLog(),
+	}
+}
+
+// cliOptions are flags that are not settings themselves
+type cliOptions struct {
+	configPath  string
+	printConfig bool
+	proxy       bool
+	// command is the subcommand given before the flags, if any
+	command string
+	bench   benchOptions
+	ping    pingOptions
+}
+
+// commands are the subcommands nattc runs instead of forwarding connections
+var commands = []string{"bench", "doctor", "ping"}
+
+// commandsUsage is appended to the flag usage
+const commandsUsage = `
+Commands, given before the flags (see nattc <command> --help):
+  nattc bench [flags]    Measure the latency and throughput of the tunnel
+  nattc ping [flags]     Time resolving the target, the handshake and an echo from natts
+  nattc doctor [flags]   Check the target, UDP, the listeners, the handshake and the
+                         targets of the forwards, and suggest fixes
+`
+
+// benchOptions are the flags of nattc bench
+type benchOptions struct {
+	pings        int
+	pingInterval time.Duration
+	duration     time.Duration
+	format       string
+}
+
+// pingOptions are the flags of nattc ping
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	format   string
+}
+
+// forwardFlags collects repeated -L forwarding specs
+type forwardFlags []nattc.Forward
+
+func (f *forwardFlags) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, fwd := range *f {
+		specs = append(specs, fwd.String())
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *forwardFlags) Set(value string) error {
+	fwd, err := nattc.ParseForward(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fwd)
+	return nil
+}
+
+// reverseFlags collects repeated -R forwarding specs
+type reverseFlags []nattc.ReverseForward
+
+func (f *reverseFlags) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, fwd := range *f {
+		specs = append(specs, fwd.String())
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *reverseFlags) Set(value string) error {
+	fwd, err := nattc.ParseReverseForward(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fwd)
+	return nil
+}
+
+// newFlagSet returns the command line flags, writing into s and opts.
+// Repeatable flags add to what s already contains.
+func newFlagSet(s *settings, opts *cliOptions) *flag.FlagSet {
+	name := os.Args[0]
+	if opts.command != "" {
+		name += " " + opts.command
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.configPath, "config", "", "TOML config file; settings from it are overridden by environment variables and flags (env NATTC_CONFIG)")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	fs.BoolVar(&opts.proxy, "proxy", false, "Run in ProxyCommand mode (stdin/stdout)")
+	fs.StringVar(&s.Listen, "listen", s.Listen, "Address to listen on for SSH connections (server mode)")
+	fs.StringVar(&s.Target, "target", s.Target, "Target FQDN to connect to (natts server); nattc bench also takes a host:port (env TARGET_FQDN)")
+	fs.StringVar(&s.Service, "service", s.Service, "Service on the natts side to connect to")
+	fs.StringVar(&s.Socks, "socks", s.Socks, "Address to run a SOCKS5 proxy on; destinations are dialed by natts")
+	fs.StringVar(&s.Metrics, "metrics", s.Metrics, "Address to serve Prometheus metrics on at /metrics, e.g. :9101 (disabled if empty)")
+	fs.DurationVar(&s.Timeouts.KeepAliveInterval, "keepalive-interval", s.Timeouts.KeepAliveInterval, "Interval between keepalive frames sent to natts")
+	fs.DurationVar(&s.Timeouts.KeepAliveTimeout, "keepalive-timeout", s.Timeouts.KeepAliveTimeout, "Reconnect after this long without hearing from natts")
+	fs.DurationVar(&s.Timeouts.IdleTimeout, "idle-timeout", s.Timeouts.IdleTimeout, "Close connections after this long without traffic (0 disables)")
+	fs.DurationVar(&s.Timeouts.MaxSessionLifetime, "max-session-lifetime", s.Timeouts.MaxSessionLifetime, "Close connections this long after they were opened (0 disables)")
+	fs.DurationVar(&s.Timeouts.ResumeTimeout, "resume-timeout", s.Timeouts.ResumeTimeout, "Keep trying to resume a broken session for this long (0 disables)")
+	fs.DurationVar(&s.Shutdown.DrainTimeout, "drain-timeout", s.Shutdown.DrainTimeout, "On shutdown, wait this long for forwarded connections to finish before closing them")
+	fs.StringVar(&s.KCP.Profile, "kcp-profile", s.KCP.Profile, "KCP retransmission `profile`: standard, normal, fast, fast2, fast3 or custom (see [kcp] in the config file)")
+	fs.StringVar(&s.KCP.Compression, "compression", s.KCP.Compression, "stream `compression`: auto (on for the normal KCP profile), off, snappy or zstd")
+	fs.Var(&s.Bandwidth.Global, "bandwidth", "Cap the `rate` nattc sends to natts, in bytes per second such as 512K (0 for unlimited)")
+	fs.StringVar(&s.Log.Format, "log-format", s.Log.Format, "Log format, text or json")
+	fs.Var(config.LogLevelFlag(&s.Log), "log-level", "Log `levels` as a default level and per-subsystem overrides, e.g. info,tunnel=debug")
+	fs.Var((*forwardFlags)(&s.Forwards), "L", "Local forward as `[bind_address:]port:service|[bind_address:]port:host:hostport`, sharing the connection to natts (repeatable, replaces --listen)")
+	fs.Var((*forwardFlags)(&s.UDPForwards), "U", "Local UDP forward as `[bind_address:]port:service|[bind_address:]port:host:hostport`; datagrams bypass KCP and are relayed unreliably (repeatable)")
+	fs.Var((*reverseFlags)(&s.ReverseForwards), "R", "Reverse forward as `[bind_address:]port:host:hostport`: natts listens on port and connections are carried back to host:hostport (repeatable)")
+	if opts.command == "bench" {
+		fs.IntVar(&opts.bench.pings, "pings", 20, "Number of round trips to time")
+		fs.DurationVar(&opts.bench.pingInterval, "ping-interval", 100*time.Millisecond, "Interval between pings")
+		fs.DurationVar(&opts.bench.duration, "duration", 5*time.Second, "How long the download and the upload each run")
+		fs.StringVar(&opts.bench.format, "format", "table", "Report `format`, table or json")
+	}
+	if opts.command == "ping" {
+		fs.IntVar(&opts.ping.count, "count", 4, "Number of echoes to send")
+		fs.DurationVar(&opts.ping.interval, "interval", time.Second, "Interval between echoes")
+		fs.StringVar(&opts.ping.format, "format", "table", "Report `format`, table or json")
+	}
+	usage := config.Usage(fs)
+	fs.Usage = func() {
+		usage()
+		if opts.command == "" {
+			fmt.Fprint(fs.Output(), commandsUsage)
+		}
+	}
+	return fs
+}
+
+// loadSettings builds the effective settings from the defaults, the config
+// file, the environment and the command line, each overriding the previous ones
+func loadSettings(args []string) (*settings, cliOptions, error) {
+	// The first pass only looks for --config
+	var opts cliOptions
+	if len(args) > 0 && slices.Contains(commands, args[0]) {
+		opts.command, args = args[0], args[1:]
+	}
+	newFlagSet(defaultSettings(), &opts).Parse(args)
+	if opts.configPath == "" {
+		config.Getenv("NATTC_CONFIG", &opts.configPath)
+	}
+
+	s := defaultSettings()
+	if opts.configPath != "" {
+		if err := config.Load(opts.configPath, s); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	config.Getenv("TARGET_FQDN", &s.Target)
+	if value, ok := os.LookupEnv("NATTC_AUTH_KEY"); ok && value != "" {
+		key, err := config.ParseKey(value)
+		if err != nil {
+			return nil, opts, fmt.Errorf("invalid NATTC_AUTH_KEY: %w", err)
+		}
+		s.AuthKey = &key
+	}
+
+	newFlagSet(s, &opts).Parse(args)
+	return s, opts, nil
+}
+
+// validate reports every problem with the settings at once
+func (s *settings) validate() error {
+	var errs config.Errors
+
+	if s.Target == "" {
+		errs.Add("target", "required (set it in the config file, TARGET_FQDN or --target)")
+	}
+	errs.CheckAddress("listen", s.Listen)
+	if s.Service == "" {
+		errs.Add("service", "must not be empty")
+	}
+	if s.Socks != "" {
+		errs.CheckAddress("socks", s.Socks)
+	}
+	if s.Metrics != "" {
+		errs.CheckAddress("metrics", s.Metrics)
+	}
+	if s.AuthKey != nil {
+		s.AuthKey.Validate(&errs, "auth_key")
+	}
+
+	s.KCP.Validate(&errs)
+	s.Timeouts.Validate(&errs)
+	s.Log.Validate(&errs)
+	if s.Shutdown.DrainTimeout < 0 {
+		errs.Add("shutdown.drain_timeout", "must not be negative (use 0 to close connections immediately)")
+	}
+
+	return errs.Err()
+}
+
+// validate checks the flags of the subcommand, if one was given
+func (o *cliOptions) validate() error {
+	switch o.command {
+	case "bench":
+		return o.bench.validate()
+	case "ping":
+		return o.ping.validate()
+	}
+	return nil
+}
+
+// defaultMode reports whether nattc forwards --listen to --service, as it
+// does without -L, -U, -R or --socks
+func (s *settings) defaultMode() bool {
+	return len(s.Forwards) == 0 && len(s.UDPForwards) == 0 && len(s.ReverseForwards) == 0 && s.Socks == ""
+}
+
+// defaultForward is the forward of the default mode
+func (s *settings) defaultForward() nattc.Forward {
+	return nattc.Forward{ListenAddr: s.Listen, Service: s.Service}
+}
+
+// redacted returns a copy of s that is safe to print
+func (s *settings) redacted() *settings {
+	r := *s
+	if s.AuthKey != nil {
+		key := s.AuthKey.Redacted()
+		r.AuthKey = &key
+	}
+	return &r
+}
+
+// clientConfig converts the settings to the nattc client configuration
+func (s *settings) clientConfig() nattc.Config {
+	cfg := nattc.Config{
+		TargetFQDN:  s.Target,
+		Forwards:    s.Forwards,
+		UDPForwards: s.UDPForwards,
+		Reverses:    s.ReverseForwards,
+		SocksAddr:   s.Socks,
+		Timeouts:    s.Timeouts.Tunnel(),
+		KCP:         s.KCP.Options(),
+		Bandwidth:   s.Bandwidth.Limits(),
+	}
+	if s.AuthKey != nil {
+		key := s.AuthKey.Tunnel()
+		cfg.AuthKey = &key
+	}
+	return cfg
+}
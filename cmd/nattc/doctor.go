@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Hogeyama/ddns-updater/internal/doctor"
+	"github.com/Hogeyama/ddns-updater/internal/nattc"
+)
+
+// runDoctor checks what nattc needs to reach natts and writes the results to w
+func runDoctor(w io.Writer, cfg *settings) error {
+	if cfg.defaultMode() {
+		cfg.Forwards = append(cfg.Forwards, cfg.defaultForward())
+	}
+
+	report := doctor.New(w)
+	nattc.Doctor(cfg.clientConfig(), report)
+	report.Summary()
+	if report.Failed() {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
@@ -2,57 +2,89 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
 	"github.com/Hogeyama/ddns-updater/internal/nattc"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
 )
 
 func main() {
-	var (
-		listenAddr  = flag.String("listen", ":10022", "Address to listen on for SSH connections (server mode)")
-		targetFQDN  = flag.String("target", "", "Target FQDN to connect to (natts server)")
-		proxyMode   = flag.Bool("proxy", false, "Run in ProxyCommand mode (stdin/stdout)")
-	)
-	// Custom usage function
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  --listen string\n")
-		fmt.Fprintf(os.Stderr, "    \tAddress to listen on for SSH connections (server mode) (default \":10022\")\n")
-		fmt.Fprintf(os.Stderr, "  --proxy\n")
-		fmt.Fprintf(os.Stderr, "    \tRun in ProxyCommand mode (stdin/stdout)\n")
-		fmt.Fprintf(os.Stderr, "  --target string\n")
-		fmt.Fprintf(os.Stderr, "    \tTarget FQDN to connect to (natts server)\n")
+	cfg, opts, err := loadSettings(os.Args[1:])
+	if err != nil {
+		exit(err)
+	}
+	if opts.printConfig {
+		if err := config.Print(os.Stdout, cfg.redacted()); err != nil {
+			exit(fmt.Errorf("failed to print config: %w", err))
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		exit(err)
+	}
+	if err := opts.validate(); err != nil {
+		exit(err)
+	}
+	if opts.printConfig {
+		return
 	}
-	flag.Parse()
 
-	// Get target FQDN from environment if not provided via flag
-	if *targetFQDN == "" {
-		*targetFQDN = os.Getenv("TARGET_FQDN")
+	if err := logging.Setup(os.Stderr, cfg.Log.Format); err != nil {
+		exit(err)
+	}
+	if err := cfg.Log.ApplyLevels(); err != nil {
+		exit(err)
 	}
 
-	if *targetFQDN == "" {
-		log.Fatal("TARGET_FQDN is required (via -target flag or TARGET_FQDN environment variable)")
+	if cfg.Metrics != "" {
+		if err := metrics.Serve(cfg.Metrics); err != nil {
+			fatal("failed to serve metrics", err)
+		}
 	}
 
-	if *proxyMode {
+	switch opts.command {
+	case "bench":
+		if err := runBench(os.Stdout, cfg, opts.bench); err != nil {
+			fatal("bench failed", err)
+		}
+		return
+	case "ping":
+		if err := runPing(os.Stdout, cfg, opts.ping); err != nil {
+			os.Exit(1)
+		}
+		return
+	case "doctor":
+		if err := runDoctor(os.Stdout, cfg); err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	if opts.proxy {
 		// ProxyCommand mode: proxy stdin/stdout
-		proxyClient := nattc.NewProxyClient(*targetFQDN)
+		proxyClient := nattc.NewProxyClient(cfg.clientConfig(), cfg.Service)
 		if err := proxyClient.RunProxy(); err != nil {
-			log.Fatalf("Proxy failed: %v", err)
+			fatal("proxy failed", err)
 		}
 		return
 	}
 
-	// Server mode: TCP listener
+	// Server mode: TCP listeners
+	// Without -L, -U, -R or --socks, forward --listen to --service
+	defaultMode := cfg.defaultMode()
+	if defaultMode {
+		cfg.Forwards = append(cfg.Forwards, cfg.defaultForward())
+	}
+
 	// Create client
-	client := nattc.New(nattc.Config{
-		TargetFQDN: *targetFQDN,
-	})
+	client := nattc.New(cfg.clientConfig())
 
 	// Setup context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -64,27 +96,57 @@ func main() {
 
 	go func() {
 		<-sigChan
-		log.Println("Received shutdown signal")
+		slog.Info("received shutdown signal")
 		cancel()
 	}()
 
 	// Start client
-	log.Printf("Starting nattc client...")
-	log.Printf("  Listen address: %s", *listenAddr)
-	log.Printf("  Target FQDN: %s", *targetFQDN)
-	log.Printf("  Usage: ssh -p %s localhost", (*listenAddr)[1:]) // Remove ':' from port
+	slog.Info("starting nattc", "target_fqdn", cfg.Target)
+	for _, fwd := range cfg.ReverseForwards {
+		slog.Info("reverse forward", "forward", fwd.String())
+	}
+	if cfg.Metrics != "" {
+		slog.Info("serving metrics", "url", cfg.Metrics+"/metrics")
+	}
+	if defaultMode && cfg.Service == tunnel.DefaultService {
+		if _, port, err := net.SplitHostPort(cfg.Listen); err == nil {
+			slog.Info("connect with ssh to localhost", "port", port)
+		}
+	}
 
-	if err := client.Start(ctx, *listenAddr); err != nil {
-		log.Fatalf("Failed to start client: %v", err)
+	if err := client.Start(ctx); err != nil {
+		fatal("failed to start client", err)
 	}
 
 	// Wait for shutdown
 	<-ctx.Done()
-	log.Println("Shutting down...")
+	slog.Info("shutting down, waiting for active connections", "drain_timeout", cfg.Shutdown.DrainTimeout)
 
-	if err := client.Close(); err != nil {
-		log.Printf("Error closing client: %v", err)
+	// A second signal skips the rest of the drain
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Shutdown.DrainTimeout)
+	defer cancelDrain()
+
+	go func() {
+		<-sigChan
+		slog.Info("received second shutdown signal, closing immediately")
+		cancelDrain()
+	}()
+
+	if err := client.Shutdown(drainCtx); err != nil {
+		slog.Error("failed to close client", "error", err)
 	}
 
-	log.Println("Client stopped")
-}
\ No newline at end of file
+	slog.Info("client stopped")
+}
+
+// exit reports an error that occurred before logging was set up and exits
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// fatal logs an error that stops the process and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/nattc"
+)
+
+func (o pingOptions) validate() error {
+	var errs config.Errors
+	if o.count < 1 {
+		errs.Add("count", "must be at least 1")
+	}
+	if o.interval < 0 {
+		errs.Add("interval", "must not be negative")
+	}
+	if o.format != "table" && o.format != "json" {
+		errs.Add("format", "must be table or json")
+	}
+	return errs.Err()
+}
+
+// pingSteps label the steps of nattc ping and say what a failure points at
+var pingSteps = map[string]struct{ label, hint string }{
+	nattc.PingStepDNS:       {"DNS", "The target does not resolve to natts; is natts running and updating its DNS records?"},
+	nattc.PingStepHandshake: {"Handshake", "natts did not answer; is its port reachable through the NAT, and do the [kcp] FEC settings and the auth key match?"},
+	nattc.PingStepEcho:      {"First echo", "natts accepted the session but did not echo; see its log"},
+}
+
+// runPing checks that natts is reachable and writes the report to w. The
+// report includes the error, so it is not worth logging again.
+func runPing(w io.Writer, cfg *settings, opts pingOptions) error {
+	report, err := nattc.Ping(cfg.clientConfig(), nattc.PingOptions{
+		Count:    opts.count,
+		Interval: opts.interval,
+	})
+
+	if opts.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(report); encErr != nil {
+			return encErr
+		}
+	} else {
+		printPing(w, report)
+	}
+	return err
+}
+
+func printPing(w io.Writer, r *nattc.PingReport) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if r.Address != "" && r.Address != r.Target {
+		fmt.Fprintf(tw, "Target\t%s (%s)\n", r.Target, r.Address)
+	} else {
+		fmt.Fprintf(tw, "Target\t%s\n", r.Target)
+	}
+	for _, step := range r.Steps {
+		label := pingSteps[step.Name].label
+		if step.Failed {
+			fmt.Fprintf(tw, "%s\tfailed after %.2fms\n", label, step.Duration)
+		} else {
+			fmt.Fprintf(tw, "%s\t%.2fms\n", label, step.Duration)
+		}
+	}
+	if r.RTT != nil && r.RTT.Samples > 1 {
+		fmt.Fprintf(tw, "RTT\tmin %.2fms  avg %.2fms  max %.2fms  jitter %.2fms  (%d echoes)\n",
+			r.RTT.Min, r.RTT.Avg, r.RTT.Max, r.RTT.Jitter, r.RTT.Samples)
+	}
+	tw.Flush()
+
+	if r.Error != "" {
+		fmt.Fprintf(w, "\n%s\n", r.Error)
+	}
+	if step, ok := pingSteps[r.FailedStep()]; ok {
+		fmt.Fprintln(w, step.hint)
+	}
+}
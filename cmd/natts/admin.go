@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/natts"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// commandsUsage is appended to the flag usage
+const commandsUsage = `
+Commands run locally:
+  natts [flags] doctor               Check the Cloudflare token, the listen port, the STUN
+                                     servers, the NAT, the published records and the
+                                     backends, and suggest fixes
+
+Commands for a running natts, sent to its admin API (--admin):
+  natts [flags] sessions list        List open sessions
+  natts [flags] sessions kill <id>   Close a session and its connections
+  natts [flags] bans list            List IPs banned for failing to authenticate
+  natts [flags] bans lift <ip>       Let a banned IP connect again
+  natts [flags] bandwidth show       Show the bandwidth limits in effect
+  natts [flags] bandwidth set <limit>...
+                                     Change bandwidth limits until the next reload,
+                                     e.g. global=2M per_session=512K service.ssh=0
+  natts [flags] rediscover           Run STUN discovery and update DNS now
+  natts [flags] drain                Shut down gracefully, as on SIGTERM
+`
+
+// adminClient sends requests to the admin API of a running natts
+type adminClient struct {
+	client http.Client
+	base   string
+	// token is sent as a bearer token, if set
+	token string
+}
+
+func newAdminClient(addr, token string) *adminClient {
+	c := &adminClient{base: "http://" + addr, token: token}
+	if natts.IsUnixSocket(addr) {
+		c.base = "http://natts"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		}
+	}
+	return c
+}
+
+// do sends a request with in, if not nil, as its JSON body and decodes the
+// JSON response into out
+func (c *adminClient) do(method, path string, in, out any) error {
+	var reqBody io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach natts: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("natts answered %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// runCommand runs a command against the running natts and prints the result
+func runCommand(cfg *settings, args []string) error {
+	if cfg.Admin == "" {
+		return fmt.Errorf("no admin API configured (set admin in the config file or --admin)")
+	}
+	c := newAdminClient(cfg.Admin, cfg.AdminToken)
+
+	switch {
+	case len(args) == 2 && args[0] == "sessions" && args[1] == "list":
+		var sessions []natts.SessionStatus
+		if err := c.do(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+			return err
+		}
+		printSessions(sessions)
+
+	case len(args) == 3 && args[0] == "sessions" && args[1] == "kill":
+		if _, err := strconv.ParseUint(args[2], 10, 64); err != nil {
+			return fmt.Errorf("invalid session ID %q", args[2])
+		}
+		var killed struct{}
+		if err := c.do(http.MethodDelete, "/sessions/"+args[2], nil, &killed); err != nil {
+			return err
+		}
+		fmt.Printf("Session %s killed\n", args[2])
+
+	case len(args) == 2 && args[0] == "bans" && args[1] == "list":
+		var bans []natts.BanStatus
+		if err := c.do(http.MethodGet, "/bans", nil, &bans); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "IP\tUNTIL")
+		for _, ban := range bans {
+			fmt.Fprintf(w, "%s\t%s\n", ban.IP, ban.Until.Local().Format(time.DateTime))
+		}
+		w.Flush()
+
+	case len(args) == 3 && args[0] == "bans" && args[1] == "lift":
+		var lifted struct{}
+		if err := c.do(http.MethodDelete, "/bans/"+url.PathEscape(args[2]), nil, &lifted); err != nil {
+			return err
+		}
+		fmt.Printf("Ban on %s lifted\n", args[2])
+
+	case len(args) == 2 && args[0] == "bandwidth" && args[1] == "show":
+		var limits tunnel.BandwidthLimits
+		if err := c.do(http.MethodGet, "/bandwidth", nil, &limits); err != nil {
+			return err
+		}
+		printBandwidth(limits)
+
+	case len(args) >= 3 && args[0] == "bandwidth" && args[1] == "set":
+		var limits tunnel.BandwidthLimits
+		if err := c.do(http.MethodGet, "/bandwidth", nil, &limits); err != nil {
+			return err
+		}
+		if err := setBandwidth(&limits, args[2:]); err != nil {
+			return err
+		}
+		if err := c.do(http.MethodPut, "/bandwidth", limits, &limits); err != nil {
+			return err
+		}
+		printBandwidth(limits)
+
+	case len(args) == 1 && args[0] == "rediscover":
+		var status natts.Status
+		if err := c.do(http.MethodPost, "/rediscover", nil, &status); err != nil {
+			return err
+		}
+		if status.STUN != nil {
+			fmt.Printf("External address: %s\n", net.JoinHostPort(status.STUN.IP, strconv.Itoa(status.STUN.Port)))
+		}
+		fmt.Printf("NAT type: %s\n", status.NATType)
+		if status.DNS != nil {
+			fmt.Printf("Published in DNS: %s\n", status.DNS.Endpoint)
+		}
+
+	case len(args) == 1 && args[0] == "drain":
+		var status natts.Status
+		if err := c.do(http.MethodPost, "/drain", nil, &status); err != nil {
+			return err
+		}
+		fmt.Printf("natts is draining, %d active connections\n", status.ActiveConnections)
+
+	default:
+		return fmt.Errorf("unknown command %q\n%s", strings.Join(args, " "), commandsUsage)
+	}
+	return nil
+}
+
+// setBandwidth applies limits given as global=<rate>, per_session=<rate> or
+// service.<name>=<rate>
+func setBandwidth(limits *tunnel.BandwidthLimits, args []string) error {
+	if limits.Services == nil {
+		limits.Services = map[string]int64{}
+	}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid bandwidth limit %q (want name=rate)", arg)
+		}
+		rate, err := config.ParseRate(value)
+		if err != nil {
+			return fmt.Errorf("invalid bandwidth limit %q: %w", arg, err)
+		}
+		switch service, isService := strings.CutPrefix(name, "service."); {
+		case name == "global":
+			limits.Global = int64(rate)
+		case name == "per_session":
+			limits.PerSession = int64(rate)
+		case isService && service != "":
+			if rate == 0 {
+				delete(limits.Services, service)
+			} else {
+				limits.Services[service] = int64(rate)
+			}
+		default:
+			return fmt.Errorf("unknown bandwidth limit %q (want global, per_session or service.<name>)", name)
+		}
+	}
+	return nil
+}
+
+func printBandwidth(limits tunnel.BandwidthLimits) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LIMIT\tRATE")
+	fmt.Fprintf(w, "global\t%s\n", formatRate(limits.Global))
+	fmt.Fprintf(w, "per_session\t%s\n", formatRate(limits.PerSession))
+	services := slices.Sorted(maps.Keys(limits.Services))
+	for _, service := range services {
+		fmt.Fprintf(w, "service.%s\t%s\n", service, formatRate(limits.Services[service]))
+	}
+	w.Flush()
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return config.Rate(rate).String() + "/s"
+}
+
+func printSessions(sessions []natts.SessionStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPEER\tKEY\tSTARTED\tDURATION\tIN\tOUT\tCONNS")
+	for _, sess := range sessions {
+		identity := sess.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			sess.ID, sess.Peer, identity, sess.Started.Local().Format(time.DateTime),
+			sess.Duration, sess.BytesIn, sess.BytesOut, sess.Connections)
+	}
+	w.Flush()
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/natts"
+	"github.com/Hogeyama/ddns-updater/internal/stun"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// settings is the effective natts configuration. Its TOML form is the config file format.
+type settings struct {
+	Listen         string             `toml:"listen"`
+	Metrics        string             `toml:"metrics"`
+	Admin          string             `toml:"admin"`
+	AdminToken     string             `toml:"admin_token"`
+	AuditLog       string             `toml:"audit_log"`
+	TargetFQDN     string             `toml:"target_fqdn"`
+	SSHTarget      string             `toml:"ssh_target"`
+	Services       map[string]string  `toml:"services"`
+	AllowEgress    []natts.EgressRule `toml:"allow_egress"`
+	AllowReverse   []string           `toml:"allow_reverse"`
+	UDPIdleTimeout time.Duration      `toml:"udp_idle_timeout"`
+	Bench          bool               `toml:"bench"`
+	Cloudflare     cloudflareSettings `toml:"cloudflare"`
+	STUN           stunSettings       `toml:"stun"`
+	KCP            config.KCP         `toml:"kcp"`
+	Timeouts       config.Timeouts    `toml:"timeouts"`
+	AuthorizedKeys []config.Key       `toml:"authorized_keys"`
+	Shutdown       shutdownSettings   `toml:"shutdown"`
+	Limits         limitsSettings     `toml:"limits"`
+	Bandwidth      config.Bandwidth   `toml:"bandwidth"`
+	Sources        sourcesSettings    `toml:"sources"`
+	Log            config.Log         `toml:"log"`
+}
+
+type cloudflareSettings struct {
+	APIToken string `toml:"api_token"`
+}
+
+type stunSettings struct {
+	Servers []string `toml:"servers"`
+}
+
+type shutdownSettings struct {
+	DrainTimeout   time.Duration `toml:"drain_timeout"`
+	MarkDNSOffline bool          `toml:"mark_dns_offline"`
+}
+
+// limitsSettings caps sessions; 0 disables a limit. It converts to natts.Limits.
+type limitsSettings struct {
+	MaxSessions       int           `toml:"max_sessions"`
+	MaxSessionsPerIP  int           `toml:"max_sessions_per_ip"`
+	SessionRate       float64       `toml:"session_rate"`
+	SessionBurst      int           `toml:"session_burst"`
+	SessionRatePerIP  float64       `toml:"session_rate_per_ip"`
+	SessionBurstPerIP int           `toml:"session_burst_per_ip"`
+	BanAfter          int           `toml:"ban_after"`
+	BanWindow         time.Duration `toml:"ban_window"`
+	BanDuration       time.Duration `toml:"ban_duration"`
+}
+
+// sourcesSettings restrict the addresses sessions are accepted from. It
+// converts to natts.SourceRules.
+type sourcesSettings struct {
+	Allow          []netip.Prefix `toml:"allow"`
+	Deny           []netip.Prefix `toml:"deny"`
+	GeoIPDatabase  string         `toml:"geoip_database"`
+	AllowCountries []string       `toml:"allow_countries"`
+	DenyCountries  []string       `toml:"deny_countries"`
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		Listen:         ":30000",
+		SSHTarget:      "127.0.0.1:22",
+		Services:       map[string]string{},
+		UDPIdleTimeout: 2 * time.Minute,
+		STUN:           stunSettings{Servers: slices.Clone(stun.DefaultServers)},
+		KCP:            config.DefaultKCP(),
+		Timeouts:       config.DefaultTimeouts(),
+		Shutdown:       shutdownSettings{DrainTimeout: 30 * time.Second},
+		Limits:         defaultLimits(),
+		Log:            config.DefaultLog(),
+	}
+}
+
+// defaultLimits leave room for many clients behind one address while keeping
+// a flood of handshakes from a single peer away from the backends
+func defaultLimits() limitsSettings {
+	return limitsSettings{
+		MaxSessions:       512,
+		MaxSessionsPerIP:  32,
+		SessionRate:       20,
+		SessionBurst:      50,
+		SessionRatePerIP:  2,
+		SessionBurstPerIP: 10,
+		BanAfter:          5,
+		BanWindow:         10 * time.Minute,
+		BanDuration:       time.Hour,
+	}
+}
+
+// cliOptions are flags that are not settings themselves
+type cliOptions struct {
+	configPath  string
+	printConfig bool
+	// args are the command and its arguments left after the flags, if any
+	args []string
+}
+
+// serviceFlags collects repeated --service name=host:port flags
+type serviceFlags map[string]string
+
+func (f serviceFlags) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+f[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f serviceFlags) Set(value string) error {
+	name, addr, ok := strings.Cut(value, "=")
+	if !ok || name == "" || addr == "" {
+		return fmt.Errorf("expected name=host:port, got %q", value)
+	}
+	f[name] = addr
+	return nil
+}
+
+// egressFlags collects repeated --allow-egress rules
+type egressFlags []natts.EgressRule
+
+func (f *egressFlags) String() string {
+	rules := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+func (f *egressFlags) Set(value string) error {
+	rule, err := natts.ParseEgressRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// prefixFlags collects repeated CIDR flags
+type prefixFlags []netip.Prefix
+
+func (f *prefixFlags) String() string {
+	prefixes := make([]string, 0, len(*f))
+	for _, p := range *f {
+		prefixes = append(prefixes, p.String())
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (f *prefixFlags) Set(value string) error {
+	p, err := netip.ParsePrefix(value)
+	if err != nil {
+		return fmt.Errorf("expected a CIDR such as 203.0.113.0/24, got %q", value)
+	}
+	*f = append(*f, p)
+	return nil
+}
+
+// listFlags collects a repeated string flag
+type listFlags []string
+
+func (f *listFlags) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// newFlagSet returns the command line flags, writing into s and opts.
+// Repeatable flags add to what s already contains.
+func newFlagSet(s *settings, opts *cliOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&opts.configPath, "config", "", "TOML config file; settings from it are overridden by environment variables and flags (env NATTS_CONFIG)")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	fs.StringVar(&s.SSHTarget, "ssh-target", s.SSHTarget, "SSH server to proxy to")
+	fs.StringVar(&s.Listen, "listen", s.Listen, "Address to listen on (e.g., :30000)")
+	fs.StringVar(&s.Admin, "admin", s.Admin, "Serve the status API on a loopback `address` (host:port) or unix socket path (disabled if empty)")
+	fs.StringVar(&s.AuditLog, "audit-log", s.AuditLog, "Append a JSON line for every session to this `file` once it ends (disabled if empty)")
+	fs.StringVar(&s.Metrics, "metrics", s.Metrics, "Address to serve Prometheus metrics on at /metrics, e.g. :9100 (disabled if empty)")
+	fs.StringVar(&s.TargetFQDN, "target-fqdn", s.TargetFQDN, "FQDN to register in DNS (env TARGET_FQDN)")
+	fs.StringVar(&s.Cloudflare.APIToken, "cf-token", s.Cloudflare.APIToken, "Cloudflare API token (env CF_API_TOKEN)")
+	fs.BoolVar(&s.Bench, "bench", s.Bench, "Serve the sink and source nattc bench measures the tunnel with")
+	fs.DurationVar(&s.UDPIdleTimeout, "udp-idle-timeout", s.UDPIdleTimeout, "Close UDP flows after this long without traffic")
+	fs.DurationVar(&s.Timeouts.KeepAliveInterval, "keepalive-interval", s.Timeouts.KeepAliveInterval, "Interval between keepalive frames sent to clients")
+	fs.DurationVar(&s.Timeouts.KeepAliveTimeout, "keepalive-timeout", s.Timeouts.KeepAliveTimeout, "Close a client session after this long without hearing from it")
+	fs.DurationVar(&s.Timeouts.IdleTimeout, "idle-timeout", s.Timeouts.IdleTimeout, "Close connections after this long without traffic (0 disables)")
+	fs.DurationVar(&s.Timeouts.MaxSessionLifetime, "max-session-lifetime", s.Timeouts.MaxSessionLifetime, "Close connections this long after they were opened (0 disables)")
+	fs.DurationVar(&s.Timeouts.ResumeTimeout, "resume-timeout", s.Timeouts.ResumeTimeout, "Keep the backend connection of a broken session open this long for nattc to resume it (0 disables)")
+	fs.DurationVar(&s.Shutdown.DrainTimeout, "drain-timeout", s.Shutdown.DrainTimeout, "On shutdown, wait this long for active connections to finish before closing them")
+	fs.BoolVar(&s.Shutdown.MarkDNSOffline, "mark-dns-offline", s.Shutdown.MarkDNSOffline, "On shutdown, replace the published port with an offline marker so clients fail fast")
+	fs.StringVar(&s.KCP.Profile, "kcp-profile", s.KCP.Profile, "KCP retransmission `profile`: standard, normal, fast, fast2, fast3 or custom (see [kcp] in the config file)")
+	fs.StringVar(&s.KCP.Compression, "compression", s.KCP.Compression, "stream `compression`: auto (on for the normal KCP profile), off, snappy or zstd")
+	fs.Var(&s.Bandwidth.Global, "bandwidth", "Cap the `rate` natts sends to all clients together, in bytes per second such as 2M (0 for unlimited)")
+	fs.StringVar(&s.Log.Format, "log-format", s.Log.Format, "Log format, text or json")
+	fs.Var(config.LogLevelFlag(&s.Log), "log-level", "Log `levels` as a default level and per-subsystem overrides, e.g. info,stun=debug,dns=warn")
+	fs.Var(serviceFlags(s.Services), "service", "Named service to expose as `name=host:port` (repeatable)")
+	fs.Var((*listFlags)(&s.AllowReverse), "allow-reverse", "`Address` clients may ask natts to listen on for reverse forwards; host:* permits any port (repeatable)")
+	fs.Var((*prefixFlags)(&s.Sources.Allow), "allow-source", "Accept sessions only from this `CIDR` or other allowed sources (repeatable)")
+	fs.Var((*prefixFlags)(&s.Sources.Deny), "deny-source", "Refuse sessions from this `CIDR` (repeatable)")
+	fs.StringVar(&s.Sources.GeoIPDatabase, "geoip-db", s.Sources.GeoIPDatabase, "Country database (MMDB) `file` for sources.allow_countries and sources.deny_countries")
+	fs.Var((*egressFlags)(&s.AllowEgress), "allow-egress", "Destination clients may dial by address, as `CIDR[:ports]`, e.g. 192.168.1.0/24:22,80,8000-8100 (repeatable)")
+	usage := config.Usage(fs)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprint(fs.Output(), commandsUsage)
+	}
+	return fs
+}
+
+// loadSettings builds the effective settings from the defaults, the config
+// file, the environment and the command line, each overriding the previous ones
+func loadSettings(args []string) (*settings, cliOptions, error) {
+	// The first pass only looks for --config
+	var opts cliOptions
+	newFlagSet(defaultSettings(), &opts).Parse(args)
+	if opts.configPath == "" {
+		config.Getenv("NATTS_CONFIG", &opts.configPath)
+	}
+
+	s := defaultSettings()
+	if opts.configPath != "" {
+		if err := config.Load(opts.configPath, s); err != nil {
+			return nil, opts, err
+		}
+		if s.Services == nil {
+			s.Services = map[string]string{}
+		}
+	}
+
+	config.Getenv("CF_API_TOKEN", &s.Cloudflare.APIToken)
+	config.Getenv("NATTS_ADMIN_TOKEN", &s.AdminToken)
+	config.Getenv("TARGET_FQDN", &s.TargetFQDN)
+
+	fs := newFlagSet(s, &opts)
+	fs.Parse(args)
+	opts.args = fs.Args()
+	return s, opts, nil
+}
+
+// validate reports every problem with the settings at once
+func (s *settings) validate() error {
+	var errs config.Errors
+
+	errs.CheckAddress("listen", s.Listen)
+	if s.Metrics != "" {
+		errs.CheckAddress("metrics", s.Metrics)
+	}
+	if s.Admin != "" && !natts.IsUnixSocket(s.Admin) {
+		checkLoopback(&errs, "admin", s.Admin)
+	}
+	if s.TargetFQDN == "" {
+		errs.Add("target_fqdn", "required (set it in the config file, TARGET_FQDN or --target-fqdn)")
+	}
+	if s.Cloudflare.APIToken == "" {
+		errs.Add("cloudflare.api_token", "required (set it in the config file, CF_API_TOKEN or --cf-token)")
+	}
+
+	if s.SSHTarget != "" {
+		errs.CheckAddress("ssh_target", s.SSHTarget)
+	}
+	for name, addr := range s.Services {
+		if name == "" {
+			errs.Add("services", "service name must not be empty")
+			continue
+		}
+		errs.CheckAddress("services."+name, addr)
+	}
+	if s.SSHTarget == "" && len(s.Services) == 0 {
+		errs.Add("services", "no services configured; set ssh_target or add a service")
+	}
+	for _, addr := range s.AllowReverse {
+		errs.CheckAddress("allow_reverse", addr)
+	}
+	if s.UDPIdleTimeout <= 0 {
+		errs.Add("udp_idle_timeout", "must be positive")
+	}
+
+	if len(s.STUN.Servers) == 0 {
+		errs.Add("stun.servers", "at least one STUN server is required")
+	}
+	for _, server := range s.STUN.Servers {
+		errs.CheckAddress("stun.servers", server)
+	}
+
+	s.KCP.Validate(&errs)
+	s.Timeouts.Validate(&errs)
+	s.Log.Validate(&errs)
+	if s.Shutdown.DrainTimeout < 0 {
+		errs.Add("shutdown.drain_timeout", "must not be negative (use 0 to close connections immediately)")
+	}
+	s.Limits.validate(&errs)
+	s.Sources.validate(&errs)
+
+	ids := map[string]bool{}
+	for i, key := range s.AuthorizedKeys {
+		key.Validate(&errs, fmt.Sprintf("authorized_keys[%d]", i))
+		if ids[key.ID] {
+			errs.Add(fmt.Sprintf("authorized_keys[%d]", i), "duplicate id %q", key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	return errs.Err()
+}
+
+func (l limitsSettings) validate(errs *config.Errors) {
+	if l.MaxSessions < 0 || l.MaxSessionsPerIP < 0 || l.SessionRate < 0 || l.SessionRatePerIP < 0 || l.BanAfter < 0 {
+		errs.Add("limits", "limits must not be negative (use 0 to disable)")
+	}
+	if l.SessionRate > 0 && l.SessionBurst < 1 {
+		errs.Add("limits.session_burst", "must be at least 1 when session_rate is set")
+	}
+	if l.SessionRatePerIP > 0 && l.SessionBurstPerIP < 1 {
+		errs.Add("limits.session_burst_per_ip", "must be at least 1 when session_rate_per_ip is set")
+	}
+	if l.BanAfter > 0 && (l.BanWindow <= 0 || l.BanDuration <= 0) {
+		errs.Add("limits", "ban_window and ban_duration must be positive when ban_after is set")
+	}
+}
+
+func (s sourcesSettings) validate(errs *config.Errors) {
+	countries := slices.Concat(s.AllowCountries, s.DenyCountries)
+	for _, code := range countries {
+		if len(code) != 2 || strings.Trim(strings.ToUpper(code), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			errs.Add("sources", "invalid country %q (use ISO 3166-1 alpha-2 codes such as JP)", code)
+		}
+	}
+	if len(countries) > 0 && s.GeoIPDatabase == "" {
+		errs.Add("sources.geoip_database", "required for allow_countries and deny_countries")
+	}
+	if s.GeoIPDatabase != "" {
+		if _, err := os.Stat(s.GeoIPDatabase); err != nil {
+			errs.Add("sources.geoip_database", "%v", err)
+		}
+	}
+}
+
+// checkLoopback records a problem if addr is not a host:port address on a loopback interface
+func checkLoopback(errs *config.Errors, setting, addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.CheckAddress(setting, addr)
+		return
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		errs.Add(setting, "%q must be a loopback address such as 127.0.0.1:9200, or a unix socket path", addr)
+	}
+}
+
+// restartRequired lists the settings that differ from running but can only
+// be applied by restarting natts
+func (s *settings) restartRequired(running *settings) []string {
+	var changed []string
+	if s.Listen != running.Listen {
+		changed = append(changed, "listen")
+	}
+	if s.Metrics != running.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if s.Admin != running.Admin {
+		changed = append(changed, "admin")
+	}
+	if s.AdminToken != running.AdminToken {
+		changed = append(changed, "admin_token")
+	}
+	if s.TargetFQDN != running.TargetFQDN {
+		changed = append(changed, "target_fqdn")
+	}
+	if s.KCP != running.KCP {
+		changed = append(changed, "kcp")
+	}
+	if s.Shutdown.DrainTimeout != running.Shutdown.DrainTimeout {
+		changed = append(changed, "shutdown.drain_timeout")
+	}
+	if s.Log.Format != running.Log.Format {
+		changed = append(changed, "log.format")
+	}
+	return changed
+}
+
+// redacted returns a copy of s that is safe to print
+func (s *settings) redacted() *settings {
+	r := *s
+	r.Cloudflare.APIToken = config.Redact(s.Cloudflare.APIToken)
+	r.AdminToken = config.Redact(s.AdminToken)
+	r.AuthorizedKeys = make([]config.Key, 0, len(s.AuthorizedKeys))
+	for _, key := range s.AuthorizedKeys {
+		r.AuthorizedKeys = append(r.AuthorizedKeys, key.Redacted())
+	}
+	return &r
+}
+
+// serverConfig converts the settings to the natts server configuration
+func (s *settings) serverConfig() natts.Config {
+	keys := make([]tunnel.Key, 0, len(s.AuthorizedKeys))
+	for _, key := range s.AuthorizedKeys {
+		keys = append(keys, key.Tunnel())
+	}
+
+	return natts.Config{
+		SSHTarget:             s.SSHTarget,
+		TargetFQDN:            s.TargetFQDN,
+		CFToken:               s.Cloudflare.APIToken,
+		Services:              s.Services,
+		Egress:                s.AllowEgress,
+		ReverseListen:         s.AllowReverse,
+		UDPIdleTimeout:        s.UDPIdleTimeout,
+		Timeouts:              s.Timeouts.Tunnel(),
+		STUNServers:           s.STUN.Servers,
+		KCP:                   s.KCP.Options(),
+		AuthorizedKeys:        keys,
+		MarkOfflineOnShutdown: s.Shutdown.MarkDNSOffline,
+		AuditLog:              s.AuditLog,
+		Limits:                natts.Limits(s.Limits),
+		Bandwidth:             s.Bandwidth.Limits(),
+		Sources:               natts.SourceRules(s.Sources),
+		Bench:                 s.Bench,
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Hogeyama/ddns-updater/internal/doctor"
+	"github.com/Hogeyama/ddns-updater/internal/natts"
+)
+
+// runDoctor checks what natts needs to be reachable and prints the results
+func runDoctor(cfg *settings) error {
+	report := doctor.New(os.Stdout)
+	if err := natts.Doctor(cfg.serverConfig(), cfg.Listen, report); err != nil {
+		return err
+	}
+	report.Summary()
+	if report.Failed() {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
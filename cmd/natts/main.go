@@ -2,60 +2,61 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/Hogeyama/ddns-updater/internal/config"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
 	"github.com/Hogeyama/ddns-updater/internal/natts"
 )
 
 func main() {
-	var (
-		sshTarget  = flag.String("ssh-target", "127.0.0.1:22", "SSH server to proxy to")
-		listenAddr = flag.String("listen", ":30000", "Address to listen on (e.g., :03000)")
-		targetFQDN = flag.String("target-fqdn", "", "FQDN to register in DNS")
-		cfToken    = flag.String("cf-token", "", "Cloudflare API token")
-	)
-	// Custom usage function
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  --cf-token string\n")
-		fmt.Fprintf(os.Stderr, "    \tCloudflare API token\n")
-		fmt.Fprintf(os.Stderr, "  --listen string\n")
-		fmt.Fprintf(os.Stderr, "    \tAddress to listen on (e.g., :30000) (default \":30000\")\n")
-		fmt.Fprintf(os.Stderr, "  --ssh-target string\n")
-		fmt.Fprintf(os.Stderr, "    \tSSH server to proxy to (default \"127.0.0.1:22\")\n")
-		fmt.Fprintf(os.Stderr, "  --target-fqdn string\n")
-		fmt.Fprintf(os.Stderr, "    \tFQDN to register in DNS\n")
+	cfg, opts, err := loadSettings(os.Args[1:])
+	if err != nil {
+		exit(err)
 	}
-	flag.Parse()
-
-	// Get values from environment if not provided via flags
-	if *cfToken == "" {
-		*cfToken = os.Getenv("CF_API_TOKEN")
+	if opts.printConfig {
+		if err := config.Print(os.Stdout, cfg.redacted()); err != nil {
+			exit(fmt.Errorf("failed to print config: %w", err))
+		}
+	}
+	if len(opts.args) == 1 && opts.args[0] == "doctor" && !opts.printConfig {
+		if err := cfg.validate(); err != nil {
+			exit(err)
+		}
+		if err := runDoctor(cfg); err != nil {
+			exit(err)
+		}
+		return
+	}
+	if len(opts.args) > 0 && !opts.printConfig {
+		if err := runCommand(cfg, opts.args); err != nil {
+			exit(err)
+		}
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		exit(err)
 	}
-	if *targetFQDN == "" {
-		*targetFQDN = os.Getenv("TARGET_FQDN")
+	if opts.printConfig {
+		return
 	}
 
-	if *cfToken == "" {
-		log.Fatal("CF_API_TOKEN is required (via flag or environment variable)")
+	if err := logging.Setup(os.Stderr, cfg.Log.Format); err != nil {
+		exit(err)
 	}
-	if *targetFQDN == "" {
-		log.Fatal("TARGET_FQDN is required (via flag or environment variable)")
+	if err := cfg.Log.ApplyLevels(); err != nil {
+		exit(err)
 	}
 
 	// Create server
-	server, err := natts.New(natts.Config{
-		SSHTarget:  *sshTarget,
-		TargetFQDN: *targetFQDN,
-		CFToken:    *cfToken,
-	})
+	server, err := natts.New(cfg.serverConfig())
 	if err != nil {
-		log.Fatalf("Failed to create natts server: %v", err)
+		fatal("failed to create natts server", err)
 	}
 
 	// Setup context for graceful shutdown
@@ -67,28 +68,113 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-sigChan
-		log.Println("Received shutdown signal")
-		cancel()
+		select {
+		case <-sigChan:
+			slog.Info("received shutdown signal")
+			cancel()
+		case <-server.DrainRequested():
+		}
+	}()
+
+	// Reload the config file on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			reload(server, cfg)
+		}
 	}()
 
 	// Start server
-	log.Printf("Starting natts server...")
-	log.Printf("  SSH target: %s", *sshTarget)
-	log.Printf("  Target FQDN: %s", *targetFQDN)
-	log.Printf("  Listen address: %s", *listenAddr)
+	slog.Info("starting natts", "target_fqdn", cfg.TargetFQDN, "listen", cfg.Listen, "ssh_target", cfg.SSHTarget)
+	for name, addr := range cfg.Services {
+		slog.Info("service", "name", name, "address", addr)
+	}
+	for _, rule := range cfg.AllowEgress {
+		slog.Info("allowed egress", "rule", rule.String())
+	}
+	for _, addr := range cfg.AllowReverse {
+		slog.Info("allowed reverse listener", "address", addr)
+	}
+	if len(cfg.AuthorizedKeys) > 0 {
+		slog.Info("authentication required", "authorized_keys", len(cfg.AuthorizedKeys))
+	}
 
-	if err := server.Start(ctx, *listenAddr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if cfg.Metrics != "" {
+		if err := metrics.Serve(cfg.Metrics); err != nil {
+			fatal("failed to serve metrics", err)
+		}
+		slog.Info("serving metrics", "url", cfg.Metrics+"/metrics")
+	}
+	if cfg.Admin != "" {
+		if err := server.ServeAdmin(cfg.Admin, cfg.AdminToken); err != nil {
+			fatal("failed to serve admin API", err)
+		}
+		slog.Info("serving admin API", "address", cfg.Admin)
 	}
 
-	// Wait for shutdown
-	<-ctx.Done()
-	log.Println("Shutting down...")
+	if err := server.Start(ctx, cfg.Listen); err != nil {
+		fatal("failed to start server", err)
+	}
 
-	if err := server.Close(); err != nil {
-		log.Printf("Error closing server: %v", err)
+	// Wait for a shutdown signal or a drain requested through the admin API
+	select {
+	case <-ctx.Done():
+	case <-server.DrainRequested():
 	}
+	slog.Info("shutting down, waiting for active connections", "drain_timeout", cfg.Shutdown.DrainTimeout)
+
+	// A second signal skips the rest of the drain
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.Shutdown.DrainTimeout)
+	defer cancelDrain()
 
-	log.Println("Server stopped")
+	go func() {
+		<-sigChan
+		slog.Info("received second shutdown signal, closing immediately")
+		cancelDrain()
+	}()
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Error("failed to close server", "error", err)
+	}
+
+	slog.Info("server stopped")
+}
+
+// exit reports an error that occurred before logging was set up and exits
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// fatal logs an error that stops the process and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// reload re-reads the configuration and applies what can change while natts
+// is running. Settings that need a restart are reported and left unchanged.
+func reload(server *natts.Server, running *settings) {
+	slog.Info("received SIGHUP, reloading configuration")
+
+	cfg, _, err := loadSettings(os.Args[1:])
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		slog.Error("failed to reload configuration, keeping the current one", "error", err)
+		return
+	}
+
+	for _, name := range cfg.restartRequired(running) {
+		slog.Warn("setting changed but only takes effect after restarting natts", "setting", name)
+	}
+
+	if err := server.Reload(cfg.serverConfig()); err != nil {
+		slog.Error("failed to reload configuration, keeping the current one", "error", err)
+		return
+	}
+	cfg.Log.ApplyLevels()
 }
@@ -0,0 +1,491 @@
+// Package config loads the TOML configuration files of natts and nattc.
+//
+// Settings are taken from the built-in defaults, then the config file, then
+// environment variables and finally command line flags, each overriding the
+// previous ones.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// redacted replaces secrets in printed configurations
+const redacted = "<redacted>"
+
+// minSecretLength is the shortest auth key secret accepted
+const minSecretLength = 16
+
+// Load decodes the TOML file at path into v. Settings v has no field for
+// are reported as errors rather than ignored.
+func Load(path string, v any) error {
+	md, err := toml.DecodeFile(path, v)
+	if err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return fmt.Errorf("failed to parse %s:\n%s", path, perr.ErrorWithPosition())
+		}
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return fmt.Errorf("unknown settings in %s: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// Print writes v as TOML
+func Print(w io.Writer, v any) error {
+	return toml.NewEncoder(w).Encode(v)
+}
+
+// Redact returns a placeholder for a secret, or an empty string if it is not set
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// Getenv sets *value to the environment variable key if it is set
+func Getenv(key string, value *string) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		*value = v
+	}
+}
+
+// Usage returns a flag.Usage function that lists the flags of fs. Flags with
+// long names are shown with two dashes, the way they are usually written.
+func Usage(fs *flag.FlagSet) func() {
+	return func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", fs.Name())
+		fs.VisitAll(func(f *flag.Flag) {
+			dashes := "--"
+			if len(f.Name) == 1 {
+				dashes = "-"
+			}
+			typ, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(w, "  %s%s", dashes, f.Name)
+			if typ != "" {
+				fmt.Fprintf(w, " %s", typ)
+			}
+			fmt.Fprintf(w, "\n    \t%s", strings.ReplaceAll(usage, "\n", "\n    \t"))
+			switch f.DefValue {
+			case "", "0", "0s", "false":
+			default:
+				if typ == "string" {
+					fmt.Fprintf(w, " (default %q)", f.DefValue)
+				} else {
+					fmt.Fprintf(w, " (default %s)", f.DefValue)
+				}
+			}
+			fmt.Fprintln(w)
+		})
+	}
+}
+
+// Errors collects the problems found while validating a configuration
+type Errors []string
+
+// Add records a problem with setting
+func (e *Errors) Add(setting, format string, args ...any) {
+	*e = append(*e, setting+": "+fmt.Sprintf(format, args...))
+}
+
+// Err returns an error listing every problem, or nil if there were none
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// CheckAddress records a problem if addr is not a host:port pair
+func (e *Errors) CheckAddress(setting, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		e.Add(setting, "%q is not a host:port address", addr)
+	}
+}
+
+// Timeouts is the [timeouts] section shared by natts and nattc
+type Timeouts struct {
+	KeepAliveInterval  time.Duration `toml:"keepalive_interval"`
+	KeepAliveTimeout   time.Duration `toml:"keepalive_timeout"`
+	IdleTimeout        time.Duration `toml:"idle_timeout"`
+	MaxSessionLifetime time.Duration `toml:"max_session_lifetime"`
+	ResumeTimeout      time.Duration `toml:"resume_timeout"`
+}
+
+// DefaultTimeouts returns the timeouts used when nothing is configured
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		KeepAliveInterval: tunnel.DefaultKeepAliveInterval,
+		KeepAliveTimeout:  tunnel.DefaultKeepAliveTimeout,
+		ResumeTimeout:     tunnel.DefaultResumeTimeout,
+	}
+}
+
+func (t Timeouts) Tunnel() tunnel.Timeouts {
+	return tunnel.Timeouts{
+		KeepAliveInterval: t.KeepAliveInterval,
+		KeepAliveTimeout:  t.KeepAliveTimeout,
+		IdleTimeout:       t.IdleTimeout,
+		MaxLifetime:       t.MaxSessionLifetime,
+		ResumeTimeout:     t.ResumeTimeout,
+	}
+}
+
+func (t Timeouts) Validate(e *Errors) {
+	if t.KeepAliveInterval <= 0 {
+		e.Add("timeouts.keepalive_interval", "must be positive")
+	}
+	if t.KeepAliveTimeout < t.KeepAliveInterval {
+		e.Add("timeouts.keepalive_timeout", "must not be shorter than keepalive_interval (%s)", t.KeepAliveInterval)
+	}
+	if t.IdleTimeout < 0 {
+		e.Add("timeouts.idle_timeout", "must not be negative (use 0 to disable)")
+	}
+	if t.MaxSessionLifetime < 0 {
+		e.Add("timeouts.max_session_lifetime", "must not be negative (use 0 to disable)")
+	}
+	if t.ResumeTimeout < 0 {
+		e.Add("timeouts.resume_timeout", "must not be negative (use 0 to disable)")
+	}
+}
+
+// customKCPProfile is the profile name for retransmission settings given one by one
+const customKCPProfile = "custom"
+
+// KCP is the [kcp] section shared by natts and nattc
+type KCP struct {
+	// Profile is one of tunnel.KCPProfiles or "custom"
+	Profile      string `toml:"profile"`
+	DataShards   int    `toml:"data_shards"`
+	ParityShards int    `toml:"parity_shards"`
+	SendWindow   int    `toml:"send_window"`
+	RecvWindow   int    `toml:"recv_window"`
+	MTU          int    `toml:"mtu"`
+	DSCP         int    `toml:"dscp"`
+	ACKNoDelay   bool   `toml:"ack_nodelay"`
+	// AdaptiveFEC sends between MinParityShards and ParityShards parity shards
+	// depending on the loss the peer sees. It only drops parity: DataShards
+	// stay fixed and ParityShards is the most ever sent.
+	AdaptiveFEC     bool `toml:"adaptive_fec"`
+	MinParityShards int  `toml:"min_parity_shards"`
+	// Compression is "auto", "off", "snappy" or "zstd"
+	Compression string `toml:"compression"`
+	// The retransmission settings of the custom profile
+	NoDelay      bool          `toml:"nodelay"`
+	Interval     time.Duration `toml:"interval"`
+	Resend       int           `toml:"resend"`
+	NoCongestion bool          `toml:"no_congestion"`
+}
+
+// DefaultKCP returns the KCP settings used when nothing is configured
+func DefaultKCP() KCP {
+	d := tunnel.DefaultKCPOptions
+	return KCP{
+		Profile:      "standard",
+		DataShards:   d.DataShards,
+		ParityShards: d.ParityShards,
+		SendWindow:   d.SendWindow,
+		RecvWindow:   d.RecvWindow,
+		MTU:          d.MTU,
+		Compression:  d.Compression,
+	}
+}
+
+func (k KCP) Options() tunnel.KCPOptions {
+	profile, ok := tunnel.KCPProfiles[k.Profile]
+	if !ok {
+		profile = tunnel.KCPProfile{NoDelay: k.NoDelay, Interval: k.Interval, Resend: k.Resend, NoCongestion: k.NoCongestion}
+	}
+	return tunnel.KCPOptions{
+		DataShards:   k.DataShards,
+		ParityShards: k.ParityShards,
+		Profile:      profile,
+		SendWindow:   k.SendWindow,
+		RecvWindow:   k.RecvWindow,
+		MTU:          k.MTU,
+		DSCP:         k.DSCP,
+		ACKNoDelay:   k.ACKNoDelay,
+
+		AdaptiveFEC:     k.AdaptiveFEC,
+		MinParityShards: k.MinParityShards,
+
+		Compression: k.Compression,
+	}
+}
+
+func (k KCP) Validate(e *Errors) {
+	switch {
+	case k.DataShards < 0 || k.ParityShards < 0:
+		e.Add("kcp", "data_shards and parity_shards must not be negative")
+	case (k.DataShards == 0) != (k.ParityShards == 0):
+		e.Add("kcp", "data_shards and parity_shards must both be set, or both be 0 to disable FEC")
+	case k.DataShards+k.ParityShards > 256:
+		e.Add("kcp", "data_shards + parity_shards must not exceed 256")
+	}
+
+	if k.AdaptiveFEC && k.DataShards == 0 {
+		e.Add("kcp.adaptive_fec", "needs FEC; set data_shards and parity_shards")
+	}
+	if k.MinParityShards < 0 || k.MinParityShards > k.ParityShards {
+		e.Add("kcp.min_parity_shards", "must be between 0 and parity_shards")
+	} else if k.AdaptiveFEC && k.DataShards > 0 && k.MinParityShards == k.ParityShards {
+		e.Add("kcp.min_parity_shards", "must be below parity_shards, the most adaptive FEC sends, or there is nothing to adapt")
+	}
+
+	custom := k.NoDelay || k.Interval != 0 || k.Resend != 0 || k.NoCongestion
+	if _, ok := tunnel.KCPProfiles[k.Profile]; ok {
+		if custom {
+			e.Add("kcp", "nodelay, interval, resend and no_congestion only apply to profile = %q", customKCPProfile)
+		}
+	} else if k.Profile == customKCPProfile {
+		if k.Interval < 10*time.Millisecond || k.Interval > 5*time.Second {
+			e.Add("kcp.interval", "must be between 10ms and 5s")
+		}
+		if k.Resend < 0 {
+			e.Add("kcp.resend", "must not be negative (use 0 to disable fast resend)")
+		}
+	} else {
+		e.Add("kcp.profile", "unknown profile %q (use standard, normal, fast, fast2, fast3 or custom)", k.Profile)
+	}
+
+	if k.SendWindow < 1 || k.RecvWindow < 1 {
+		e.Add("kcp", "send_window and recv_window must be at least 1")
+	}
+	if k.MTU < 576 || k.MTU > 1500 {
+		e.Add("kcp.mtu", "must be between 576 and 1500")
+	}
+	if k.DSCP < 0 || k.DSCP > 63 {
+		e.Add("kcp.dscp", "must be between 0 and 63")
+	}
+	if k.Compression != "auto" && k.Compression != "off" && !slices.Contains(tunnel.CompressionAlgorithms, k.Compression) {
+		e.Add("kcp.compression", "unknown compression %q (use auto, off, snappy or zstd)", k.Compression)
+	}
+}
+
+// Key is an auth key shared between nattc and natts
+type Key struct {
+	ID     string `toml:"id"`
+	Secret string `toml:"secret"`
+}
+
+// ParseKey parses a key given as id=secret
+func ParseKey(s string) (Key, error) {
+	id, secret, ok := strings.Cut(s, "=")
+	if !ok {
+		return Key{}, fmt.Errorf("expected id=secret")
+	}
+	return Key{ID: id, Secret: secret}, nil
+}
+
+func (k Key) Tunnel() tunnel.Key {
+	return tunnel.Key{ID: k.ID, Secret: k.Secret}
+}
+
+func (k Key) Redacted() Key {
+	return Key{ID: k.ID, Secret: Redact(k.Secret)}
+}
+
+func (k Key) Validate(e *Errors, setting string) {
+	if k.ID == "" {
+		e.Add(setting, "id must not be empty")
+	}
+	if strings.ContainsAny(k.ID, "= \t") {
+		e.Add(setting, "id %q must not contain '=' or whitespace", k.ID)
+	}
+	if len(k.Secret) < minSecretLength {
+		e.Add(setting, "secret of key %q must be at least %d characters", k.ID, minSecretLength)
+	}
+}
+
+// Log is the [log] section shared by natts and nattc
+type Log struct {
+	// Format is "text" or "json"
+	Format string `toml:"format"`
+	Level  string `toml:"level"`
+	// Levels overrides Level for individual subsystems
+	Levels map[string]string `toml:"levels"`
+}
+
+// DefaultLog returns the log settings used when nothing is configured
+func DefaultLog() Log {
+	return Log{Format: logging.Text, Level: "info", Levels: map[string]string{}}
+}
+
+func (l Log) Validate(e *Errors) {
+	if l.Format != logging.Text && l.Format != logging.JSON {
+		e.Add("log.format", "must be %q or %q, got %q", logging.Text, logging.JSON, l.Format)
+	}
+	if _, _, err := l.levels(); err != nil {
+		e.Add("log", "%v", err)
+	}
+}
+
+// ApplyLevels sets the levels of the loggers; it can be called again on reload
+func (l Log) ApplyLevels() error {
+	level, overrides, err := l.levels()
+	if err != nil {
+		return err
+	}
+	logging.SetLevels(level, overrides)
+	return nil
+}
+
+func (l Log) levels() (slog.Level, map[string]slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return 0, nil, fmt.Errorf("invalid level %q (use debug, info, warn or error)", l.Level)
+	}
+
+	overrides := make(map[string]slog.Level, len(l.Levels))
+	for name, value := range l.Levels {
+		if !slices.Contains(logging.Subsystems, name) {
+			return 0, nil, fmt.Errorf("unknown subsystem %q in levels (use %s)", name, strings.Join(logging.Subsystems, ", "))
+		}
+		var sub slog.Level
+		if err := sub.UnmarshalText([]byte(value)); err != nil {
+			return 0, nil, fmt.Errorf("invalid level %q for %s (use debug, info, warn or error)", value, name)
+		}
+		overrides[name] = sub
+	}
+	return level, overrides, nil
+}
+
+// LogLevelFlag returns a flag that sets the levels of l from a list such as
+// "info,stun=debug,dns=warn": a plain level sets Level, subsystem=level
+// overrides it for that subsystem
+func LogLevelFlag(l *Log) flag.Value {
+	return (*logLevelFlag)(l)
+}
+
+type logLevelFlag Log
+
+func (f *logLevelFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := []string{f.Level}
+	names := make([]string, 0, len(f.Levels))
+	for name := range f.Levels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		parts = append(parts, name+"="+f.Levels[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *logLevelFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		name, level, ok := strings.Cut(item, "=")
+		if !ok {
+			f.Level = item
+			continue
+		}
+		if f.Levels == nil {
+			f.Levels = map[string]string{}
+		}
+		f.Levels[name] = level
+	}
+	return nil
+}
+
+// Rate is a bandwidth in bytes per second, written as a number with an
+// optional K, M or G suffix for multiples of 1024, e.g. "512K" or "1.5M"
+type Rate int64
+
+// ParseRate parses a Rate; "0" means unlimited
+func ParseRate(s string) (Rate, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := 1.0
+	if num != "" {
+		switch num[len(num)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid rate %q (use bytes per second such as 512K or 2M)", s)
+	}
+	return Rate(v * mult), nil
+}
+
+func (r Rate) String() string {
+	switch {
+	case r >= 1<<30 && r%(1<<30) == 0:
+		return strconv.FormatInt(int64(r>>30), 10) + "G"
+	case r >= 1<<20 && r%(1<<20) == 0:
+		return strconv.FormatInt(int64(r>>20), 10) + "M"
+	case r >= 1<<10 && r%(1<<10) == 0:
+		return strconv.FormatInt(int64(r>>10), 10) + "K"
+	default:
+		return strconv.FormatInt(int64(r), 10)
+	}
+}
+
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalText(text []byte) error {
+	return r.Set(string(text))
+}
+
+// Set parses a Rate given as a flag
+func (r *Rate) Set(s string) error {
+	v, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// Bandwidth is the [bandwidth] section shared by natts and nattc: caps on the
+// bytes per second each side sends through the tunnel, 0 meaning unlimited
+type Bandwidth struct {
+	Global     Rate `toml:"global"`
+	PerSession Rate `toml:"per_session"`
+	// Services limits the connections of each service; "egress" covers SOCKS
+	// and address forwards, "reverse" reverse forwards
+	Services map[string]Rate `toml:"services"`
+}
+
+func (b Bandwidth) Limits() tunnel.BandwidthLimits {
+	services := make(map[string]int64, len(b.Services))
+	for name, rate := range b.Services {
+		services[name] = int64(rate)
+	}
+	return tunnel.BandwidthLimits{Global: int64(b.Global), PerSession: int64(b.PerSession), Services: services}
+}
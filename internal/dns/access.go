@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// Errors of CheckAccess, telling which permission is missing
+var (
+	ErrTokenInvalid = errors.New("API token is not valid")
+	ErrNoZone       = errors.New("API token cannot access the zone")
+	ErrNoRecords    = errors.New("API token cannot list the DNS records of the zone")
+)
+
+// Published are the records natts publishes for an FQDN, as Cloudflare has them
+type Published struct {
+	ZoneID string
+	// IPv4 are the contents of the A records
+	IPv4 []string
+	// Port is the port of the kcp-port TXT record, or "" if there is none
+	Port string
+	// Offline is set if the TXT record marks natts offline
+	Offline bool
+}
+
+// CheckAccess checks that apiToken is active and can read the zone and DNS
+// records of fqdn, the way UpdateRecords uses them, and returns what is
+// published for fqdn. It does not change any record.
+func CheckAccess(ctx context.Context, apiToken, fqdn string) (*Published, error) {
+	api, err := cloudflare.NewWithAPIToken(apiToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
+	}
+
+	token, err := api.VerifyAPIToken(ctx)
+	var apiErr *cloudflare.Error
+	if errors.As(err, &apiErr) {
+		return nil, fmt.Errorf("%w: %w", ErrTokenInvalid, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Cloudflare: %w", err)
+	}
+	if token.Status != "active" {
+		return nil, fmt.Errorf("%w: token is %s", ErrTokenInvalid, token.Status)
+	}
+
+	zoneID, err := getZoneId(api, fqdn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoZone, err)
+	}
+
+	records, _, err := api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(zoneID), cloudflare.ListDNSRecordsParams{Name: fqdn})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoRecords, err)
+	}
+
+	published := &Published{ZoneID: zoneID}
+	for _, record := range records {
+		switch record.Type {
+		case "A":
+			published.IPv4 = append(published.IPv4, record.Content)
+		case "TXT":
+			text := strings.Trim(record.Content, `"`)
+			if text == OfflineMarker {
+				published.Offline = true
+			} else if port, ok := strings.CutPrefix(text, "kcp-port="); ok {
+				published.Port = port
+			}
+		}
+	}
+	return published, nil
+}
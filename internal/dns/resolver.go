@@ -1,16 +1,42 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 )
 
-// ResolveTarget resolves FQDN to get IP and port from TXT record with kcp-port prefix
-func ResolveTarget(fqdn string) (string, error) {
+// OfflineMarker is published in place of the port while natts is stopped
+const OfflineMarker = "kcp-offline"
+
+// PortRecord returns the TXT record that publishes port
+func PortRecord(port int) string {
+	return fmt.Sprintf("kcp-port=%d", port)
+}
+
+// ErrOffline is returned by ResolveTarget when natts has marked itself offline
+var ErrOffline = errors.New("natts is offline")
+
+// ResolveAddress returns target as it is if it is a host:port, such as a natts
+// on loopback, and resolves it with ResolveTarget otherwise. Only nattc bench
+// takes such targets.
+func ResolveAddress(r *net.Resolver, target string) (string, error) {
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			return target, nil
+		}
+	}
+	return ResolveTarget(r, target)
+}
+
+// ResolveTarget resolves FQDN to get IP and port from TXT record with kcp-port prefix,
+// asking r, or the system resolver if r is nil
+func ResolveTarget(r *net.Resolver, fqdn string) (string, error) {
 	// Resolve A record to get IP
-	ips, err := net.LookupIP(fqdn)
+	ips, err := r.LookupIP(context.Background(), "ip", fqdn)
 	if err != nil {
 		return "", fmt.Errorf("failed to lookup IP for %s: %w", fqdn, err)
 	}
@@ -22,13 +48,16 @@ func ResolveTarget(fqdn string) (string, error) {
 	ip := ips[0]
 
 	// Resolve TXT record to get port
-	txtRecords, err := net.LookupTXT(fqdn)
+	txtRecords, err := r.LookupTXT(context.Background(), fqdn)
 	if err != nil {
 		return "", fmt.Errorf("failed to lookup TXT records for %s: %w", fqdn, err)
 	}
 
 	var port string
 	for _, txt := range txtRecords {
+		if txt == OfflineMarker {
+			return "", fmt.Errorf("%s: %w", fqdn, ErrOffline)
+		}
 		if strings.HasPrefix(txt, "kcp-port=") {
 			port = strings.TrimPrefix(txt, "kcp-port=")
 			break
@@ -45,4 +74,4 @@ func ResolveTarget(fqdn string) (string, error) {
 	}
 
 	return net.JoinHostPort(ip.String(), port), nil
-}
\ No newline at end of file
+}
@@ -3,11 +3,44 @@ package dns
 import (
 	"context"
 	"fmt"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
 	"github.com/cloudflare/cloudflare-go"
 	"strings"
+	"time"
 )
 
-func UpdateRecords(ctx context.Context, apiToken, fqdn, ipv4 string, port int) error {
+var log = logging.For(logging.DNS)
+
+// Updater publishes the address natts is reachable at
+type Updater interface {
+	// Update points the A record of fqdn at ipv4 and its TXT record at port
+	Update(ctx context.Context, fqdn, ipv4 string, port int) error
+	// MarkOffline replaces the port published for fqdn with the offline marker
+	MarkOffline(ctx context.Context, fqdn string) error
+}
+
+// Cloudflare updates the records through the Cloudflare API
+type Cloudflare struct {
+	APIToken string
+}
+
+func (c Cloudflare) Update(ctx context.Context, fqdn, ipv4 string, port int) error {
+	return updateRecords(ctx, c.APIToken, fqdn, ipv4, port)
+}
+
+func (c Cloudflare) MarkOffline(ctx context.Context, fqdn string) error {
+	return markOffline(ctx, c.APIToken, fqdn)
+}
+
+// UpdateRecords publishes ipv4 and port for fqdn with u
+func UpdateRecords(ctx context.Context, u Updater, fqdn, ipv4 string, port int) error {
+	err := u.Update(ctx, fqdn, ipv4, port)
+	observe(metrics.Endpoint(ipv4, port), err)
+	return err
+}
+
+func updateRecords(ctx context.Context, apiToken, fqdn, ipv4 string, port int) error {
 	api, err := cloudflare.NewWithAPIToken(apiToken)
 	if err != nil {
 		return err
@@ -24,7 +57,41 @@ func UpdateRecords(ctx context.Context, apiToken, fqdn, ipv4 string, port int) e
 		return err
 	}
 
-	return upsertTXTRecord(ctx, api, rc, fqdn, port)
+	return upsertTXTRecord(ctx, api, rc, fqdn, PortRecord(port))
+}
+
+// MarkOffline replaces the port published for fqdn with an offline marker,
+// so that clients fail fast instead of timing out against a stopped natts
+func MarkOffline(ctx context.Context, u Updater, fqdn string) error {
+	err := u.MarkOffline(ctx, fqdn)
+	observe("offline", err)
+	return err
+}
+
+func markOffline(ctx context.Context, apiToken, fqdn string) error {
+	api, err := cloudflare.NewWithAPIToken(apiToken)
+	if err != nil {
+		return err
+	}
+
+	zoneID, err := getZoneId(api, fqdn)
+	if err != nil {
+		return err
+	}
+
+	return upsertTXTRecord(ctx, api, cloudflare.ZoneIdentifier(zoneID), fqdn, OfflineMarker)
+}
+
+// observe records the outcome of publishing endpoint
+func observe(endpoint string, err error) {
+	metrics.DNSUpdates.WithLabelValues(metrics.Result(err)).Inc()
+	if err != nil {
+		log.Debug("DNS update failed", "endpoint", endpoint, "error", err)
+	} else {
+		log.Debug("DNS update succeeded", "endpoint", endpoint)
+		metrics.DNSLastUpdate.Set(float64(time.Now().Unix()))
+		metrics.SetEndpoint(metrics.DNSEndpoint, endpoint)
+	}
 }
 
 func getZoneId(api *cloudflare.API, fqdn string) (string, error) {
@@ -89,8 +156,8 @@ func upsertIPv4Record(ctx context.Context, api *cloudflare.API, rc *cloudflare.R
 	return nil
 }
 
-func upsertTXTRecord(ctx context.Context, api *cloudflare.API, rc *cloudflare.ResourceContainer, fqdn string, port int) error {
-	content := fmt.Sprintf("\"kcp-port=%d\"", port)
+func upsertTXTRecord(ctx context.Context, api *cloudflare.API, rc *cloudflare.ResourceContainer, fqdn, text string) error {
+	content := fmt.Sprintf("\"%s\"", text)
 	txtRecordID, err := getRecordId(ctx, api, rc, "TXT", fqdn)
 	if err != nil {
 		// Record doesn't exist, create it
@@ -0,0 +1,87 @@
+// Package doctor reports the checks of natts doctor and nattc doctor
+package doctor
+
+import (
+	"fmt"
+	"io"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	OK   Status = "ok"
+	Warn Status = "warn"
+	Fail Status = "fail"
+	// Skip is for checks that cannot run because an earlier one failed
+	Skip Status = "skip"
+)
+
+// Result is the outcome of a check
+type Result struct {
+	Check  string
+	Status Status
+	Detail string
+	// Fix says what to do about a failure or warning
+	Fix string
+}
+
+// Report collects the results of the checks and prints each as it comes in,
+// since some checks wait for timeouts
+type Report struct {
+	w       io.Writer
+	Results []Result
+}
+
+// New returns a report that prints to w
+func New(w io.Writer) *Report {
+	return &Report{w: w}
+}
+
+// OK records a check that passed
+func (r *Report) OK(check, format string, args ...any) {
+	r.add(Result{Check: check, Status: OK, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Warn records a check that passed with a problem that may stop clients from connecting
+func (r *Report) Warn(check, detail, fix string) {
+	r.add(Result{Check: check, Status: Warn, Detail: detail, Fix: fix})
+}
+
+// Fail records a check that failed
+func (r *Report) Fail(check, detail, fix string) {
+	r.add(Result{Check: check, Status: Fail, Detail: detail, Fix: fix})
+}
+
+// Skip records a check that did not run
+func (r *Report) Skip(check, reason string) {
+	r.add(Result{Check: check, Status: Skip, Detail: reason})
+}
+
+func (r *Report) add(result Result) {
+	r.Results = append(r.Results, result)
+	label := map[Status]string{OK: "ok", Warn: "WARN", Fail: "FAIL", Skip: "skip"}[result.Status]
+	fmt.Fprintf(r.w, "%-4s  %s: %s\n", label, result.Check, result.Detail)
+	if result.Fix != "" {
+		fmt.Fprintf(r.w, "      fix: %s\n", result.Fix)
+	}
+}
+
+// Failed reports whether any check failed
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary prints how many checks passed, warned and failed
+func (r *Report) Summary() {
+	counts := map[Status]int{}
+	for _, result := range r.Results {
+		counts[result.Status]++
+	}
+	fmt.Fprintf(r.w, "\n%d ok, %d warnings, %d failed, %d skipped\n", counts[OK], counts[Warn], counts[Fail], counts[Skip])
+}
@@ -0,0 +1,335 @@
+// Package e2e runs natts and nattc together in one process, with fake STUN
+// and DNS servers and an echo backend in place of the Internet and sshd
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/nattc"
+	"github.com/Hogeyama/ddns-updater/internal/natts"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+const fqdn = "natts.e2e.test"
+
+// timeouts notice a broken session quickly, so that nattc reconnects within a test
+var timeouts = tunnel.Timeouts{
+	KeepAliveInterval: 200 * time.Millisecond,
+	KeepAliveTimeout:  2 * time.Second,
+}
+
+// kcpOptions move the test data quickly over loopback; the conservative
+// defaults would take minutes for TestDataIntegrity
+var kcpOptions = func() tunnel.KCPOptions {
+	o := tunnel.DefaultKCPOptions
+	o.Profile = tunnel.KCPProfiles["fast"]
+	o.SendWindow, o.RecvWindow = 256, 512
+	return o
+}()
+
+// variant is a configuration the tests run over besides the default
+type variant struct {
+	name string
+	// kcp changes the KCP options of both natts and nattc
+	kcp func(*tunnel.KCPOptions)
+	// auth makes nattc authenticate with a key natts has authorized
+	auth bool
+}
+
+var variants = []variant{
+	{name: "default"},
+	{name: "zstd", kcp: func(o *tunnel.KCPOptions) { o.Compression = tunnel.CompressionZstd }},
+	{name: "snappy", kcp: func(o *tunnel.KCPOptions) { o.Compression = tunnel.CompressionSnappy }},
+	{name: "auth", auth: true},
+	{name: "adaptive FEC", kcp: func(o *tunnel.KCPOptions) { o.AdaptiveFEC, o.MinParityShards = true, 0 }},
+	{name: "no FEC", kcp: func(o *tunnel.KCPOptions) { o.DataShards, o.ParityShards = 0, 0 }},
+}
+
+// forEachVariant runs test as a subtest for each of variants
+func forEachVariant(t *testing.T, test func(t *testing.T, v variant)) {
+	for _, v := range variants {
+		t.Run(v.name, func(t *testing.T) { test(t, v) })
+	}
+}
+
+// harness is a natts and a nattc forwarding a local port to the echo backend through it
+type harness struct {
+	t        *testing.T
+	updater  *fakeUpdater
+	resolver *net.Resolver
+	server   *natts.Server
+	client   *nattc.Client
+	// forward is the address nattc listens on
+	forward string
+}
+
+// start starts natts and nattc. natts runs STUN discovery again once it has
+// had no connections for rediscoverAfter, or after the default if it is zero.
+func start(t *testing.T, rediscoverAfter time.Duration) *harness {
+	t.Helper()
+	return startVariant(t, variant{}, rediscoverAfter)
+}
+
+// startVariant starts natts and nattc configured as v
+func startVariant(t *testing.T, v variant, rediscoverAfter time.Duration) *harness {
+	t.Helper()
+	h := &harness{t: t, updater: &fakeUpdater{}}
+	h.resolver = startDNS(t, fqdn, h.updater)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	kcp := kcpOptions
+	if v.kcp != nil {
+		v.kcp(&kcp)
+	}
+	var key *tunnel.Key
+	var authorized []tunnel.Key
+	if v.auth {
+		key = &tunnel.Key{ID: "e2e", Secret: "e2e secret"}
+		authorized = []tunnel.Key{*key}
+	}
+
+	server, err := natts.New(natts.Config{
+		SSHTarget:             startEchoBackend(t),
+		TargetFQDN:            fqdn,
+		Updater:               h.updater,
+		STUNServers:           []string{startSTUN(t)},
+		KCP:                   kcp,
+		Timeouts:              timeouts,
+		AuthorizedKeys:        authorized,
+		MarkOfflineOnShutdown: true,
+		RediscoverAfter:       rediscoverAfter,
+	})
+	if err != nil {
+		t.Fatalf("failed to create natts: %v", err)
+	}
+	if err := server.Start(ctx, ":0"); err != nil {
+		t.Fatalf("failed to start natts: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	h.server = server
+
+	h.forward = freePort(t)
+	h.client = nattc.New(nattc.Config{
+		TargetFQDN: fqdn,
+		Resolver:   h.resolver,
+		Forwards:   []nattc.Forward{{ListenAddr: h.forward, Service: tunnel.DefaultService}},
+		KCP:        kcp,
+		Timeouts:   timeouts,
+		AuthKey:    key,
+	})
+	if err := h.client.Start(ctx); err != nil {
+		t.Fatalf("failed to start nattc: %v", err)
+	}
+	t.Cleanup(func() { h.client.Close() })
+	return h
+}
+
+// freePort returns a loopback address with a port nothing listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// dial connects to the forward of nattc
+func (h *harness) dial() net.Conn {
+	h.t.Helper()
+	conn, err := net.DialTimeout("tcp", h.forward, 5*time.Second)
+	if err != nil {
+		h.t.Fatalf("failed to connect to nattc: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return conn
+}
+
+// echo sends msg over conn and returns an error unless it comes back
+func echo(conn net.Conn, msg []byte) error {
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("failed to read the echo: %w", err)
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("echo is %q, want %q", got, msg)
+	}
+	return nil
+}
+
+func TestConnect(t *testing.T) {
+	forEachVariant(t, testConnect)
+}
+
+func testConnect(t *testing.T, v variant) {
+	h := startVariant(t, v, 0)
+
+	addr, err := dns.ResolveTarget(h.resolver, fqdn)
+	if err != nil {
+		t.Fatalf("failed to resolve the published records: %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.1" {
+		t.Errorf("published address is %s, want the loopback address STUN saw", addr)
+	}
+
+	conn := h.dial()
+	defer conn.Close()
+	if err := echo(conn, []byte("hello through natts")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataIntegrity(t *testing.T) {
+	forEachVariant(t, testDataIntegrity)
+}
+
+func testDataIntegrity(t *testing.T, v variant) {
+	h := startVariant(t, v, 0)
+
+	const (
+		conns = 4
+		size  = 4 << 20
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.transfer(size); err != nil {
+				errs <- fmt.Errorf("connection %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// transfer sends size random bytes through the tunnel while reading the echo
+// back, and compares the hashes of both
+func (h *harness) transfer(size int) error {
+	conn := h.dial()
+	defer conn.Close()
+
+	sent := sha256.New()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.MultiWriter(conn, sent), rand.Reader, int64(size))
+		done <- err
+	}()
+
+	received := sha256.New()
+	if _, err := io.CopyN(received, conn, int64(size)); err != nil {
+		return fmt.Errorf("failed to read the echo: %w", err)
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if !bytes.Equal(sent.Sum(nil), received.Sum(nil)) {
+		return errors.New("the echo differs from the data sent")
+	}
+	return nil
+}
+
+func TestIdleRediscovery(t *testing.T) {
+	h := start(t, 500*time.Millisecond)
+
+	conn := h.dial()
+	if err := echo(conn, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	updates := h.updater.updateCount()
+	deadline := time.Now().Add(10 * time.Second)
+	for h.updater.updateCount() == updates {
+		if time.Now().After(deadline) {
+			t.Fatal("natts did not register again after being idle")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The session nattc had broke with the listener, so it may take a few
+	// attempts until nattc notices and connects again
+	var err error
+	for time.Now().Before(deadline.Add(10 * time.Second)) {
+		conn, err = net.DialTimeout("tcp", h.forward, 5*time.Second)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+			err = echo(conn, []byte("after"))
+			conn.Close()
+		}
+		if err == nil {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("no connection after rediscovery: %v", err)
+}
+
+func TestShutdown(t *testing.T) {
+	h := start(t, 0)
+
+	conn := h.dial()
+	defer conn.Close()
+	if err := echo(conn, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- h.server.Shutdown(ctx)
+	}()
+
+	// natts marks itself offline at once, then drains the open connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := dns.ResolveTarget(h.resolver, fqdn)
+		if errors.Is(err, dns.ErrOffline) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("natts was not marked offline, resolving returns %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := echo(conn, []byte("while draining")); err != nil {
+		t.Fatalf("open connection broke while draining: %v", err)
+	}
+	conn.Close()
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("natts did not shut down cleanly: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.client.Shutdown(ctx); err != nil {
+		t.Fatalf("nattc did not shut down cleanly: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", h.forward, time.Second); err == nil {
+		t.Error("nattc still listens after shutting down")
+	}
+}
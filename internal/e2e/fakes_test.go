@@ -0,0 +1,204 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/pion/stun"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startSTUN starts a STUN server on loopback that answers every binding
+// request with the address it came from, as a host without NAT would see
+func startSTUN(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen for STUN: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+				continue
+			}
+			res, err := stun.Build(
+				stun.NewTransactionIDSetter(req.TransactionID),
+				stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+			)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(res.Raw, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// fakeUpdater keeps the records natts publishes in memory
+type fakeUpdater struct {
+	mu      sync.Mutex
+	ipv4    string
+	port    int
+	offline bool
+	// updates counts the calls of Update
+	updates int
+}
+
+func (u *fakeUpdater) Update(ctx context.Context, fqdn, ipv4 string, port int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ipv4, u.port, u.offline = ipv4, port, false
+	u.updates++
+	return nil
+}
+
+func (u *fakeUpdater) MarkOffline(ctx context.Context, fqdn string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.offline = true
+	return nil
+}
+
+// records returns the A and TXT records published, or nothing before the first update
+func (u *fakeUpdater) records() (ipv4 string, txt string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.updates == 0 {
+		return "", ""
+	}
+	if u.offline {
+		return u.ipv4, dns.OfflineMarker
+	}
+	return u.ipv4, dns.PortRecord(u.port)
+}
+
+func (u *fakeUpdater) updateCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.updates
+}
+
+// startDNS starts a DNS server on loopback that answers for fqdn with the
+// records of u, and returns a resolver that asks it
+func startDNS(t *testing.T, fqdn string, u *fakeUpdater) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen for DNS: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	name := dnsmessage.MustNewName(strings.TrimSuffix(fqdn, ".") + ".")
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			res, err := answerDNS(buf[:n], name, u)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(res, from)
+		}
+	}()
+
+	addr := conn.LocalAddr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+// answerDNS builds the response to the query in msg
+func answerDNS(msg []byte, name dnsmessage.Name, u *fakeUpdater) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	header.Authoritative = true
+	if !strings.EqualFold(q.Name.String(), name.String()) {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	ipv4, txt := u.records()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 0}
+	switch {
+	case header.RCode != dnsmessage.RCodeSuccess || ipv4 == "":
+	case q.Type == dnsmessage.TypeA:
+		ip := net.ParseIP(ipv4).To4()
+		if ip == nil {
+			return nil, errors.New("published address is not IPv4")
+		}
+		if err := b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip)}); err != nil {
+			return nil, err
+		}
+	case q.Type == dnsmessage.TypeTXT:
+		if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{txt}}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// startEchoBackend starts a TCP server on loopback that echoes what it
+// receives, standing in for sshd
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen for the backend: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
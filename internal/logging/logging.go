@@ -0,0 +1,144 @@
+// Package logging sets up the structured logs of natts and nattc.
+//
+// Every logger belongs to a subsystem, recorded as the "subsystem" attribute,
+// whose level can be set separately and changed while the process runs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Subsystems
+const (
+	// Main covers starting, reloading and stopping the process
+	Main = "main"
+	// Tunnel covers sessions, streams and the connections proxied over them
+	Tunnel = "tunnel"
+	// STUN covers discovery of the external address and NAT type
+	STUN = "stun"
+	// DNS covers publishing and resolving the endpoint of natts
+	DNS = "dns"
+)
+
+// Subsystems lists every subsystem whose level can be set
+var Subsystems = []string{Main, Tunnel, STUN, DNS}
+
+// Formats
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+var (
+	levels = map[string]*slog.LevelVar{}
+	// base formats and writes the records of every subsystem
+	base atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	for _, name := range Subsystems {
+		levels[name] = new(slog.LevelVar)
+	}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	base.Store(&h)
+	slog.SetDefault(For(Main))
+}
+
+// Setup writes logs to w in the given format, "text" or "json"
+func Setup(w io.Writer, format string) error {
+	// Levels are checked per subsystem before records reach the base handler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var h slog.Handler
+	switch format {
+	case Text, "":
+		h = slog.NewTextHandler(w, opts)
+	case JSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	base.Store(&h)
+	return nil
+}
+
+// SetLevels sets the level of every subsystem to level, except for those
+// given in overrides. It can be called at any time.
+func SetLevels(level slog.Level, overrides map[string]slog.Level) {
+	for name, v := range levels {
+		if l, ok := overrides[name]; ok {
+			v.Set(l)
+		} else {
+			v.Set(level)
+		}
+	}
+}
+
+// For returns the logger of a subsystem
+func For(subsystem string) *slog.Logger {
+	level, ok := levels[subsystem]
+	if !ok {
+		panic("logging: unknown subsystem " + subsystem)
+	}
+	return slog.New(&handler{level: level}).With("subsystem", subsystem)
+}
+
+// handler filters records by the level of its subsystem and passes them on
+// to the current base handler, so that Setup also applies to loggers created
+// before it was called
+type handler struct {
+	level *slog.LevelVar
+	// with replays the attributes and groups added to this handler on the base handler
+	with []func(slog.Handler) slog.Handler
+	// derived caches the base handler with is applied to. Levels are checked
+	// in Enabled, so only a new base handler invalidates it.
+	derived atomic.Pointer[derivedHandler]
+}
+
+// derivedHandler is a base handler with the attributes and groups of a handler applied
+type derivedHandler struct {
+	base    *slog.Handler
+	handler slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.target().Handle(ctx, r)
+}
+
+// target returns the current base handler with the attributes and groups of h
+// applied, deriving it again only if Setup replaced the base handler
+func (h *handler) target() slog.Handler {
+	b := base.Load()
+	if d := h.derived.Load(); d != nil && d.base == b {
+		return d.handler
+	}
+
+	target := *b
+	for _, f := range h.with {
+		target = f(target)
+	}
+	h.derived.Store(&derivedHandler{base: b, handler: target})
+	return target
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{level: h.level, with: append(slices.Clip(h.with), func(t slog.Handler) slog.Handler {
+		return t.WithAttrs(attrs)
+	})}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{level: h.level, with: append(slices.Clip(h.with), func(t slog.Handler) slog.Handler {
+		return t.WithGroup(name)
+	})}
+}
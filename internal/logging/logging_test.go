@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingHandler counts how often a handler is derived from it
+type countingHandler struct {
+	slog.Handler
+	derived *atomic.Int64
+}
+
+func (h countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.derived.Add(1)
+	return countingHandler{Handler: h.Handler.WithAttrs(attrs), derived: h.derived}
+}
+
+func (h countingHandler) WithGroup(name string) slog.Handler {
+	h.derived.Add(1)
+	return countingHandler{Handler: h.Handler.WithGroup(name), derived: h.derived}
+}
+
+// setBase replaces the base handler for the duration of the test
+func setBase(t *testing.T, h slog.Handler) {
+	t.Helper()
+	old := base.Load()
+	base.Store(&h)
+	t.Cleanup(func() { base.Store(old) })
+}
+
+func TestHandlerDerivesOncePerBase(t *testing.T) {
+	var derived atomic.Int64
+	var first bytes.Buffer
+	setBase(t, countingHandler{Handler: slog.NewTextHandler(&first, nil), derived: &derived})
+	SetLevels(slog.LevelInfo, nil)
+
+	log := For(Tunnel).With("session", 1).WithGroup("stream")
+	for range 10 {
+		log.Info("forwarded", "bytes", 10)
+	}
+	// subsystem, session and the group, derived once for all records
+	if got := derived.Load(); got != 3 {
+		t.Errorf("derived %d handlers for 10 records, want 3", got)
+	}
+	if !strings.Contains(first.String(), "subsystem=tunnel session=1 stream.bytes=10") {
+		t.Errorf("record lost its attributes: %s", first.String())
+	}
+
+	// Setup replaces the base handler of loggers created before it
+	var second bytes.Buffer
+	setBase(t, countingHandler{Handler: slog.NewTextHandler(&second, nil), derived: &derived})
+	log.Info("forwarded", "bytes", 20)
+	log.Info("forwarded", "bytes", 30)
+	if got := derived.Load(); got != 6 {
+		t.Errorf("derived %d handlers after a new base, want 6", got)
+	}
+	if !strings.Contains(second.String(), "subsystem=tunnel session=1 stream.bytes=30") {
+		t.Errorf("new base handler did not get the record: %s", second.String())
+	}
+}
+
+func TestHandlerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	setBase(t, slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { SetLevels(slog.LevelInfo, nil) })
+
+	tunnel, stun := For(Tunnel).With("session", 1), For(STUN)
+	SetLevels(slog.LevelInfo, map[string]slog.Level{STUN: slog.LevelDebug})
+	tunnel.Debug("hidden")
+	stun.Debug("shown")
+
+	// Levels change without deriving the handlers again
+	SetLevels(slog.LevelDebug, nil)
+	tunnel.Debug("shown later")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("debug record of the tunnel logged at level info")
+	}
+	for _, msg := range []string{"msg=shown ", "msg=\"shown later\""} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("missing %s in %s", msg, out)
+		}
+	}
+	if !tunnel.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("tunnel logger not enabled at debug after SetLevels")
+	}
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// kcpCounters are the process-wide KCP SNMP counters that are exported
+var kcpCounters = []struct {
+	desc  *prometheus.Desc
+	value func(*kcp.Snmp) uint64
+}{
+	{kcpDesc("bytes_sent_total", "Bytes sent by KCP to the peer, before FEC and headers."), func(s *kcp.Snmp) uint64 { return s.BytesSent }},
+	{kcpDesc("bytes_received_total", "Bytes received by KCP from the peer, before FEC and headers."), func(s *kcp.Snmp) uint64 { return s.BytesReceived }},
+	{kcpDesc("udp_bytes_sent_total", "UDP bytes sent by KCP."), func(s *kcp.Snmp) uint64 { return s.OutBytes }},
+	{kcpDesc("udp_bytes_received_total", "UDP bytes received by KCP."), func(s *kcp.Snmp) uint64 { return s.InBytes }},
+	{kcpDesc("segments_sent_total", "KCP segments sent."), func(s *kcp.Snmp) uint64 { return s.OutSegs }},
+	{kcpDesc("segments_received_total", "KCP segments received."), func(s *kcp.Snmp) uint64 { return s.InSegs }},
+	{kcpDesc("retransmitted_segments_total", "KCP segments retransmitted after a timeout."), func(s *kcp.Snmp) uint64 { return s.RetransSegs }},
+	{kcpDesc("fast_retransmitted_segments_total", "KCP segments retransmitted early because later segments were acknowledged."), func(s *kcp.Snmp) uint64 { return s.FastRetransSegs }},
+	{kcpDesc("lost_segments_total", "KCP segments inferred as lost."), func(s *kcp.Snmp) uint64 { return s.LostSegs }},
+	{kcpDesc("duplicate_segments_total", "KCP segments received more than once."), func(s *kcp.Snmp) uint64 { return s.RepeatSegs }},
+	{kcpDesc("fec_recovered_total", "Packets recovered by forward error correction."), func(s *kcp.Snmp) uint64 { return s.FECRecovered }},
+	{kcpDesc("fec_errors_total", "Packets forward error correction recovered incorrectly."), func(s *kcp.Snmp) uint64 { return s.FECErrs }},
+	{kcpDesc("fec_parity_shards_total", "FEC parity shards received."), func(s *kcp.Snmp) uint64 { return s.FECParityShards }},
+	{kcpDesc("fec_short_shards_total", "FEC groups with too few shards to recover lost packets."), func(s *kcp.Snmp) uint64 { return s.FECShortShards }},
+	{kcpDesc("input_errors_total", "Packets KCP failed to read, decode or checksum."), func(s *kcp.Snmp) uint64 { return s.InErrs + s.InCsumErrors + s.KCPInErrors }},
+}
+
+func kcpDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "kcp", name), help, nil, nil)
+}
+
+// kcpCollector exports kcp.DefaultSnmp, which covers every KCP session of the process
+type kcpCollector struct{}
+
+func (kcpCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range kcpCounters {
+		ch <- c.desc
+	}
+}
+
+func (kcpCollector) Collect(ch chan<- prometheus.Metric) {
+	snmp := kcp.DefaultSnmp.Copy()
+	for _, c := range kcpCounters {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(c.value(snmp)))
+	}
+}
@@ -0,0 +1,272 @@
+// Package metrics exports Prometheus metrics for natts and nattc.
+//
+// Both binaries share the metric names below; a "session" is the KCP
+// connection between nattc and natts and a "connection" is one proxied
+// stream multiplexed over it.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+const namespace = "natt"
+
+// rttSampleInterval is how often WatchKCP records the round-trip time of a session
+const rttSampleInterval = 10 * time.Second
+
+// Registry holds every metric served by Serve
+var Registry = prometheus.NewRegistry()
+
+var (
+	SessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sessions_active",
+		Help:      "Number of open sessions between nattc and natts.",
+	})
+	SessionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sessions_total",
+		Help:      "Number of sessions established since start.",
+	})
+	HandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handshake_failures_total",
+		Help:      "Number of sessions whose handshake failed, including authentication failures.",
+	})
+	AuthFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of sessions refused because the client could not prove it holds an authorized key.",
+	})
+	SessionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sessions_rejected_total",
+		Help:      "Number of sessions refused before the handshake by reason: banned, max_sessions, max_sessions_per_ip, rate, rate_per_ip, source_denied, country_denied or source_not_allowed.",
+	}, []string{"reason"})
+	Bans = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bans_total",
+		Help:      "Number of times a peer IP was banned after repeated authentication failures.",
+	})
+	FECAdjustments = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fec_adjustments_total",
+		Help:      "Number of times the peer was asked to send another number of FEC parity shards.",
+	})
+	ConnectionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connections_active",
+		Help:      "Number of proxied connections in progress.",
+	})
+	ConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Number of proxied connections by service.",
+	}, []string{"service"})
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes carried through the tunnel by service; direction is \"in\" for bytes received from the peer and \"out\" for bytes sent to it.",
+	}, []string{"service", "direction"})
+	CompressionInput = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compression_input_bytes_total",
+		Help:      "Bytes written to compressed streams by algorithm, before compression.",
+	}, []string{"algorithm"})
+	CompressionOutput = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compression_output_bytes_total",
+		Help:      "Bytes sent on compressed streams by algorithm, after compression; incompressible data counts as is.",
+	}, []string{"algorithm"})
+	KCPRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kcp_rtt_seconds",
+		Help:      "Smoothed round-trip time of KCP sessions, sampled every 10 seconds.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+
+	STUNRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stun_requests_total",
+		Help:      "STUN binding requests by server and result (success or failure).",
+	}, []string{"server", "result"})
+	STUNDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stun_request_duration_seconds",
+		Help:      "Latency of STUN binding requests by server.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"server"})
+	STUNEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stun_external_endpoint_info",
+		Help:      "External address last discovered via STUN, as a label with value 1.",
+	}, []string{"address"})
+
+	DNSUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dns_updates_total",
+		Help:      "DNS record updates by result (success or failure).",
+	}, []string{"result"})
+	DNSLastUpdate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dns_last_update_timestamp_seconds",
+		Help:      "Unix time of the last successful DNS record update.",
+	})
+	DNSEndpoint = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dns_published_endpoint_info",
+		Help:      "Endpoint last published in DNS, as a label with value 1; \"offline\" after natts marked itself offline.",
+	}, []string{"address"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		kcpCollector{},
+		SessionsActive, SessionsTotal, HandshakeFailures, AuthFailures, SessionsRejected, Bans, FECAdjustments,
+		ConnectionsActive, ConnectionsTotal, Bytes, CompressionInput, CompressionOutput, KCPRTT,
+		STUNRequests, STUNDuration, STUNEndpoint,
+		DNSUpdates, DNSLastUpdate, DNSEndpoint,
+	)
+}
+
+// Serve starts serving the metrics on addr at /metrics. It returns once the
+// listener is open; errors after that are logged.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			logging.For(logging.Main).Error("metrics server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Result returns the result label for err
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// SetEndpoint makes address the only label of an info gauge
+func SetEndpoint(info *prometheus.GaugeVec, address string) {
+	info.Reset()
+	info.WithLabelValues(address).Set(1)
+}
+
+// Endpoint formats an IP and port the way they are published
+func Endpoint(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// Service returns the service label for a stream: the service name, or
+// "egress" for streams to an address, "reverse" for reverse forwards,
+// "bench" for nattc bench and "echo" for nattc ping
+func Service(req tunnel.OpenRequest) string {
+	switch {
+	case req.Bench:
+		return "bench"
+	case req.Echo:
+		return "echo"
+	case req.Listen != "":
+		return "reverse"
+	case req.Address != "":
+		return "egress"
+	default:
+		return req.Service
+	}
+}
+
+// Connection records the start of a proxied connection for service and
+// returns a function that records its end
+func Connection(service string) func() {
+	ConnectionsTotal.WithLabelValues(service).Inc()
+	ConnectionsActive.Inc()
+	return ConnectionsActive.Dec
+}
+
+// Traffic counts the bytes of one service in both directions
+type Traffic struct {
+	In, Out prometheus.Counter
+}
+
+// NewTraffic returns the byte counters of service
+func NewTraffic(service string) Traffic {
+	return Traffic{
+		In:  Bytes.WithLabelValues(service, "in"),
+		Out: Bytes.WithLabelValues(service, "out"),
+	}
+}
+
+// Count wraps the tunnel side of a connection so that the bytes read from
+// and written to it are counted for service
+func Count(rw io.ReadWriter, service string) io.ReadWriter {
+	return &counter{rw: rw, traffic: NewTraffic(service)}
+}
+
+type counter struct {
+	rw      io.ReadWriter
+	traffic Traffic
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.rw.Read(p)
+	c.traffic.In.Add(float64(n))
+	return n, err
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.rw.Write(p)
+	c.traffic.Out.Add(float64(n))
+	return n, err
+}
+
+// Compressed returns the function tunnel.Compress reports the bytes of a
+// stream compressed with algorithm to
+func Compressed(algorithm string) func(in, out int) {
+	input, output := CompressionInput.WithLabelValues(algorithm), CompressionOutput.WithLabelValues(algorithm)
+	return func(in, out int) {
+		input.Add(float64(in))
+		output.Add(float64(out))
+	}
+}
+
+// WatchKCP samples the round-trip time of sess until done is closed
+func WatchKCP(sess *kcp.UDPSession, done <-chan struct{}) {
+	ticker := time.NewTicker(rttSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if srtt := sess.GetSRTT(); srtt > 0 {
+				KCPRTT.Observe(float64(srtt) / 1000)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package nattc
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// BenchOptions controls what RunBench measures
+type BenchOptions struct {
+	// Pings round trips are timed on an idle stream, one every PingInterval
+	Pings        int
+	PingInterval time.Duration
+	// Duration is how long the download and the upload each run
+	Duration time.Duration
+}
+
+// BenchReport is the outcome of RunBench. Durations are in milliseconds so
+// that the JSON form is easy to consume.
+type BenchReport struct {
+	Target      string      `json:"target"`
+	FEC         string      `json:"fec"`
+	Compression string      `json:"compression,omitempty"`
+	RTT         RTTStats    `json:"rtt"`
+	Download    Throughput  `json:"download"`
+	Upload      Throughput  `json:"upload"`
+	KCP         KCPCounters `json:"kcp"`
+}
+
+// RTTStats summarizes the round-trip times of the pings
+type RTTStats struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min_ms"`
+	Avg     float64 `json:"avg_ms"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	Max     float64 `json:"max_ms"`
+	// Jitter is the standard deviation
+	Jitter float64 `json:"jitter_ms"`
+}
+
+// Throughput is what the receiving side measured of a transfer
+type Throughput struct {
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// KCPCounters are the KCP statistics of nattc over the benchmark. Losses and
+// retransmissions are of the segments nattc sent; those of natts only show up
+// as duplicates received.
+type KCPCounters struct {
+	SegmentsSent      uint64 `json:"segments_sent"`
+	SegmentsReceived  uint64 `json:"segments_received"`
+	Retransmitted     uint64 `json:"retransmitted"`
+	FastRetransmitted uint64 `json:"fast_retransmitted"`
+	// Lost are the segments retransmitted after a timeout
+	Lost         uint64  `json:"lost"`
+	Duplicates   uint64  `json:"duplicates"`
+	FECRecovered uint64  `json:"fec_recovered"`
+	LossRate     float64 `json:"loss_rate"`
+}
+
+// RunBench connects to natts and measures the round-trip time, the download
+// and upload throughput and the KCP losses of the tunnel. Every connection of
+// the process counts towards the KCP statistics, so it is meant to run alone,
+// as nattc bench does.
+func RunBench(cfg Config, opts BenchOptions) (*BenchReport, error) {
+	s := newSession(cfg, nil)
+	defer s.close()
+
+	addr, err := dns.ResolveAddress(cfg.Resolver, cfg.TargetFQDN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target: %w", err)
+	}
+	s.mu.Lock()
+	_, _, err = s.connect(addr)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	before := kcp.DefaultSnmp.Copy()
+
+	s.mu.Lock()
+	report := &BenchReport{
+		Target:      s.remote.String(),
+		FEC:         cfg.KCP.FEC().String(),
+		Compression: s.compression,
+	}
+	s.mu.Unlock()
+
+	var rtts []time.Duration
+	err = s.bench(func(st *stream) (err error) {
+		rtts, err = tunnel.BenchPings(st, opts.Pings, opts.PingInterval)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ping failed: %w", err)
+	}
+	report.RTT = rttStats(rtts)
+
+	err = s.bench(func(st *stream) error {
+		result, err := tunnel.BenchDownload(st, opts.Duration)
+		report.Download = throughput(result)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+
+	// Like natts, the upload is not compressed but kept within the bandwidth limits
+	service := metrics.Service(tunnel.OpenRequest{Bench: true})
+	err = s.bench(func(st *stream) error {
+		result, err := tunnel.BenchUpload(s.shaper.Shape(tunnel.Until(st.done), st, s.bandwidth, service), opts.Duration)
+		report.Upload = throughput(result)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+
+	report.KCP = kcpCounters(before, kcp.DefaultSnmp.Copy())
+	return report, nil
+}
+
+// bench runs measure on a new bench stream
+func (s *session) bench(measure func(*stream) error) error {
+	st, err := s.openStream(tunnel.OpenRequest{Bench: true})
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	return measure(st)
+}
+
+func rttStats(rtts []time.Duration) RTTStats {
+	if len(rtts) == 0 {
+		return RTTStats{}
+	}
+	ms := make([]float64, len(rtts))
+	var sum float64
+	for i, rtt := range rtts {
+		ms[i] = milliseconds(rtt)
+		sum += ms[i]
+	}
+	slices.Sort(ms)
+	avg := sum / float64(len(ms))
+	var variance float64
+	for _, v := range ms {
+		variance += (v - avg) * (v - avg)
+	}
+	percentile := func(p float64) float64 {
+		return ms[min(len(ms)-1, int(math.Ceil(p*float64(len(ms))))-1)]
+	}
+	return RTTStats{
+		Samples: len(ms),
+		Min:     ms[0],
+		Avg:     avg,
+		P50:     percentile(0.5),
+		P90:     percentile(0.9),
+		P99:     percentile(0.99),
+		Max:     ms[len(ms)-1],
+		Jitter:  math.Sqrt(variance / float64(len(ms))),
+	}
+}
+
+func throughput(r tunnel.BenchResult) Throughput {
+	return Throughput{Bytes: r.Bytes, Seconds: r.Elapsed.Seconds(), BytesPerSecond: r.BytesPerSecond()}
+}
+
+func kcpCounters(before, after *kcp.Snmp) KCPCounters {
+	c := KCPCounters{
+		SegmentsSent:      after.OutSegs - before.OutSegs,
+		SegmentsReceived:  after.InSegs - before.InSegs,
+		Retransmitted:     after.RetransSegs - before.RetransSegs,
+		FastRetransmitted: after.FastRetransSegs - before.FastRetransSegs,
+		Lost:              after.LostSegs - before.LostSegs,
+		Duplicates:        after.RepeatSegs - before.RepeatSegs,
+		FECRecovered:      after.FECRecovered - before.FECRecovered,
+	}
+	if c.SegmentsSent > 0 {
+		c.LossRate = float64(c.Lost) / float64(c.SegmentsSent)
+	}
+	return c
+}
@@ -2,48 +2,122 @@ package nattc
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/Hogeyama/ddns-updater/internal/dns"
-	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
 )
 
+var (
+	mainLog   = logging.For(logging.Main)
+	tunnelLog = logging.For(logging.Tunnel)
+)
+
+// drainPollInterval is how often Shutdown checks whether connections have finished
+const drainPollInterval = time.Second
+
+// errShuttingDown is sent to natts for reverse connections arriving while nattc shuts down
+var errShuttingDown = errors.New("nattc is shutting down")
+
 type Client struct {
-	targetFQDN string
-	listener   net.Listener
+	targetFQDN  string
+	forwards    []Forward
+	udpForwards []Forward
+	reverses    []ReverseForward
+	socksAddr   string
+	session     *session
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+
+	// Forwarded connections in progress, waited for by Shutdown
+	connMutex   sync.Mutex
+	activeConns int
+	// draining refuses connections natts opens for reverse forwards while nattc shuts down
+	draining atomic.Bool
 }
 
 type Config struct {
 	TargetFQDN string
+	// Resolver looks up the records of TargetFQDN (default the system resolver)
+	Resolver *net.Resolver
+	// Forwards are the local listeners to start; they all share one KCP connection
+	Forwards []Forward
+	// UDPForwards are local UDP listeners whose datagrams are relayed outside KCP
+	UDPForwards []Forward
+	// Reverses are listeners natts opens on its side on behalf of nattc
+	Reverses []ReverseForward
+	// SocksAddr, if set, starts a SOCKS5 proxy whose connections are dialed by natts
+	SocksAddr string
+	// Timeouts controls keepalives and how long forwarded connections may live
+	Timeouts tunnel.Timeouts
+	// KCP tunes the KCP session; its FEC settings must match natts
+	KCP tunnel.KCPOptions
+	// AuthKey, if set, is the key to authenticate to natts with
+	AuthKey *tunnel.Key
+	// Bandwidth caps the bytes per second nattc sends to natts over streams
+	Bandwidth tunnel.BandwidthLimits
 }
 
 func New(cfg Config) *Client {
-	return &Client{
-		targetFQDN: cfg.TargetFQDN,
+	c := &Client{
+		targetFQDN:  cfg.TargetFQDN,
+		forwards:    cfg.Forwards,
+		udpForwards: cfg.UDPForwards,
+		reverses:    cfg.Reverses,
+		socksAddr:   cfg.SocksAddr,
 	}
+	c.session = newSession(cfg, c.handleReverseStream)
+	return c
 }
 
-func (c *Client) Start(ctx context.Context, listenAddr string) error {
-	// Start TCP listener
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to start TCP listener: %w", err)
+func (c *Client) Start(ctx context.Context) error {
+	if len(c.forwards) == 0 && len(c.udpForwards) == 0 && len(c.reverses) == 0 && c.socksAddr == "" {
+		return fmt.Errorf("no forwards configured")
+	}
+
+	for _, fwd := range c.forwards {
+		// Start TCP listener
+		listener, err := net.Listen("tcp", fwd.ListenAddr)
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("failed to start TCP listener on %s: %w", fwd.ListenAddr, err)
+		}
+		c.listeners = append(c.listeners, listener)
+
+		mainLog.Info("forwarding", "forward", fwd.String(), "target", c.targetFQDN)
+
+		// Accept connections
+		go c.acceptLoop(ctx, listener, fwd)
 	}
-	c.listener = listener
 
-	log.Printf("nattc: TCP listener started on %s", listenAddr)
-	log.Printf("nattc: will proxy to %s", c.targetFQDN)
+	for _, fwd := range c.udpForwards {
+		if err := c.startUDPForward(ctx, fwd); err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	if c.socksAddr != "" {
+		if err := c.startSocks(ctx); err != nil {
+			c.Close()
+			return err
+		}
+	}
 
-	// Accept connections
-	go c.acceptLoop(ctx)
+	for _, fwd := range c.reverses {
+		go c.runReverse(ctx, fwd)
+	}
 
 	return nil
 }
 
-func (c *Client) acceptLoop(ctx context.Context) {
+func (c *Client) acceptLoop(ctx context.Context, listener net.Listener, fwd Forward) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -51,67 +125,117 @@ func (c *Client) acceptLoop(ctx context.Context) {
 		default:
 		}
 
-		conn, err := c.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("nattc: failed to accept connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			tunnelLog.Warn("failed to accept connection", "forward", fwd.String(), "error", err)
 			continue
 		}
 
-		go c.handleConnection(conn)
+		go c.handleConnection(conn, fwd)
 	}
 }
 
-func (c *Client) handleConnection(tcpConn net.Conn) {
+func (c *Client) handleConnection(tcpConn net.Conn, fwd Forward) {
 	defer tcpConn.Close()
+	defer c.trackConnection()()
 
-	log.Printf("nattc: new connection from %s", tcpConn.RemoteAddr())
+	req := fwd.request()
+	service := metrics.Service(req)
+	defer metrics.Connection(service)()
 
-	// Resolve target FQDN to get natts IP and port
-	targetAddr, err := dns.ResolveTarget(c.targetFQDN)
+	log := tunnelLog.With("peer", tcpConn.RemoteAddr().String(), "service", req.Target())
+	stream, err := c.session.openResumable(req)
 	if err != nil {
-		log.Printf("nattc: failed to resolve target: %v", err)
+		log.Warn("failed to open stream", "error", err)
 		return
 	}
+	defer stream.Close()
 
-	log.Printf("nattc: resolved target to %s", targetAddr)
+	log = log.With("session", c.session.currentID())
+	log.Info("new connection")
 
-	// Connect to natts via KCP
-	kcpConn, err := kcp.DialWithOptions(targetAddr, nil, 10, 3)
-	if err != nil {
-		log.Printf("nattc: failed to connect to natts: %v", err)
-		return
+	// Proxy data between TCP connection and stream
+	if err := tunnel.Pipe(tcpConn, metrics.Count(c.session.wrap(stream, service), service), c.session.timeouts); err != nil {
+		log.Warn("proxy error", "error", err)
+	}
+
+	log.Info("connection closed")
+}
+
+// trackConnection records the start of a forwarded connection and returns
+// a function that records its end
+func (c *Client) trackConnection() func() {
+	c.connMutex.Lock()
+	c.activeConns++
+	c.connMutex.Unlock()
+
+	return func() {
+		c.connMutex.Lock()
+		c.activeConns--
+		c.connMutex.Unlock()
 	}
-	defer kcpConn.Close()
+}
 
-	log.Printf("nattc: connected to natts at %s", targetAddr)
+// Shutdown stops nattc gracefully. Local listeners are closed, and forwarded
+// connections get until ctx is done to finish before Close cuts the rest.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.draining.Store(true)
+	if err := c.closeListeners(); err != nil {
+		mainLog.Warn("failed to close listeners", "error", err)
+	}
 
-	// Proxy data between TCP and KCP connections
-	done := make(chan error, 2)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
 
-	go func() {
-		_, err := io.Copy(kcpConn, tcpConn)
-		done <- err
-	}()
+	logged := -1
+	for {
+		c.connMutex.Lock()
+		activeConns := c.activeConns
+		c.connMutex.Unlock()
 
-	go func() {
-		_, err := io.Copy(tcpConn, kcpConn)
-		done <- err
-	}()
+		if activeConns == 0 {
+			break
+		}
+		if activeConns != logged {
+			mainLog.Info("draining, waiting for active connections", "active_connections", activeConns)
+			logged = activeConns
+		}
 
-	// Wait for either direction to complete
-	err = <-done
-	if err != nil {
-		log.Printf("nattc: proxy error: %v", err)
+		select {
+		case <-ctx.Done():
+			mainLog.Warn("drain timed out, closing active connections", "active_connections", activeConns)
+			return errors.Join(ctx.Err(), c.Close())
+		case <-ticker.C:
+		}
 	}
 
-	log.Printf("nattc: connection closed")
+	return c.Close()
 }
 
-
+// Close stops nattc immediately, closing every listener and connection
 func (c *Client) Close() error {
-	if c.listener != nil {
-		return c.listener.Close()
-	}
-	return nil
+	c.draining.Store(true)
+	err := c.closeListeners()
+	return errors.Join(err, c.session.close())
 }
 
+// closeListeners stops accepting local connections and UDP datagrams
+func (c *Client) closeListeners() error {
+	var errs []error
+	for _, listener := range c.listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.listeners = nil
+	for _, conn := range c.packetConns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.packetConns = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,217 @@
+package nattc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/doctor"
+	"github.com/Hogeyama/ddns-updater/internal/stun"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// Doctor checks what nattc needs to forward connections with cfg: the
+// resolution of the target, outbound UDP, the local listeners, the handshake
+// with natts, an echo from it and the targets of the forwards. natts opens
+// the backend connections and reverse listeners the checks ask for, and
+// closes them right away.
+func Doctor(cfg Config, report *doctor.Report) {
+	addr := checkTarget(cfg, report)
+	checkUDP(report)
+	checkListeners(cfg, report)
+
+	if addr == "" {
+		report.Skip("handshake", "needs the target to resolve")
+		return
+	}
+	s := newSession(cfg, nil)
+	defer s.close()
+	if !checkHandshake(s, addr, report) {
+		return
+	}
+	checkEcho(s, report)
+	checkTargets(s, cfg, report)
+}
+
+// checkTarget resolves the target and returns the address of natts, or "" if it does not resolve
+func checkTarget(cfg Config, report *doctor.Report) string {
+	addr, err := dns.ResolveTarget(cfg.Resolver, cfg.TargetFQDN)
+	switch {
+	case errors.Is(err, dns.ErrOffline):
+		report.Fail("target", err.Error(), "Start natts; it marked itself offline when it stopped")
+	case err != nil:
+		report.Fail("target", err.Error(), "Check target (or TARGET_FQDN), and run natts doctor on the natts host to check that it publishes its A and kcp-port TXT records")
+	default:
+		report.OK("target", "%s resolves to %s", cfg.TargetFQDN, addr)
+	}
+	return addr
+}
+
+// checkUDP asks a STUN server for the external address of a free port, which
+// shows whether this network lets UDP out
+func checkUDP(report *doctor.Report) {
+	ip, port, err := stun.GetIPv4AndAvailablePort(stun.DefaultServers)
+	if err != nil {
+		report.Warn("udp", err.Error(), "Allow outbound UDP on this network; KCP runs over UDP, so a network that blocks it cannot reach natts")
+		return
+	}
+	report.OK("udp", "outbound UDP works, a STUN server sees this host as %s", net.JoinHostPort(ip, strconv.Itoa(port)))
+}
+
+// checkListeners checks that the addresses of the local forwards and the SOCKS proxy are free
+func checkListeners(cfg Config, report *doctor.Report) {
+	check := func(network, addr string) {
+		name := "listen " + addr
+		var err error
+		if network == "udp" {
+			var pc net.PacketConn
+			if pc, err = net.ListenPacket(network, addr); err == nil {
+				pc.Close()
+			}
+		} else {
+			var l net.Listener
+			if l, err = net.Listen(network, addr); err == nil {
+				l.Close()
+			}
+		}
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			report.Warn(name, err.Error(), "Ignore this if nattc is running with this forward; otherwise stop the process using "+addr+" or forward from another port")
+			return
+		case err != nil:
+			report.Fail(name, err.Error(), "Check the address, or forward from another one")
+			return
+		}
+		report.OK(name, "%s %s is free", network, addr)
+	}
+
+	for _, fwd := range cfg.Forwards {
+		check("tcp", fwd.ListenAddr)
+	}
+	for _, fwd := range cfg.UDPForwards {
+		check("udp", fwd.ListenAddr)
+	}
+	if cfg.SocksAddr != "" {
+		check("tcp", cfg.SocksAddr)
+	}
+}
+
+// checkHandshake connects to natts at addr and authenticates
+func checkHandshake(s *session, addr string, report *doctor.Report) bool {
+	start := time.Now()
+	s.mu.Lock()
+	_, compression, err := s.connect(addr)
+	s.mu.Unlock()
+
+	var rerr *tunnel.RejectedError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &rerr) && rerr.Reason == tunnel.ErrAuthFailed.Error():
+		report.Fail("handshake", err.Error(), "Set auth_key (or NATTC_AUTH_KEY) to a key listed in the authorized_keys of natts")
+	case errors.As(err, &nerr) && nerr.Timeout():
+		report.Fail("handshake", err.Error(),
+			"natts did not answer: run natts doctor on its host to check that its UDP port is reachable through the NAT, and use the same [kcp] data_shards and parity_shards on both sides")
+	case err != nil:
+		report.Fail("handshake", err.Error(), "Make the [kcp] settings of nattc match those of natts, and see the log of natts")
+	default:
+		if compression == "" {
+			compression = "off"
+		}
+		report.OK("handshake", "connected to natts in %.2fms (%s, compression %s)",
+			milliseconds(time.Since(start)), s.kcpOptions.FEC(), compression)
+		return true
+	}
+	return false
+}
+
+// checkEcho has natts echo a ping on a stream not connected to any backend
+func checkEcho(s *session, report *doctor.Report) {
+	start := time.Now()
+	err := s.probe(tunnel.OpenRequest{Echo: true}, func(stream net.Conn) error {
+		_, err := tunnel.Pings(stream, 1, 0)
+		return err
+	})
+	if err != nil {
+		report.Fail("echo", err.Error(), "Update natts to the version of nattc, and see its log")
+		return
+	}
+	report.OK("echo", "natts answered in %.2fms", milliseconds(time.Since(start)))
+}
+
+// checkTargets opens a stream to the target of every forward, which natts
+// only accepts once it connected to it, opened a UDP flow to it or listens
+// for a reverse forward
+func checkTargets(s *session, cfg Config, report *doctor.Report) {
+	seen := map[string]bool{}
+	check := func(name string, req tunnel.OpenRequest, fix string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+
+		err := s.probe(req, nil)
+		var rerr *tunnel.RejectedError
+		switch {
+		case errors.As(err, &rerr) && rerr.Code == tunnel.RejectInUse:
+			// Most likely the nattc running with this configuration holds it
+			report.Warn(name, "natts already listens there, maybe for a running nattc",
+				"Ignore this if nattc is running with this forward; otherwise check what listens on it on the natts host")
+		case errors.As(err, &rerr):
+			report.Fail(name, err.Error(), fix)
+		case err != nil:
+			report.Fail(name, err.Error(), "See the log of natts")
+		default:
+			report.OK(name, "natts accepted it")
+		}
+	}
+	targetFix := func(fwd Forward) string {
+		if fwd.Address != "" {
+			return "Allow " + fwd.Address + " with allow_egress on natts, and check that it is reachable from there"
+		}
+		return "Add the service to natts with --service or [services], and check that its backend is running"
+	}
+
+	for _, fwd := range cfg.Forwards {
+		req := fwd.request()
+		check("target "+req.Target(), req, targetFix(fwd))
+	}
+	for _, fwd := range cfg.UDPForwards {
+		req := fwd.request()
+		req.UDP = true
+		check("udp target "+req.Target(), req, targetFix(fwd))
+	}
+	for _, fwd := range cfg.Reverses {
+		check("reverse "+fwd.RemoteAddr, tunnel.OpenRequest{Listen: fwd.RemoteAddr},
+			"Allow "+fwd.RemoteAddr+" with allow_reverse on natts, and check that nothing else listens there")
+	}
+}
+
+// probe opens a stream for req with a deadline, runs check on it if it is
+// not nil and closes it
+func (s *session) probe(req tunnel.OpenRequest, check func(net.Conn) error) error {
+	mux, _, err := s.get()
+	if err != nil {
+		return err
+	}
+	if err := s.serves(req); err != nil {
+		return err
+	}
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(tunnel.HandshakeTimeout))
+	if err := tunnel.Open(stream, req); err != nil {
+		return err
+	}
+	if check == nil {
+		return nil
+	}
+	return check(stream)
+}
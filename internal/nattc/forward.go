@@ -0,0 +1,166 @@
+package nattc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// Forward describes a local listener whose connections are carried to a target on the natts side
+type Forward struct {
+	ListenAddr string
+	// Service is the natts service to connect to; ignored if Address is set
+	Service string
+	// Address is a host:port dialed by natts
+	Address string
+}
+
+// request returns the stream header that opens the forward's target
+func (f Forward) request() tunnel.OpenRequest {
+	return tunnel.OpenRequest{Service: f.Service, Address: f.Address}
+}
+
+func (f Forward) String() string {
+	target := f.Service
+	if f.Address != "" {
+		target = f.Address
+	}
+	return fmt.Sprintf("%s -> %s", f.ListenAddr, target)
+}
+
+// Spec returns the forward in the form accepted by ParseForward
+func (f Forward) Spec() string {
+	target := f.Service
+	if f.Address != "" {
+		target = f.Address
+	}
+	bind, port, _ := net.SplitHostPort(f.ListenAddr)
+	if bind == "" {
+		return port + ":" + target
+	}
+	return bind + ":" + port + ":" + target
+}
+
+func (f Forward) MarshalText() ([]byte, error) {
+	return []byte(f.Spec()), nil
+}
+
+func (f *Forward) UnmarshalText(text []byte) error {
+	fwd, err := ParseForward(string(text))
+	if err != nil {
+		return err
+	}
+	*f = fwd
+	return nil
+}
+
+// ParseForward parses an ssh -L style forwarding spec:
+//
+//	[bind_address:]port:service
+//	[bind_address:]port:host:hostport
+func ParseForward(spec string) (Forward, error) {
+	parts := strings.Split(spec, ":")
+
+	var bind, port string
+	var target []string
+	switch {
+	case len(parts) == 2:
+		port, target = parts[0], parts[1:]
+	case len(parts) == 3 && isPort(parts[2]):
+		port, target = parts[0], parts[1:]
+	case len(parts) == 3:
+		bind, port, target = parts[0], parts[1], parts[2:]
+	case len(parts) == 4:
+		bind, port, target = parts[0], parts[1], parts[2:]
+	default:
+		return Forward{}, fmt.Errorf("invalid forward spec %q", spec)
+	}
+
+	if !isPort(port) {
+		return Forward{}, fmt.Errorf("invalid listen port in forward spec %q", spec)
+	}
+
+	fwd := Forward{ListenAddr: net.JoinHostPort(bind, port)}
+	if len(target) == 1 {
+		if target[0] == "" {
+			return Forward{}, fmt.Errorf("missing service in forward spec %q", spec)
+		}
+		fwd.Service = target[0]
+	} else {
+		if target[0] == "" || !isPort(target[1]) {
+			return Forward{}, fmt.Errorf("invalid destination in forward spec %q", spec)
+		}
+		fwd.Address = net.JoinHostPort(target[0], target[1])
+	}
+	return fwd, nil
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port >= 0 && port <= 65535
+}
+
+// ReverseForward asks natts to listen on RemoteAddr and carries the connections
+// accepted there back to LocalAddr on the nattc side
+type ReverseForward struct {
+	RemoteAddr string
+	LocalAddr  string
+}
+
+func (r ReverseForward) String() string {
+	return fmt.Sprintf("natts %s -> %s", r.RemoteAddr, r.LocalAddr)
+}
+
+// Spec returns the reverse forward in the form accepted by ParseReverseForward
+func (r ReverseForward) Spec() string {
+	bind, port, _ := net.SplitHostPort(r.RemoteAddr)
+	if bind == "" {
+		return port + ":" + r.LocalAddr
+	}
+	return bind + ":" + port + ":" + r.LocalAddr
+}
+
+func (r ReverseForward) MarshalText() ([]byte, error) {
+	return []byte(r.Spec()), nil
+}
+
+func (r *ReverseForward) UnmarshalText(text []byte) error {
+	fwd, err := ParseReverseForward(string(text))
+	if err != nil {
+		return err
+	}
+	*r = fwd
+	return nil
+}
+
+// ParseReverseForward parses an ssh -R style forwarding spec:
+//
+//	[bind_address:]port:host:hostport
+func ParseReverseForward(spec string) (ReverseForward, error) {
+	parts := strings.Split(spec, ":")
+
+	var bind, port, host, hostPort string
+	switch len(parts) {
+	case 3:
+		port, host, hostPort = parts[0], parts[1], parts[2]
+	case 4:
+		bind, port, host, hostPort = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return ReverseForward{}, fmt.Errorf("invalid reverse forward spec %q", spec)
+	}
+
+	if !isPort(port) {
+		return ReverseForward{}, fmt.Errorf("invalid remote port in reverse forward spec %q", spec)
+	}
+	if host == "" || !isPort(hostPort) {
+		return ReverseForward{}, fmt.Errorf("invalid destination in reverse forward spec %q", spec)
+	}
+
+	return ReverseForward{
+		RemoteAddr: net.JoinHostPort(bind, port),
+		LocalAddr:  net.JoinHostPort(host, hostPort),
+	}, nil
+}
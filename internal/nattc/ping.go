@@ -0,0 +1,136 @@
+package nattc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// Steps of Ping, in the order they run
+const (
+	PingStepDNS       = "dns"
+	PingStepHandshake = "handshake"
+	PingStepEcho      = "echo"
+)
+
+// PingOptions controls how many echoes Ping sends
+type PingOptions struct {
+	// Count echoes are sent, one every Interval
+	Count    int
+	Interval time.Duration
+}
+
+// PingReport is the outcome of Ping. Durations are in milliseconds so that
+// the JSON form is easy to consume.
+type PingReport struct {
+	Target string `json:"target"`
+	// Address is the natts endpoint the target resolved to
+	Address string     `json:"address,omitempty"`
+	Steps   []PingStep `json:"steps"`
+	// RTT summarizes the echoes, once the echo step succeeded
+	RTT *RTTStats `json:"rtt,omitempty"`
+	// Error is the error Ping returned, if any
+	Error string `json:"error,omitempty"`
+}
+
+// PingStep is the time a step of Ping took
+type PingStep struct {
+	Name     string  `json:"step"`
+	Duration float64 `json:"ms"`
+	Failed   bool    `json:"failed,omitempty"`
+}
+
+// FailedStep returns the name of the step that failed, or "" if none did
+func (r *PingReport) FailedStep() string {
+	for _, step := range r.Steps {
+		if step.Failed {
+			return step.Name
+		}
+	}
+	return ""
+}
+
+// step records a step that started at start
+func (r *PingReport) step(name string, start time.Time, err error) {
+	r.Steps = append(r.Steps, PingStep{Name: name, Duration: milliseconds(time.Since(start)), Failed: err != nil})
+}
+
+// Ping checks step by step that natts is reachable: it resolves the target,
+// connects and authenticates, and has natts echo pings on a stream that is
+// not connected to any backend. The report covers the steps up to the first
+// one that failed, and the error that stopped Ping.
+func Ping(cfg Config, opts PingOptions) (*PingReport, error) {
+	report := &PingReport{Target: cfg.TargetFQDN}
+	if err := report.run(cfg, opts); err != nil {
+		report.Error = err.Error()
+		return report, err
+	}
+	return report, nil
+}
+
+// run runs the steps of Ping, recording them in r
+func (r *PingReport) run(cfg Config, opts PingOptions) error {
+	s := newSession(cfg, nil)
+	defer s.close()
+
+	start := time.Now()
+	addr, err := dns.ResolveTarget(cfg.Resolver, cfg.TargetFQDN)
+	r.step(PingStepDNS, start, err)
+	if err != nil {
+		return fmt.Errorf("failed to resolve target: %w", err)
+	}
+	r.Address = addr
+
+	start = time.Now()
+	s.mu.Lock()
+	mux, _, err := s.connect(addr)
+	s.mu.Unlock()
+	r.step(PingStepHandshake, start, err)
+	if err != nil {
+		return err
+	}
+
+	// The first echo includes opening the stream, the first exchange with
+	// natts after the handshake
+	start = time.Now()
+	if err := s.serves(tunnel.OpenRequest{Echo: true}); err != nil {
+		r.step(PingStepEcho, start, err)
+		return err
+	}
+	stream, err := mux.OpenStream()
+	if err != nil {
+		r.step(PingStepEcho, start, err)
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(start.Add(tunnel.HandshakeTimeout + time.Duration(opts.Count)*opts.Interval))
+
+	err = tunnel.Open(stream, tunnel.OpenRequest{Echo: true})
+	var rtts []time.Duration
+	if err == nil {
+		rtts, err = tunnel.Pings(stream, 1, 0)
+	}
+	r.step(PingStepEcho, start, err)
+	if err != nil {
+		return fmt.Errorf("echo failed: %w", err)
+	}
+
+	if opts.Count > 1 {
+		time.Sleep(opts.Interval)
+		var more []time.Duration
+		more, err = tunnel.Pings(stream, opts.Count-1, opts.Interval)
+		rtts = append(rtts, more...)
+		if err != nil {
+			err = fmt.Errorf("echo %d failed: %w", len(rtts)+1, err)
+		}
+	}
+	stats := rttStats(rtts)
+	r.RTT = &stats
+	return err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -2,66 +2,52 @@ package nattc
 
 import (
 	"fmt"
-	"io"
-	"log"
 	"os"
 
-	"github.com/Hogeyama/ddns-updater/internal/dns"
-	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
 )
 
+// stdio joins stdin and stdout into a single io.ReadWriter
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+
 // ProxyClient implements ProxyCommand functionality for SSH
 type ProxyClient struct {
-	targetFQDN string
+	cfg     Config
+	service string
 }
 
-func NewProxyClient(targetFQDN string) *ProxyClient {
+// NewProxyClient returns a client that connects stdin/stdout to service.
+// Only the connection settings of cfg are used.
+func NewProxyClient(cfg Config, service string) *ProxyClient {
 	return &ProxyClient{
-		targetFQDN: targetFQDN,
+		cfg:     cfg,
+		service: service,
 	}
 }
 
 // RunProxy connects to natts and proxies stdin/stdout for SSH ProxyCommand
 func (p *ProxyClient) RunProxy() error {
-	// Resolve target FQDN to get natts IP and port
-	targetAddr, err := dns.ResolveTarget(p.targetFQDN)
-	if err != nil {
-		return fmt.Errorf("failed to resolve target: %w", err)
-	}
-
-	log.Printf("nattc-proxy: resolved target to %s", targetAddr)
+	session := newSession(p.cfg, nil)
+	defer session.close()
 
-	// Connect to natts via KCP
-	kcpConn, err := kcp.DialWithOptions(targetAddr, nil, 10, 3)
+	stream, err := session.openResumable(tunnel.OpenRequest{Service: p.service})
 	if err != nil {
-		return fmt.Errorf("failed to connect to natts: %w", err)
+		return fmt.Errorf("failed to open stream: %w", err)
 	}
-	defer kcpConn.Close()
+	defer stream.Close()
 
-	log.Printf("nattc-proxy: connected to natts at %s", targetAddr)
+	log := tunnelLog.With("session", session.currentID(), "peer", "stdio", "service", p.service)
+	log.Info("connected", "target", p.cfg.TargetFQDN)
 
-	// Proxy data between stdin/stdout and KCP connection
-	done := make(chan error, 2)
-
-	// Copy from stdin to KCP
-	go func() {
-		_, err := io.Copy(kcpConn, os.Stdin)
-		done <- err
-	}()
-
-	// Copy from KCP to stdout
-	go func() {
-		_, err := io.Copy(os.Stdout, kcpConn)
-		done <- err
-	}()
-
-	// Wait for either direction to complete
-	err = <-done
+	// Proxy data between stdin/stdout and the stream
+	err = tunnel.Pipe(stdio{}, session.wrap(stream, p.service), p.cfg.Timeouts)
 	if err != nil {
-		log.Printf("nattc-proxy: proxy error: %v", err)
+		log.Warn("proxy error", "error", err)
 	}
 
-	log.Printf("nattc-proxy: connection closed")
+	log.Info("connection closed")
 	return err
 }
-
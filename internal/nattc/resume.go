@@ -0,0 +1,112 @@
+package nattc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// resumeRetryInterval is how long to wait between attempts to resume a stream
+const resumeRetryInterval = time.Second
+
+// openResumable opens a stream that is resumed on a new session if the current
+// one breaks. It falls back to a plain stream if resumption is disabled or
+// natts does not issue a token.
+func (s *session) openResumable(req tunnel.OpenRequest) (*stream, error) {
+	if s.timeouts.ResumeTimeout <= 0 {
+		return s.openStream(req)
+	}
+
+	mux, compression, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := mux.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	token, err := tunnel.OpenResumable(st, req)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	if token == "" {
+		return &stream{ReadWriteCloser: st, compression: compression, done: st.GetDieCh()}, nil
+	}
+
+	// The stream keeps its compression when it is resumed on another session
+	rc := tunnel.NewResumableConn(st, 0)
+	go s.keepResumed(rc, token)
+	return &stream{ReadWriteCloser: rc, compression: compression, done: rc.Done()}, nil
+}
+
+// keepResumed resumes rc on a new session whenever its current one breaks,
+// giving up after the resume timeout
+func (s *session) keepResumed(rc *tunnel.ResumableConn, token string) {
+	log := tunnelLog.With("stream", token[:tunnel.MinResumeTokenLength])
+	for {
+		select {
+		case <-rc.Broken():
+		case <-rc.Done():
+			return
+		}
+		select {
+		case <-rc.Done():
+			return
+		default:
+		}
+
+		log.Info("stream broken, trying to resume")
+
+		deadline := time.Now().Add(s.timeouts.ResumeTimeout)
+		for {
+			err := s.resume(rc, token)
+			if err == nil {
+				log.Info("stream resumed", "session", s.currentID())
+				break
+			}
+
+			log.Warn("failed to resume stream", "error", err)
+
+			var rerr *tunnel.RejectedError
+			if errors.As(err, &rerr) || errors.Is(err, errSessionClosed) || time.Now().After(deadline) {
+				rc.Close()
+				return
+			}
+
+			select {
+			case <-rc.Done():
+				return
+			case <-time.After(resumeRetryInterval):
+			}
+		}
+	}
+}
+
+// resume continues rc on a new stream, reconnecting to natts if necessary
+func (s *session) resume(rc *tunnel.ResumableConn, token string) error {
+	received := rc.Suspend()
+
+	// Once the broken session is closed, get connects again, re-resolving the target
+	mux, _, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	peerReceived, err := tunnel.OpenResume(stream, token, received)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	return rc.Resume(stream, peerReceived)
+}
@@ -0,0 +1,100 @@
+package nattc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// reverseRetryInterval is how long to wait before registering a reverse forward again
+const reverseRetryInterval = 5 * time.Second
+
+// runReverse keeps a reverse forward registered with natts, registering it
+// again whenever the session to natts is lost
+func (c *Client) runReverse(ctx context.Context, fwd ReverseForward) {
+	log := tunnelLog.With("forward", fwd.String())
+	for {
+		control, err := c.session.openStream(tunnel.OpenRequest{Listen: fwd.RemoteAddr})
+		if err != nil {
+			log.Warn("failed to register reverse forward", "error", err)
+		} else {
+			log.Info("reverse forward registered", "session", c.session.currentID())
+
+			// natts keeps the listener open until the control stream closes
+			io.Copy(io.Discard, control)
+			control.Close()
+
+			log.Warn("reverse forward lost")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reverseRetryInterval):
+		}
+	}
+}
+
+// handleReverseStream serves a stream natts opened for a connection accepted on a reverse listener
+func (c *Client) handleReverseStream(stream *stream) {
+	defer stream.Close()
+	defer c.trackConnection()()
+
+	log := tunnelLog.With("session", c.session.currentID())
+	req, err := tunnel.ReadOpenRequest(stream)
+	if err != nil {
+		log.Warn("failed to read stream header", "error", err)
+		return
+	}
+
+	log = log.With("service", req.Target())
+
+	if c.draining.Load() {
+		tunnel.Reject(stream, errShuttingDown)
+		return
+	}
+
+	var fwd *ReverseForward
+	for i := range c.reverses {
+		if c.reverses[i].RemoteAddr == req.Listen {
+			fwd = &c.reverses[i]
+			break
+		}
+	}
+	if fwd == nil {
+		log.Warn("rejected stream for unknown reverse forward")
+		tunnel.Reject(stream, fmt.Errorf("no reverse forward for %s", req.Target()))
+		return
+	}
+
+	localConn, err := net.DialTimeout("tcp", fwd.LocalAddr, 10*time.Second)
+	if err != nil {
+		log.Warn("failed to connect to local address", "address", fwd.LocalAddr, "error", err)
+		tunnel.Reject(stream, fmt.Errorf("%s is unavailable", fwd.LocalAddr))
+		return
+	}
+	defer localConn.Close()
+
+	if err := tunnel.Accept(stream); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	log = log.With("peer", localConn.LocalAddr().String())
+	log.Info("new reverse connection", "forward", fwd.String())
+
+	service := metrics.Service(*req)
+	defer metrics.Connection(service)()
+
+	// Proxy data between the stream and the local connection
+	if err := tunnel.Pipe(localConn, metrics.Count(c.session.wrap(stream, service), service), c.session.timeouts); err != nil {
+		log.Warn("proxy error", "error", err)
+	}
+
+	log.Info("reverse connection closed")
+}
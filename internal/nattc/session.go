@@ -0,0 +1,383 @@
+package nattc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// errSessionClosed is returned for streams opened after the session was closed
+var errSessionClosed = errors.New("connection to natts is closed")
+
+// errNoEcho and errNoBench are returned for echo and bench streams to a natts
+// that did not offer them in the handshake
+var (
+	errNoEcho  = errors.New("natts does not serve echo streams; update it to the version of nattc")
+	errNoBench = errors.New("natts does not serve bench streams; update it to the version of nattc")
+)
+
+// session holds the KCP connection to natts that all streams of a process share.
+// It is (re)established lazily when a stream is opened.
+type session struct {
+	targetFQDN string
+	resolver   *net.Resolver
+	timeouts   tunnel.Timeouts
+	kcpOptions tunnel.KCPOptions
+	authKey    *tunnel.Key
+	// handler serves streams opened by natts; they are refused if it is nil
+	handler func(*stream)
+	// shaper caps the bandwidth nattc sends to natts; all connections of the
+	// process count as one session
+	shaper    *tunnel.Shaper
+	bandwidth *tunnel.SessionBucket
+	// fec adapts the parity sent to natts, if adaptive FEC is on
+	fec *tunnel.AdaptiveFEC
+
+	mu sync.Mutex
+	// closed stops get from connecting again once nattc shuts down
+	closed bool
+	// id numbers the connections to natts, to tell them apart in the logs
+	id     uint64
+	mux    *smux.Session
+	dgram  *tunnel.DatagramConn
+	remote net.Addr
+	// compression is the algorithm agreed for the streams of mux
+	compression string
+	// servesEcho and servesBench are set if the natts of mux serves echo and bench streams
+	servesEcho, servesBench bool
+
+	// UDP flows by flow ID
+	flowMu sync.Mutex
+	flows  map[uint32]*flow
+}
+
+func newSession(cfg Config, handler func(*stream)) *session {
+	shaper := tunnel.NewShaper(cfg.Bandwidth)
+	return &session{
+		targetFQDN: cfg.TargetFQDN,
+		resolver:   cfg.Resolver,
+		timeouts:   cfg.Timeouts,
+		kcpOptions: cfg.KCP,
+		authKey:    cfg.AuthKey,
+		handler:    handler,
+		shaper:     shaper,
+		bandwidth:  shaper.NewSession(),
+		fec:        cfg.KCP.NewAdaptiveFEC(),
+		flows:      make(map[uint32]*flow),
+	}
+}
+
+// stream is a stream to natts, compressed as agreed for the session it belongs to
+type stream struct {
+	io.ReadWriteCloser
+	compression string
+	// done is closed once the stream is closed for good
+	done <-chan struct{}
+}
+
+// wrap returns the side of st that a connection of service is proxied to:
+// data is compressed as agreed with natts and what is written limited by the
+// configured bandwidth limits
+func (s *session) wrap(st *stream, service string) io.ReadWriter {
+	shaped := s.shaper.Shape(tunnel.Until(st.done), st, s.bandwidth, service)
+	if st.compression == "" {
+		return shaped
+	}
+	return tunnel.Compress(shaped, st.compression, metrics.Compressed(st.compression))
+}
+
+// openStream opens a new stream to natts and selects its target
+func (s *session) openStream(req tunnel.OpenRequest) (*stream, error) {
+	mux, compression, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.serves(req); err != nil {
+		return nil, err
+	}
+
+	st, err := mux.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	if err := tunnel.Open(st, req); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return &stream{ReadWriteCloser: st, compression: compression, done: st.GetDieCh()}, nil
+}
+
+// serves returns an error if req asks for an echo or bench stream that the
+// natts of the current session does not serve
+func (s *session) serves(req tunnel.OpenRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case req.Echo && !s.servesEcho:
+		return errNoEcho
+	case req.Bench && !s.servesBench:
+		return errNoBench
+	}
+	return nil
+}
+
+// get returns the current multiplexed session and the compression agreed for
+// it, connecting to natts if there is none
+func (s *session) get() (*smux.Session, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, "", errSessionClosed
+	}
+	if s.mux != nil && !s.mux.IsClosed() {
+		return s.mux, s.compression, nil
+	}
+
+	// Resolve target FQDN to get natts IP and port
+	targetAddr, err := dns.ResolveTarget(s.resolver, s.targetFQDN)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve target: %w", err)
+	}
+	tunnelLog.Debug("resolved target", "session", s.id+1, "address", targetAddr)
+	return s.connect(targetAddr)
+}
+
+// connect establishes a new session with natts at targetAddr. s.mu must be held.
+func (s *session) connect(targetAddr string) (*smux.Session, string, error) {
+	log := tunnelLog.With("session", s.id+1)
+
+	remote, err := net.ResolveUDPAddr("udp", targetAddr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve target address: %w", err)
+	}
+
+	// UDP flows share the socket with KCP
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	dgram := tunnel.NewDatagramConn(conn, s.handleDatagram)
+	if s.fec != nil {
+		dgram.SetAdaptiveFEC(s.fec)
+	}
+
+	// Connect to natts via KCP
+	kcpConn, err := kcp.NewConn4(rand.Uint32(), remote, nil, s.kcpOptions.DataShards, s.kcpOptions.ParityShards, true, dgram)
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("failed to connect to natts: %w", err)
+	}
+	s.kcpOptions.Apply(kcpConn)
+	if s.kcpOptions.DSCP > 0 {
+		if err := kcpConn.SetDSCP(s.kcpOptions.DSCP); err != nil {
+			log.Warn("failed to set DSCP", "dscp", s.kcpOptions.DSCP, "error", err)
+		}
+	}
+
+	mux, err := smux.Client(kcpConn, tunnel.MuxConfig(s.timeouts))
+	if err != nil {
+		kcpConn.Close()
+		return nil, "", fmt.Errorf("failed to start session: %w", err)
+	}
+
+	agreement, err := handshake(mux, s.authKey, s.kcpOptions.FEC(), s.kcpOptions.CompressionOffer())
+	if err != nil {
+		mux.Close()
+		metrics.HandshakeFailures.Inc()
+		var rerr *tunnel.RejectedError
+		if errors.As(err, &rerr) && rerr.Reason == tunnel.ErrAuthFailed.Error() {
+			metrics.AuthFailures.Inc()
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			// Without matching FEC settings natts cannot even read the handshake
+			return nil, "", fmt.Errorf("handshake with natts failed: %w (is natts running, and are [kcp] data_shards and parity_shards the same on both sides?)", err)
+		}
+		return nil, "", fmt.Errorf("handshake with natts failed: %w", err)
+	}
+
+	s.id++
+	log.Info("connected to natts", "address", targetAddr)
+	if agreement.Compression != "" {
+		log.Info("compressing streams", "algorithm", agreement.Compression)
+	}
+
+	metrics.SessionsTotal.Inc()
+	metrics.SessionsActive.Inc()
+	go func() {
+		<-mux.CloseChan()
+		metrics.SessionsActive.Dec()
+	}()
+	go metrics.WatchKCP(kcpConn, mux.CloseChan())
+
+	go s.acceptStreams(mux, agreement.Compression)
+	if agreement.AdaptiveFEC {
+		go s.exchangeFEC(mux, remote, log)
+	}
+
+	s.mux = mux
+	s.dgram = dgram
+	s.remote = remote
+	s.compression = agreement.Compression
+	s.servesEcho, s.servesBench = agreement.Echo, agreement.Bench
+	return mux, agreement.Compression, nil
+}
+
+// currentID returns the ID of the latest connection to natts
+func (s *session) currentID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// handshake authenticates to natts, checks that it uses the same FEC settings
+// and agrees on compression, on the first stream of a new session
+func handshake(mux *smux.Session, key *tunnel.Key, fec tunnel.FEC, compression *tunnel.CompressionOffer) (tunnel.Agreement, error) {
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return tunnel.Agreement{}, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(tunnel.HandshakeTimeout))
+	return tunnel.Handshake(stream, key, fec, compression)
+}
+
+// exchangeFEC runs the adaptive FEC control stream with natts until the session closes
+func (s *session) exchangeFEC(mux *smux.Session, remote net.Addr, log *slog.Logger) {
+	defer s.fec.Forget(remote)
+
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	if err := tunnel.Open(stream, tunnel.OpenRequest{Control: true}); err != nil {
+		log.Warn("failed to open control stream", "error", err)
+		return
+	}
+
+	err = s.fec.Exchange(stream, remote, tunnel.FECSampleInterval, func(parity int, loss float64) {
+		log.Info("adjusted FEC", "parity_shards", parity, "loss", loss)
+		metrics.FECAdjustments.Inc()
+	})
+	log.Debug("control stream closed", "error", err)
+}
+
+// acceptStreams serves the streams natts opens until the session closes
+func (s *session) acceptStreams(mux *smux.Session, compression string) {
+	for {
+		st, err := mux.AcceptStream()
+		if err != nil {
+			return
+		}
+
+		if s.handler == nil {
+			st.Close()
+			continue
+		}
+		go s.handler(&stream{ReadWriteCloser: st, compression: compression, done: st.GetDieCh()})
+	}
+}
+
+// flow is a UDP flow to natts. Its datagrams bypass KCP; the stream only
+// controls its lifetime.
+type flow struct {
+	id      uint32
+	control *smux.Stream
+	dgram   *tunnel.DatagramConn
+	remote  net.Addr
+	receive func([]byte)
+	// allow tells whether a datagram of n bytes is within the bandwidth limits
+	allow func(n int) bool
+}
+
+func (f *flow) send(payload []byte) error {
+	return f.dgram.WriteDatagram(f.id, payload, f.remote)
+}
+
+// openFlow asks natts for a UDP flow to the requested target.
+// Datagrams natts sends on the flow are passed to receive.
+func (s *session) openFlow(req tunnel.OpenRequest, receive func([]byte)) (*flow, error) {
+	mux, _, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	dgram, remote := s.dgram, s.remote
+	s.mu.Unlock()
+
+	stream, err := mux.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	id, err := tunnel.OpenFlow(stream, req)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	f := &flow{
+		id:      id,
+		control: stream,
+		dgram:   dgram,
+		remote:  remote,
+		receive: receive,
+		allow:   s.shaper.Police(s.bandwidth, metrics.Service(req)),
+	}
+
+	s.flowMu.Lock()
+	s.flows[id] = f
+	s.flowMu.Unlock()
+
+	return f, nil
+}
+
+// closeFlow stops delivering datagrams for f and tells natts to drop it
+func (s *session) closeFlow(f *flow) {
+	s.flowMu.Lock()
+	delete(s.flows, f.id)
+	s.flowMu.Unlock()
+
+	f.control.Close()
+}
+
+// handleDatagram delivers a datagram from natts to the receiver of its flow
+func (s *session) handleDatagram(id uint32, payload []byte, from net.Addr) {
+	s.flowMu.Lock()
+	f := s.flows[id]
+	s.flowMu.Unlock()
+
+	if f == nil || f.remote.String() != from.String() {
+		return
+	}
+	f.receive(payload)
+}
+
+func (s *session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.mux == nil {
+		return nil
+	}
+	err := s.mux.Close()
+	s.mux = nil
+	return err
+}
@@ -0,0 +1,30 @@
+package nattc
+
+import (
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func TestServes(t *testing.T) {
+	tests := []struct {
+		name                    string
+		servesEcho, servesBench bool
+		req                     tunnel.OpenRequest
+		want                    error
+	}{
+		{"echo", true, true, tunnel.OpenRequest{Echo: true}, nil},
+		{"bench", true, true, tunnel.OpenRequest{Bench: true}, nil},
+		{"echo on old natts", false, false, tunnel.OpenRequest{Echo: true}, errNoEcho},
+		{"bench on old natts", false, false, tunnel.OpenRequest{Bench: true}, errNoBench},
+		{"service on old natts", false, false, tunnel.OpenRequest{Service: "web"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &session{servesEcho: tt.servesEcho, servesBench: tt.servesBench}
+			if err := s.serves(tt.req); err != tt.want {
+				t.Errorf("serves = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package nattc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// SOCKS5 constants (RFC 1928)
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAtypNotSupported    = 0x08
+)
+
+// socksError carries the SOCKS reply code to send for a failed request
+type socksError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksError) Error() string { return e.err.Error() }
+
+func (c *Client) startSocks(ctx context.Context) error {
+	listener, err := net.Listen("tcp", c.socksAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start SOCKS listener on %s: %w", c.socksAddr, err)
+	}
+	c.listeners = append(c.listeners, listener)
+
+	mainLog.Info("SOCKS5 proxy started", "address", c.socksAddr, "target", c.targetFQDN)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				tunnelLog.Warn("failed to accept SOCKS connection", "error", err)
+				continue
+			}
+
+			go c.handleSocks(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (c *Client) handleSocks(conn net.Conn) {
+	defer conn.Close()
+	defer c.trackConnection()()
+
+	// Bound the time a client may take to complete the SOCKS handshake
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	log := tunnelLog.With("peer", conn.RemoteAddr().String())
+	address, err := socksHandshake(conn)
+	if err != nil {
+		log.Warn("SOCKS handshake failed", "error", err)
+		var serr *socksError
+		if errors.As(err, &serr) {
+			writeSocksReply(conn, serr.reply)
+		}
+		return
+	}
+
+	req := tunnel.OpenRequest{Address: address}
+	log = log.With("service", req.Target())
+	service := metrics.Service(req)
+	defer metrics.Connection(service)()
+
+	stream, err := c.session.openStream(req)
+	if err != nil {
+		log.Warn("failed to open stream", "error", err)
+		writeSocksReply(conn, socksReply(err))
+		return
+	}
+	defer stream.Close()
+
+	log = log.With("session", c.session.currentID())
+	log.Info("new SOCKS connection")
+
+	if err := writeSocksReply(conn, socksReplySucceeded); err != nil {
+		log.Warn("failed to send SOCKS reply", "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Proxy data between SOCKS connection and stream
+	if err := tunnel.Pipe(conn, metrics.Count(c.session.wrap(stream, service), service), c.session.timeouts); err != nil {
+		log.Warn("proxy error", "error", err)
+	}
+
+	log.Info("SOCKS connection closed")
+}
+
+// socksHandshake negotiates the authentication method and reads the
+// CONNECT request, returning the requested destination as host:port
+func socksHandshake(rw io.ReadWriter) (string, error) {
+	// Method selection: VER NMETHODS METHODS...
+	var header [2]byte
+	if _, err := io.ReadFull(rw, header[:]); err != nil {
+		return "", fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", fmt.Errorf("failed to read methods: %w", err)
+	}
+
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+			break
+		}
+	}
+	if _, err := rw.Write([]byte{socksVersion, method}); err != nil {
+		return "", fmt.Errorf("failed to write method selection: %w", err)
+	}
+	if method == socksMethodNoAcceptable {
+		return "", fmt.Errorf("client offers no supported authentication method")
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	if req[1] != socksCmdConnect {
+		return "", &socksError{socksReplyCommandNotSupported, fmt.Errorf("unsupported command %d", req[1])}
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if req[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(rw, size[:]); err != nil {
+			return "", fmt.Errorf("failed to read domain length: %w", err)
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(rw, domain); err != nil {
+			return "", fmt.Errorf("failed to read domain: %w", err)
+		}
+		host = string(domain)
+	default:
+		return "", &socksError{socksReplyAtypNotSupported, fmt.Errorf("unsupported address type %d", req[3])}
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply maps the reason natts rejected a stream to a SOCKS reply code
+func socksReply(err error) byte {
+	var rerr *tunnel.RejectedError
+	if !errors.As(err, &rerr) {
+		return socksReplyGeneralFailure
+	}
+	switch rerr.Code {
+	case tunnel.RejectNotAllowed:
+		return socksReplyNotAllowed
+	case tunnel.RejectRefused:
+		return socksReplyConnectionRefused
+	case tunnel.RejectUnreachable:
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
+
+// writeSocksReply sends a reply with an unspecified bound address
+func writeSocksReply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socksVersion, reply, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,102 @@
+package nattc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func TestSocksReply(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"not allowed", &tunnel.RejectedError{Code: tunnel.RejectNotAllowed}, socksReplyNotAllowed},
+		{"refused", &tunnel.RejectedError{Code: tunnel.RejectRefused}, socksReplyConnectionRefused},
+		{"unreachable", &tunnel.RejectedError{Code: tunnel.RejectUnreachable}, socksReplyHostUnreachable},
+		{"natts without codes", &tunnel.RejectedError{}, socksReplyGeneralFailure},
+		{"session failure", errors.New("failed to resolve target"), socksReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socksReply(tt.err); got != tt.want {
+				t.Errorf("socksReply = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+// socksConn feeds a client's messages to socksHandshake and collects its answers
+type socksConn struct {
+	io.Reader
+	io.Writer
+}
+
+func TestSocksHandshake(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksMethodNoAuth}
+	tests := []struct {
+		name      string
+		input     []byte
+		want      string
+		wantReply byte
+		wantErr   bool
+	}{
+		{
+			name:  "IPv4",
+			input: append(greeting, socksVersion, socksCmdConnect, 0, socksAtypIPv4, 192, 168, 1, 10, 0, 80),
+			want:  "192.168.1.10:80",
+		},
+		{
+			name:  "domain",
+			input: append(greeting, socksVersion, socksCmdConnect, 0, socksAtypDomain, 3, 'l', 'a', 'n', 0x01, 0xbb),
+			want:  "lan:443",
+		},
+		{
+			name:      "bind",
+			input:     append(greeting, socksVersion, 0x02, 0, socksAtypIPv4, 10, 0, 0, 1, 0, 22),
+			wantReply: socksReplyCommandNotSupported,
+			wantErr:   true,
+		},
+		{
+			name:      "unknown address type",
+			input:     append(greeting, socksVersion, socksCmdConnect, 0, 0x09),
+			wantReply: socksReplyAtypNotSupported,
+			wantErr:   true,
+		},
+		{
+			name:    "no acceptable method",
+			input:   []byte{socksVersion, 1, 0x02},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := socksConn{Reader: bytes.NewReader(tt.input), Writer: io.Discard}
+			got, err := socksHandshake(conn)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("socksHandshake: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("destination is %s, want %s", got, tt.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("socksHandshake accepted the request")
+			}
+			var serr *socksError
+			if tt.wantReply == 0 {
+				if errors.As(err, &serr) {
+					t.Errorf("reply %#x for an error without one", serr.reply)
+				}
+			} else if !errors.As(err, &serr) || serr.reply != tt.wantReply {
+				t.Errorf("error %v does not carry reply %#x", err, tt.wantReply)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package nattc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func (c *Client) startUDPForward(ctx context.Context, fwd Forward) error {
+	conn, err := net.ListenPacket("udp", fwd.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener on %s: %w", fwd.ListenAddr, err)
+	}
+	c.packetConns = append(c.packetConns, conn)
+
+	mainLog.Info("forwarding UDP", "forward", fwd.String(), "target", c.targetFQDN)
+
+	go c.serveUDP(ctx, conn, fwd)
+	return nil
+}
+
+// serveUDP relays the datagrams of every local peer over its own flow to natts.
+// A flow lasts until natts closes it for being idle.
+func (c *Client) serveUDP(ctx context.Context, conn net.PacketConn, fwd Forward) {
+	var mu sync.Mutex
+	flows := make(map[string]*flow)
+	req := fwd.request()
+	traffic := metrics.NewTraffic(metrics.Service(req))
+	log := tunnelLog.With("service", req.Target())
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warn("failed to read UDP datagram", "error", err)
+			}
+			return
+		}
+		if n > tunnel.MaxDatagramSize {
+			log.Warn("dropped datagram: too large", "peer", addr.String(), "size", n)
+			continue
+		}
+
+		key := addr.String()
+		mu.Lock()
+		f := flows[key]
+		mu.Unlock()
+
+		if f == nil {
+			f, err = c.session.openFlow(req, func(payload []byte) {
+				traffic.In.Add(float64(len(payload)))
+				conn.WriteTo(payload, addr)
+			})
+			if err != nil {
+				log.Warn("failed to open UDP flow", "peer", addr.String(), "error", err)
+				continue
+			}
+
+			flowLog := log.With("session", c.session.currentID(), "peer", addr.String(), "flow", f.id)
+			flowLog.Info("UDP flow opened")
+
+			mu.Lock()
+			flows[key] = f
+			mu.Unlock()
+
+			// natts closes the control stream when the flow expires
+			go func() {
+				io.Copy(io.Discard, f.control)
+				c.session.closeFlow(f)
+
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+
+				flowLog.Info("UDP flow closed")
+			}()
+		}
+
+		// Datagrams over the bandwidth limits are dropped rather than delayed
+		if !f.allow(n) {
+			continue
+		}
+		if err := f.send(buf[:n]); err != nil {
+			log.Warn("failed to send datagram", "peer", addr.String(), "flow", f.id, "error", err)
+			continue
+		}
+		traffic.Out.Add(float64(n))
+	}
+}
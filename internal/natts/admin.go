@@ -0,0 +1,227 @@
+package natts
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// IsUnixSocket reports whether an admin address is the path of a unix socket
+// rather than host:port
+func IsUnixSocket(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+// ServeAdmin starts the admin API on addr, a loopback host:port or the path
+// of a unix socket. It returns once the listener is open; the API is served
+// until Close.
+//
+// Requests from browsers, which carry an Origin header, are refused, and so
+// are requests to a loopback address under another host name. On a loopback
+// address the requests that change anything must carry token as a bearer
+// token, and are refused if token is empty; on a unix socket its file mode
+// is what keeps other users out.
+//
+// GET    /status         the Status as JSON
+// GET    /sessions       the open sessions as JSON
+// DELETE /sessions/{id}  close a session and its connections
+// POST   /rediscover     run STUN discovery and update DNS now, returning the new Status
+// GET    /bans           the IPs banned for failing to authenticate as JSON
+// DELETE /bans/{ip}      lift a ban
+// GET    /bandwidth      the bandwidth limits in effect as JSON
+// PUT    /bandwidth      replace the bandwidth limits with the JSON body, until the next reload
+// POST   /drain          shut down gracefully, as on SIGTERM
+// GET    /livez          200 if natts is live, 503 with the problems otherwise
+// GET    /readyz         200 if natts is ready for clients, 503 with the reasons otherwise
+//
+// Failed requests are answered with {"error": "..."}.
+func (s *Server) ServeAdmin(addr, token string) error {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return fmt.Errorf("failed to start admin API on %s: %w", addr, err)
+	}
+	s.adminListener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Status())
+	})
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Sessions())
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid session ID %q", r.PathValue("id")))
+			return
+		}
+		if err := s.KillSession(id); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrUnknownSession) {
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"killed": id})
+	})
+	mux.HandleFunc("POST /rediscover", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Rediscover(); err != nil {
+			code := http.StatusBadGateway
+			if errors.Is(err, errShuttingDown) {
+				code = http.StatusServiceUnavailable
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Status())
+	})
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Bans())
+	})
+	mux.HandleFunc("DELETE /bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Unban(r.PathValue("ip")); err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrNotBanned) {
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"unbanned": r.PathValue("ip")})
+	})
+	mux.HandleFunc("GET /bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Bandwidth())
+	})
+	mux.HandleFunc("PUT /bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		var limits tunnel.BandwidthLimits
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&limits); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid bandwidth limits: %w", err))
+			return
+		}
+		if err := s.SetBandwidth(limits); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Bandwidth())
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		s.Drain()
+		writeJSON(w, http.StatusAccepted, s.Status())
+	})
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.Live())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.Ready())
+	})
+
+	handler := guardAdmin(mux, !IsUnixSocket(addr), token)
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			mainLog.Error("admin API stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// guardAdmin keeps web pages the operator opens away from the admin API,
+// and requires token for the requests that change anything over TCP
+func guardAdmin(next http.Handler, tcp bool, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests from browsers are not accepted"))
+			return
+		}
+		if !tcp {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A page can point a name it controls at 127.0.0.1 (DNS rebinding)
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if token == "" {
+				writeError(w, http.StatusForbidden, fmt.Errorf("set admin_token to change natts over TCP, or serve the admin API on a unix socket"))
+				return
+			}
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong admin token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAdmin opens the admin listener. A unix socket left behind by a natts
+// that did not exit cleanly is replaced; one that is still served is not.
+func listenAdmin(addr string) (net.Listener, error) {
+	if !IsUnixSocket(addr) {
+		return net.Listen("tcp", addr)
+	}
+
+	if _, err := os.Stat(addr); err == nil {
+		if conn, err := net.Dial("unix", addr); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket is in use by another process")
+		}
+		if err := os.Remove(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Only the user running natts may use the admin API
+	if err := os.Chmod(addr, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeHealth answers a liveness or readiness check
+func writeHealth(w http.ResponseWriter, problems []string) {
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "failing", "problems": problems})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
@@ -0,0 +1,51 @@
+package natts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		tcp    bool
+		token  string
+		method string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{name: "status over TCP", tcp: true, method: http.MethodGet, host: "127.0.0.1:9200", want: http.StatusOK},
+		{name: "status as localhost", tcp: true, method: http.MethodGet, host: "localhost:9200", want: http.StatusOK},
+		{name: "status over IPv6 loopback", tcp: true, method: http.MethodGet, host: "[::1]:9200", want: http.StatusOK},
+		{name: "rebound host name", tcp: true, method: http.MethodGet, host: "evil.example:9200", want: http.StatusForbidden},
+		{name: "browser", tcp: true, method: http.MethodGet, host: "127.0.0.1:9200",
+			header: map[string]string{"Origin": "https://evil.example"}, want: http.StatusForbidden},
+		{name: "drain without a token configured", tcp: true, method: http.MethodPost, host: "127.0.0.1:9200", want: http.StatusForbidden},
+		{name: "drain without the token", tcp: true, token: "secret", method: http.MethodPost, host: "127.0.0.1:9200", want: http.StatusUnauthorized},
+		{name: "drain with a wrong token", tcp: true, token: "secret", method: http.MethodPost, host: "127.0.0.1:9200",
+			header: map[string]string{"Authorization": "Bearer wrong"}, want: http.StatusUnauthorized},
+		{name: "drain with the token", tcp: true, token: "secret", method: http.MethodPost, host: "127.0.0.1:9200",
+			header: map[string]string{"Authorization": "Bearer secret"}, want: http.StatusOK},
+		{name: "browser with the token", tcp: true, token: "secret", method: http.MethodPost, host: "127.0.0.1:9200",
+			header: map[string]string{"Authorization": "Bearer secret", "Origin": "null"}, want: http.StatusForbidden},
+		{name: "drain over the unix socket", method: http.MethodPost, host: "natts", want: http.StatusOK},
+		{name: "browser over the unix socket", method: http.MethodPost, host: "natts",
+			header: map[string]string{"Origin": "https://evil.example"}, want: http.StatusForbidden},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://"+tt.host+"/drain", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			guardAdmin(ok, tt.tcp, tt.token).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
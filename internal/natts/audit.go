@@ -0,0 +1,89 @@
+package natts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the line the audit log gets for every session once it ends
+type AuditRecord struct {
+	Session uint64 `json:"session"`
+	// Identity is the ID of the key the client authenticated with, if any
+	Identity string `json:"identity,omitempty"`
+	Peer     string `json:"peer"`
+	// Services are the targets of the streams the client opened, in order of first use
+	Services    []string  `json:"services"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Duration    string    `json:"duration"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Connections int64     `json:"connections"`
+	CloseReason string    `json:"close_reason"`
+}
+
+// Close reasons recorded in the audit log besides errors of the session
+const (
+	closeKilled      = "killed through the admin API"
+	closeShutdown    = "natts shut down"
+	closeRestart     = "natts reopened its listener"
+	closeUnreachable = "client stopped responding"
+)
+
+// auditLog appends one JSON line per session to a file. Without a path
+// nothing is written.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// open switches to the file at path, which is created if missing and only
+// ever appended to. Opening the current path again picks up a file that was
+// rotated away.
+func (a *auditLog) open(path string) error {
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	old := a.file
+	a.path, a.file = path, file
+	a.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// write appends rec and syncs it to disk, so that records survive a crash
+func (a *auditLog) write(rec AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		mainLog.Error("failed to encode audit record", "session", rec.Session, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(line); err != nil {
+		mainLog.Error("failed to write audit log", "path", a.path, "error", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		mainLog.Error("failed to sync audit log", "path", a.path, "error", err)
+	}
+}
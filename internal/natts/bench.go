@@ -0,0 +1,50 @@
+package natts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// maxBenchStreams is how many bench streams a session may run at once. nattc
+// bench runs one after the other, but the previous one may still be closing.
+const maxBenchStreams = 2
+
+// serveBench runs the sink and source of nattc bench on stream
+func (s *Server) serveBench(sess *session, log *slog.Logger, stream *smux.Stream) {
+	if !s.current().bench {
+		tunnel.Reject(stream, fmt.Errorf("bench is disabled"))
+		return
+	}
+	if sess.benchStreams.Add(1) > maxBenchStreams {
+		sess.benchStreams.Add(-1)
+		log.Warn("rejected bench stream: too many running", "limit", maxBenchStreams)
+		tunnel.Reject(stream, fmt.Errorf("at most %d bench streams may run at once", maxBenchStreams))
+		return
+	}
+	defer sess.benchStreams.Add(-1)
+	defer s.trackConnection(sess, log)()
+
+	service := metrics.Service(tunnel.OpenRequest{Bench: true})
+	defer metrics.Connection(service)()
+
+	// Pings and uploads wait for nattc, which must not hold a bench slot for good
+	stream.SetDeadline(time.Now().Add(tunnel.BenchTimeout))
+	if err := tunnel.Accept(stream); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	// Bench data is random, so it is measured without compression but within the bandwidth limits
+	conn := s.shaper.Shape(tunnel.Until(stream.GetDieCh()), stream, sess.bandwidth, service)
+	err := tunnel.ServeBench(metrics.Count(sess.count(conn), service))
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Debug("bench stream closed", "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package natts
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func TestBenchStreamsPerSession(t *testing.T) {
+	tests := []struct {
+		name        string
+		bench       bool
+		streams     int
+		wantOpened  int
+		wantRefused int
+	}{
+		{"disabled", false, 1, 0, 1},
+		{"within the limit", true, maxBenchStreams, maxBenchStreams, 0},
+		{"over the limit", true, maxBenchStreams + 2, maxBenchStreams, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Config{SSHTarget: "127.0.0.1:22", Bench: tt.bench})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newPipeSession(t, s)
+
+			opened, refused := 0, 0
+			for range tt.streams {
+				client, server := p.stream(t)
+				go func() {
+					if _, err := tunnel.ReadOpenRequest(server); err == nil {
+						s.serveBench(p.sess, p.sess.log, server)
+					}
+				}()
+				// Streams that were accepted stay open, waiting for the bench request
+				err := tunnel.Open(client, tunnel.OpenRequest{Version: tunnel.ProtocolVersion, Bench: true})
+				var rerr *tunnel.RejectedError
+				switch {
+				case err == nil:
+					opened++
+				case errors.As(err, &rerr):
+					refused++
+				default:
+					t.Fatalf("failed to open bench stream: %v", err)
+				}
+			}
+			if opened != tt.wantOpened || refused != tt.wantRefused {
+				t.Errorf("%d streams opened and %d refused, want %d and %d", opened, refused, tt.wantOpened, tt.wantRefused)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package natts
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// serveControl runs the adaptive FEC control stream of sess until the session closes
+func (s *Server) serveControl(sess *session, log *slog.Logger, stream *smux.Stream) {
+	if !sess.adaptiveFEC {
+		tunnel.Reject(stream, fmt.Errorf("adaptive FEC was not agreed on"))
+		return
+	}
+	if err := tunnel.Accept(stream); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+	defer s.fec.Forget(sess.peer)
+
+	err := s.fec.Exchange(stream, sess.peer, tunnel.FECSampleInterval, func(parity int, loss float64) {
+		log.Info("adjusted FEC", "parity_shards", parity, "loss", loss)
+		metrics.FECAdjustments.Inc()
+	})
+	log.Debug("control stream closed", "error", err)
+}
@@ -0,0 +1,212 @@
+package natts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/doctor"
+	"github.com/Hogeyama/ddns-updater/internal/stun"
+)
+
+// doctorMappingPause is how long Doctor waits before asking a STUN server
+// again, to see whether the NAT keeps the mapping of the port
+const doctorMappingPause = 2 * time.Second
+
+// Doctor checks what natts needs to be reachable with cfg when listening on
+// listenAddr: access to the DNS zone, the local port, every STUN server, the
+// NAT, the published records and the backends of the services. natts must not
+// be running for the checks of the port, but all others still run if it is.
+func Doctor(cfg Config, listenAddr string, report *doctor.Report) error {
+	p, err := newPolicy(cfg)
+	if err != nil {
+		return err
+	}
+
+	published := checkCloudflare(cfg, report)
+	probe, listenProbed := checkPort(listenAddr, p.stunServers, report)
+	external := checkSTUN(probe, report)
+	checkNAT(probe, len(p.stunServers), report)
+	checkRecords(cfg.TargetFQDN, published, external, listenProbed, report)
+	checkBackends(p.services, report)
+	return nil
+}
+
+// checkCloudflare checks the API token and returns what is published for the
+// target, or nil if the token cannot read it
+func checkCloudflare(cfg Config, report *doctor.Report) *dns.Published {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	published, err := dns.CheckAccess(ctx, cfg.CFToken, cfg.TargetFQDN)
+	switch {
+	case errors.Is(err, dns.ErrTokenInvalid):
+		report.Fail("cloudflare", err.Error(), "Set cloudflare.api_token (or CF_API_TOKEN) to an active API token with the Zone:DNS:Edit permission")
+	case errors.Is(err, dns.ErrNoZone):
+		report.Fail("cloudflare", err.Error(), fmt.Sprintf("Check target_fqdn, and include the zone of %s in the Zone Resources of the API token", cfg.TargetFQDN))
+	case errors.Is(err, dns.ErrNoRecords):
+		report.Fail("cloudflare", err.Error(), "Give the API token the Zone:DNS:Edit permission for the zone")
+	case err != nil:
+		report.Fail("cloudflare", err.Error(), "Check that this host can reach api.cloudflare.com over HTTPS")
+	default:
+		// Checking edit access would take changing a record, or a token that may read its own policies
+		report.OK("cloudflare", "API token can read the records of %s in zone %s; whether it may edit them shows on the first update", cfg.TargetFQDN, published.ZoneID)
+		return published
+	}
+	return nil
+}
+
+// checkPort checks that the UDP port of listenAddr is free and asks the STUN
+// servers about it. If the port is not fixed or not free, they are asked
+// about another port and listenProbed is false.
+func checkPort(listenAddr string, servers []string, report *doctor.Report) (probe *stun.ProbeResult, listenProbed bool) {
+	port, err := listenPort(listenAddr)
+	switch {
+	case err != nil:
+		report.Fail("port", err.Error(), "Set listen to an address such as :30000, or :0 to let STUN pick the port")
+	case port == 0:
+		report.OK("port", "listen is %s, so natts uses a free port found by STUN on every start", listenAddr)
+	default:
+		if probe, err = stun.Probe(port, servers, doctorMappingPause); err == nil {
+			report.OK("port", "UDP port %d is free", port)
+			return probe, true
+		}
+		report.Fail("port", err.Error(), fmt.Sprintf("Stop the process using UDP port %d (natts itself, if it is running) or change listen", port))
+	}
+
+	// The other checks still tell a lot from any port
+	probe, err = stun.Probe(0, servers, doctorMappingPause)
+	if err != nil {
+		report.Fail("stun", err.Error(), "Check that this host can open UDP sockets")
+	}
+	return probe, false
+}
+
+// checkSTUN reports the answer of every STUN server and returns the external
+// address of the first that answered, or nil if none did
+func checkSTUN(probe *stun.ProbeResult, report *doctor.Report) *net.UDPAddr {
+	if probe == nil {
+		return nil
+	}
+
+	var external *net.UDPAddr
+	for _, m := range probe.Mappings {
+		if m.Err == nil && external == nil {
+			external = m.Addr
+		}
+	}
+	for _, m := range probe.Mappings {
+		check := "stun " + m.Server
+		switch {
+		case m.Err == nil:
+			report.OK(check, "sees port %d as %s (%.1fms)", probe.LocalPort, m.Addr, float64(m.RTT)/float64(time.Millisecond))
+		case external != nil:
+			report.Warn(check, m.Err.Error(), "natts falls back to the other servers, but remove this one from [stun] servers if it stays unreachable")
+		default:
+			report.Fail(check, m.Err.Error(), "Allow outbound UDP to the STUN server, or add servers that are reachable to [stun] servers")
+		}
+	}
+	return external
+}
+
+// checkNAT reports the NAT type and whether the NAT kept the mapping of the port
+func checkNAT(probe *stun.ProbeResult, servers int, report *doctor.Report) {
+	if probe == nil {
+		report.Skip("nat", "no UDP port to probe")
+		return
+	}
+	if !slices.ContainsFunc(probe.Mappings, func(m stun.Mapping) bool { return m.Err == nil }) {
+		report.Skip("nat", "no STUN server answered")
+		return
+	}
+
+	natType := probe.NATType()
+	switch {
+	case servers < 2:
+		report.Warn("nat", "the NAT type is unknown with a single STUN server", "Add a second server to [stun] servers to detect the NAT type")
+	case natType == stun.NATUnknown:
+		report.Warn("nat", "the NAT type is unknown, fewer than two STUN servers answered", "Make at least two of the [stun] servers reachable")
+	case natType == stun.NATSymmetric:
+		report.Fail("nat", "symmetric NAT: every destination sees a different external port, so clients cannot reach the published one",
+			"Forward a UDP port to this host on the router and set listen to it, or run natts behind a NAT that maps ports independently of the destination")
+	case natType == stun.NATNone:
+		report.OK("nat", "no NAT, the port is reachable at its own address")
+	default:
+		report.OK("nat", "%s NAT, clients can reach the address STUN sees", natType)
+	}
+
+	if probe.Again == nil {
+		return
+	}
+	first := probe.Mappings[slices.IndexFunc(probe.Mappings, func(m stun.Mapping) bool { return m.Err == nil })]
+	switch {
+	case probe.Again.Err != nil:
+		report.Warn("nat mapping", fmt.Sprintf("%s did not answer again: %v", probe.Again.Server, probe.Again.Err), "Check for packet loss to the STUN server")
+	case !probe.Again.Addr.IP.Equal(first.Addr.IP) || probe.Again.Addr.Port != first.Addr.Port:
+		report.Warn("nat mapping", fmt.Sprintf("the external address changed from %s to %s within %s", first.Addr, probe.Again.Addr, doctorMappingPause),
+			"The published address goes stale quickly; forward a UDP port to this host on the router and set listen to it")
+	default:
+		report.OK("nat mapping", "%s kept %s after %s", probe.Again.Server, first.Addr, doctorMappingPause)
+	}
+}
+
+// checkRecords compares the records published for fqdn with the external
+// address STUN found, and with what resolvers return to clients. The port is
+// only compared if STUN was asked about the listen port.
+func checkRecords(fqdn string, published *dns.Published, external *net.UDPAddr, listenProbed bool, report *doctor.Report) {
+	if published == nil || external == nil {
+		report.Skip("records", "needs the cloudflare and stun checks to pass")
+		return
+	}
+
+	const fix = "Start natts, or run natts rediscover if it is running, to publish the current address"
+	switch {
+	case published.Offline:
+		report.Warn("records", "the TXT record marks natts offline", fix)
+		return
+	case len(published.IPv4) == 0 || published.Port == "":
+		report.Warn("records", fmt.Sprintf("no A and kcp-port TXT records are published for %s", fqdn), fix)
+		return
+	case !slices.Contains(published.IPv4, external.IP.String()):
+		report.Warn("records", fmt.Sprintf("the A record is %s but STUN sees %s", strings.Join(published.IPv4, ", "), external.IP), fix)
+		return
+	case listenProbed && published.Port != strconv.Itoa(external.Port):
+		report.Warn("records", fmt.Sprintf("the TXT record publishes port %s but STUN sees port %d", published.Port, external.Port), fix)
+		return
+	}
+
+	endpoint := net.JoinHostPort(external.IP.String(), published.Port)
+	report.OK("records", "%s publishes %s", fqdn, endpoint)
+
+	resolved, err := dns.ResolveTarget(nil, fqdn)
+	switch {
+	case err != nil:
+		report.Warn("resolution", err.Error(), "Wait for the TTL of the records to expire, and check that the resolver of this host answers for "+fqdn)
+	case resolved != endpoint:
+		report.Warn("resolution", fmt.Sprintf("resolvers still return %s", resolved), "Wait for the TTL of the records to expire")
+	default:
+		report.OK("resolution", "clients resolve %s to %s", fqdn, resolved)
+	}
+}
+
+// checkBackends connects to the backend of every service
+func checkBackends(services map[string]string, report *doctor.Report) {
+	for _, name := range slices.Sorted(maps.Keys(services)) {
+		addr := services[name]
+		check := "service " + name
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			report.Fail(check, err.Error(), fmt.Sprintf("Start the backend on %s, or fix the address of the service", addr))
+			continue
+		}
+		conn.Close()
+		report.OK(check, "%s accepts connections", addr)
+	}
+}
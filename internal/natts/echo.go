@@ -0,0 +1,25 @@
+package natts
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// serveEcho sends back what nattc ping writes to stream, without connecting to a backend
+func (s *Server) serveEcho(sess *session, log *slog.Logger, stream *smux.Stream) {
+	if err := tunnel.Accept(stream); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	service := metrics.Service(tunnel.OpenRequest{Echo: true})
+	err := tunnel.ServeEcho(s.shaper.Shape(tunnel.Until(stream.GetDieCh()), stream, sess.bandwidth, service))
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Debug("echo stream closed", "error", err)
+	}
+}
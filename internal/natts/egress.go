@@ -0,0 +1,158 @@
+package natts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EgressRule permits streams to dial addresses inside Prefix on the given ports.
+// A rule without ports permits every port.
+type EgressRule struct {
+	Prefix netip.Prefix
+	Ports  []PortRange
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low, High uint16
+}
+
+func (r EgressRule) String() string {
+	if len(r.Ports) == 0 {
+		return r.Prefix.String()
+	}
+
+	ports := make([]string, 0, len(r.Ports))
+	for _, pr := range r.Ports {
+		if pr.Low == pr.High {
+			ports = append(ports, strconv.Itoa(int(pr.Low)))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d-%d", pr.Low, pr.High))
+		}
+	}
+
+	prefix := r.Prefix.String()
+	if r.Prefix.Addr().Is6() {
+		prefix = "[" + prefix + "]"
+	}
+	return prefix + ":" + strings.Join(ports, ",")
+}
+
+func (r EgressRule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *EgressRule) UnmarshalText(text []byte) error {
+	rule, err := ParseEgressRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// Permits reports whether the rule allows dialing addr
+func (r EgressRule) Permits(addr netip.AddrPort) bool {
+	if !r.Prefix.Contains(addr.Addr().Unmap()) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, pr := range r.Ports {
+		if addr.Port() >= pr.Low && addr.Port() <= pr.High {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEgressRule parses rules such as "192.168.1.0/24", "10.0.0.5:22,80",
+// "192.168.1.0/24:8000-8100" or "[fd00::/8]:443"
+func ParseEgressRule(s string) (EgressRule, error) {
+	prefixStr, portsStr := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: missing ']'", s)
+		}
+		prefixStr, portsStr = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+	} else if strings.Count(s, ":") == 1 {
+		prefixStr, portsStr, _ = strings.Cut(s, ":")
+	}
+
+	var rule EgressRule
+	if strings.Contains(prefixStr, "/") {
+		prefix, err := netip.ParsePrefix(prefixStr)
+		if err != nil {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: %w", s, err)
+		}
+		rule.Prefix = prefix.Masked()
+	} else {
+		addr, err := netip.ParseAddr(prefixStr)
+		if err != nil {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: %w", s, err)
+		}
+		rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if portsStr == "" {
+		return rule, nil
+	}
+	for _, part := range strings.Split(portsStr, ",") {
+		lowStr, highStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			highStr = lowStr
+		}
+		low, err := strconv.ParseUint(lowStr, 10, 16)
+		if err != nil {
+			return EgressRule{}, fmt.Errorf("invalid port %q in egress rule %q", part, s)
+		}
+		high, err := strconv.ParseUint(highStr, 10, 16)
+		if err != nil || high < low {
+			return EgressRule{}, fmt.Errorf("invalid port %q in egress rule %q", part, s)
+		}
+		rule.Ports = append(rule.Ports, PortRange{Low: uint16(low), High: uint16(high)})
+	}
+	return rule, nil
+}
+
+// resolveEgress resolves a host:port requested by a client and returns
+// the first resulting address that the egress rules permit
+func (p *policy) resolveEgress(address string) (string, error) {
+	if len(p.egress) == 0 {
+		return "", fmt.Errorf("address %s is not allowed", address)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %s: %w", address, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in address %s", address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	for _, addr := range addrs {
+		candidate := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+		for _, rule := range p.egress {
+			if rule.Permits(candidate) {
+				return candidate.String(), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("address %s is not allowed", address)
+}
@@ -0,0 +1,255 @@
+package natts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterPruneInterval is how often state about peers that went quiet is dropped
+const limiterPruneInterval = time.Minute
+
+// ErrNotBanned is returned by Unban for IPs that are not banned
+var ErrNotBanned = errors.New("not banned")
+
+// Limits caps the sessions natts accepts. A zero value disables a limit.
+type Limits struct {
+	// MaxSessions caps the sessions open at once across all peers
+	MaxSessions int
+	// MaxSessionsPerIP caps the sessions open at once from one source IP
+	MaxSessionsPerIP int
+	// SessionRate caps new sessions per second across all peers, allowing
+	// bursts of SessionBurst
+	SessionRate  float64
+	SessionBurst int
+	// SessionRatePerIP caps new sessions per second from one source IP,
+	// allowing bursts of SessionBurstPerIP
+	SessionRatePerIP  float64
+	SessionBurstPerIP int
+	// BanAfter authentication failures from one IP within BanWindow ban it
+	// for BanDuration
+	BanAfter    int
+	BanWindow   time.Duration
+	BanDuration time.Duration
+}
+
+// Reasons a session is refused before its handshake, also used as metric labels
+const (
+	rejectBanned           = "banned"
+	rejectMaxSessions      = "max_sessions"
+	rejectMaxSessionsPerIP = "max_sessions_per_ip"
+	rejectRate             = "rate"
+	rejectRatePerIP        = "rate_per_ip"
+)
+
+// limiter enforces Limits across sessions. The limits themselves come from
+// the policy in effect, so that Reload can change them.
+type limiter struct {
+	mu       sync.Mutex
+	total    int
+	sessions map[netip.Addr]int
+	rate     *rate.Limiter
+	rates    map[netip.Addr]*rate.Limiter
+	// failures are the times of recent authentication failures by IP
+	failures map[netip.Addr][]time.Time
+	// bans are the times banned IPs are let in again
+	bans       map[netip.Addr]time.Time
+	lastPruned time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		sessions:   make(map[netip.Addr]int),
+		rate:       rate.NewLimiter(rate.Inf, 0),
+		rates:      make(map[netip.Addr]*rate.Limiter),
+		failures:   make(map[netip.Addr][]time.Time),
+		bans:       make(map[netip.Addr]time.Time),
+		lastPruned: time.Now(),
+	}
+}
+
+// peerIP returns the IP of a peer address, without the IPv4-in-IPv6 prefix
+func peerIP(addr net.Addr) netip.Addr {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ip, _ := netip.AddrFromSlice(udp.IP)
+		return ip.Unmap()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap.Addr().Unmap()
+}
+
+// admit counts a new session from ip, or returns why it is refused.
+// Admitted sessions must be released once they end.
+func (l *limiter) admit(ip netip.Addr, limits Limits) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now, limits)
+
+	if until, ok := l.bans[ip]; ok && now.Before(until) {
+		return rejectBanned, false
+	}
+	if limits.MaxSessions > 0 && l.total >= limits.MaxSessions {
+		return rejectMaxSessions, false
+	}
+	if limits.MaxSessionsPerIP > 0 && l.sessions[ip] >= limits.MaxSessionsPerIP {
+		return rejectMaxSessionsPerIP, false
+	}
+
+	l.rate = setRate(l.rate, limits.SessionRate, limits.SessionBurst)
+	global := l.rate
+	perIP := setRate(l.rates[ip], limits.SessionRatePerIP, limits.SessionBurstPerIP)
+	l.rates[ip] = perIP
+
+	// Only take tokens once both limiters agree, so that refused sessions
+	// do not use up the allowance of others
+	if global.Limit() != rate.Inf && global.TokensAt(now) < 1 {
+		return rejectRate, false
+	}
+	if !perIP.AllowN(now, 1) {
+		return rejectRatePerIP, false
+	}
+	global.AllowN(now, 1)
+
+	l.total++
+	l.sessions[ip]++
+	return "", true
+}
+
+// setRate applies a configured rate to r and returns it; a rate of 0 removes
+// the limit. A limiter that was unlimited so far has saved up no tokens, so
+// it is replaced by one with a full burst.
+func setRate(r *rate.Limiter, perSecond float64, burst int) *rate.Limiter {
+	limit := rate.Inf
+	if perSecond > 0 {
+		limit = rate.Limit(perSecond)
+		burst = max(burst, 1)
+	}
+	if r == nil || (r.Limit() == rate.Inf && limit != rate.Inf) {
+		return rate.NewLimiter(limit, burst)
+	}
+	if r.Limit() != limit {
+		r.SetLimit(limit)
+	}
+	if r.Burst() != burst {
+		r.SetBurst(burst)
+	}
+	return r
+}
+
+// release records the end of a session admitted for ip
+func (l *limiter) release(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.sessions[ip]--; l.sessions[ip] <= 0 {
+		delete(l.sessions, ip)
+	}
+}
+
+// authFailed records a failed authentication from ip and reports whether it
+// got ip banned
+func (l *limiter) authFailed(ip netip.Addr, limits Limits) bool {
+	if limits.BanAfter <= 0 || limits.BanDuration <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	failures := append(recent(l.failures[ip], now, limits.BanWindow), now)
+	if len(failures) < limits.BanAfter {
+		l.failures[ip] = failures
+		return false
+	}
+	delete(l.failures, ip)
+	l.bans[ip] = now.Add(limits.BanDuration)
+	return true
+}
+
+// recent drops the times older than window; without a window all are kept
+func recent(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	if window <= 0 {
+		return times
+	}
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	return times[i:]
+}
+
+// Bans lists the IPs banned for failing to authenticate, soonest to expire first
+func (s *Server) Bans() []BanStatus {
+	l := s.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]BanStatus, 0, len(l.bans))
+	for ip, until := range l.bans {
+		if now.Before(until) {
+			bans = append(bans, BanStatus{IP: ip.String(), Until: until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Unban lets a banned IP connect again
+func (s *Server) Unban(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid IP %q", ip)
+	}
+	addr = addr.Unmap()
+
+	l := s.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until, ok := l.bans[addr]; !ok || !time.Now().Before(until) {
+		return fmt.Errorf("%w: %s", ErrNotBanned, addr)
+	}
+	delete(l.bans, addr)
+	delete(l.failures, addr)
+	mainLog.Info("ban lifted", "ip", addr.String())
+	return nil
+}
+
+// prune drops expired bans and failures, and the rate limiters of peers that
+// have not connected for a while, so that spoofed source addresses cannot
+// grow the maps without bound
+func (l *limiter) prune(now time.Time, limits Limits) {
+	if now.Sub(l.lastPruned) < limiterPruneInterval {
+		return
+	}
+	l.lastPruned = now
+
+	for ip, until := range l.bans {
+		if !now.Before(until) {
+			delete(l.bans, ip)
+		}
+	}
+	for ip, failures := range l.failures {
+		if failures = recent(failures, now, limits.BanWindow); len(failures) == 0 || limits.BanAfter <= 0 {
+			delete(l.failures, ip)
+		} else {
+			l.failures[ip] = failures
+		}
+	}
+	for ip, r := range l.rates {
+		if l.sessions[ip] == 0 && (r.Limit() == rate.Inf || r.TokensAt(now) >= float64(r.Burst())) {
+			delete(l.rates, ip)
+		}
+	}
+}
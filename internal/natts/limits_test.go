@@ -0,0 +1,156 @@
+package natts
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestLimiterAdmit(t *testing.T) {
+	a, b, c := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")
+
+	// step admits a session from ip, or releases one if release is set
+	type step struct {
+		ip      netip.Addr
+		release bool
+		want    string
+	}
+	tests := []struct {
+		name   string
+		limits Limits
+		steps  []step
+	}{
+		{
+			"unlimited",
+			Limits{},
+			[]step{{ip: a}, {ip: a}, {ip: b}},
+		},
+		{
+			"max sessions",
+			Limits{MaxSessions: 2},
+			[]step{{ip: a}, {ip: b}, {ip: c, want: rejectMaxSessions}, {ip: a, release: true}, {ip: c}},
+		},
+		{
+			"max sessions per IP",
+			Limits{MaxSessionsPerIP: 1},
+			[]step{{ip: a}, {ip: a, want: rejectMaxSessionsPerIP}, {ip: b}, {ip: a, release: true}, {ip: a}},
+		},
+		{
+			"rate",
+			Limits{SessionRate: 0.001, SessionBurst: 2},
+			[]step{{ip: a}, {ip: b}, {ip: c, want: rejectRate}, {ip: a, release: true}, {ip: c, want: rejectRate}},
+		},
+		{
+			// The session refused by its own rate leaves the global allowance to b
+			"rate per IP",
+			Limits{SessionRate: 0.001, SessionBurst: 2, SessionRatePerIP: 0.001, SessionBurstPerIP: 1},
+			[]step{{ip: a}, {ip: a, want: rejectRatePerIP}, {ip: b}, {ip: c, want: rejectRate}},
+		},
+		{
+			"rate without burst",
+			Limits{SessionRatePerIP: 0.001},
+			[]step{{ip: a}, {ip: a, want: rejectRatePerIP}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter()
+			for i, s := range tt.steps {
+				if s.release {
+					l.release(s.ip)
+					continue
+				}
+				reason, ok := l.admit(s.ip, tt.limits)
+				if reason != s.want || ok != (s.want == "") {
+					t.Errorf("step %d: session from %s refused with %q (admitted %v), want %q", i, s.ip, reason, ok, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterBan(t *testing.T) {
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	limits := Limits{BanAfter: 3, BanWindow: time.Minute, BanDuration: time.Hour}
+	l := newLimiter()
+
+	for i := range 3 {
+		if banned := l.authFailed(a, limits); banned != (i == 2) {
+			t.Errorf("failure %d banned %s: %v", i+1, a, banned)
+		}
+	}
+	l.authFailed(b, limits)
+
+	if reason, _ := l.admit(a, limits); reason != rejectBanned {
+		t.Errorf("banned IP refused with %q, want %q", reason, rejectBanned)
+	}
+	if reason, ok := l.admit(b, limits); !ok {
+		t.Errorf("IP with one failure refused with %q", reason)
+	}
+	if len(l.failures[a]) != 0 {
+		t.Error("failures of a banned IP are kept")
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	now := time.Now()
+	ip := func(s string) netip.Addr { return netip.MustParseAddr(s) }
+	full := func() *rate.Limiter { return rate.NewLimiter(1, 1) }
+	spent := func() *rate.Limiter {
+		r := rate.NewLimiter(0.001, 1)
+		r.AllowN(now, 1)
+		return r
+	}
+	limits := Limits{BanAfter: 3, BanWindow: time.Minute}
+
+	l := newLimiter()
+	l.lastPruned = now.Add(-2 * limiterPruneInterval)
+	l.bans[ip("192.0.2.1")] = now.Add(-time.Second)
+	l.bans[ip("192.0.2.2")] = now.Add(time.Hour)
+	l.failures[ip("192.0.2.3")] = []time.Time{now.Add(-2 * time.Minute)}
+	l.failures[ip("192.0.2.4")] = []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Second)}
+	l.rates[ip("192.0.2.5")] = full()
+	l.rates[ip("192.0.2.6")] = spent()
+	l.rates[ip("192.0.2.7")] = full()
+	l.sessions[ip("192.0.2.7")] = 1
+	l.rates[ip("192.0.2.8")] = rate.NewLimiter(rate.Inf, 0)
+
+	l.prune(now, limits)
+
+	tests := []struct {
+		name string
+		kept bool
+		got  bool
+	}{
+		{"expired ban", false, has(l.bans, ip("192.0.2.1"))},
+		{"ban", true, has(l.bans, ip("192.0.2.2"))},
+		{"failures out of the window", false, has(l.failures, ip("192.0.2.3"))},
+		{"recent failure", true, has(l.failures, ip("192.0.2.4"))},
+		{"refilled rate limiter", false, has(l.rates, ip("192.0.2.5"))},
+		{"spent rate limiter", true, has(l.rates, ip("192.0.2.6"))},
+		{"rate limiter of an open session", true, has(l.rates, ip("192.0.2.7"))},
+		{"unlimited rate limiter", false, has(l.rates, ip("192.0.2.8"))},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.kept {
+			t.Errorf("%s kept: %v, want %v", tt.name, tt.got, tt.kept)
+		}
+	}
+	if got := len(l.failures[ip("192.0.2.4")]); got != 1 {
+		t.Errorf("%d failures kept, want the one in the window", got)
+	}
+
+	// Until the interval has passed again nothing is pruned
+	l.bans[ip("192.0.2.1")] = now.Add(-time.Second)
+	l.prune(now.Add(time.Second), limits)
+	if !has(l.bans, ip("192.0.2.1")) {
+		t.Error("pruned again before the interval passed")
+	}
+}
+
+func has[V any](m map[netip.Addr]V, ip netip.Addr) bool {
+	_, ok := m[ip]
+	return ok
+}
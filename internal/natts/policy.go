@@ -0,0 +1,115 @@
+package natts
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/stun"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+// policy holds the settings that can be replaced while natts is running.
+// A policy is never modified; Reload swaps in a new one.
+type policy struct {
+	updater     dns.Updater
+	stunServers []string
+	services    map[string]string
+	egress      []EgressRule
+	// Addresses clients may ask natts to listen on for reverse forwards
+	reverseListen []string
+	// Keys clients authenticate with; any client is accepted without them
+	authorizedKeys []tunnel.Key
+	udpIdleTimeout time.Duration
+	timeouts       tunnel.Timeouts
+	markOffline    bool
+	limits         Limits
+	sources        *sourceFilter
+	bench          bool
+}
+
+func newPolicy(cfg Config) (*policy, error) {
+	services := make(map[string]string, len(cfg.Services)+1)
+	if cfg.SSHTarget != "" {
+		services[tunnel.DefaultService] = cfg.SSHTarget
+	}
+	for name, addr := range cfg.Services {
+		if name == "" {
+			return nil, fmt.Errorf("service name must not be empty")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address for service %s: %w", name, err)
+		}
+		services[name] = addr
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no services configured")
+	}
+
+	udpIdleTimeout := cfg.UDPIdleTimeout
+	if udpIdleTimeout <= 0 {
+		udpIdleTimeout = 2 * time.Minute
+	}
+
+	stunServers := cfg.STUNServers
+	if len(stunServers) == 0 {
+		stunServers = stun.DefaultServers
+	}
+
+	updater := cfg.Updater
+	if updater == nil {
+		updater = dns.Cloudflare{APIToken: cfg.CFToken}
+	}
+
+	sources, err := newSourceFilter(cfg.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy{
+		updater:        updater,
+		stunServers:    stunServers,
+		services:       services,
+		egress:         cfg.Egress,
+		reverseListen:  cfg.ReverseListen,
+		authorizedKeys: cfg.AuthorizedKeys,
+		udpIdleTimeout: udpIdleTimeout,
+		timeouts:       cfg.Timeouts,
+		markOffline:    cfg.MarkOfflineOnShutdown,
+		limits:         cfg.Limits,
+		sources:        sources,
+		bench:          cfg.Bench,
+	}, nil
+}
+
+// current returns the policy in effect
+func (s *Server) current() *policy {
+	s.policyMutex.RLock()
+	defer s.policyMutex.RUnlock()
+	return s.policy
+}
+
+// Reload applies the settings of cfg that can change while natts is running:
+// the Cloudflare token, STUN servers, services, egress and reverse allowlists,
+// authorized keys, timeouts, limits and source rules. They take effect for new sessions and streams;
+// established ones keep the settings they started with. TargetFQDN and KCP
+// are only read by New. The audit log is reopened, so that it can be rotated,
+// and the bandwidth limits replace those set through SetBandwidth.
+func (s *Server) Reload(cfg Config) error {
+	p, err := newPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.audit.open(cfg.AuditLog); err != nil {
+		return err
+	}
+	s.shaper.SetLimits(cfg.Bandwidth)
+
+	s.policyMutex.Lock()
+	s.policy = p
+	s.policyMutex.Unlock()
+
+	mainLog.Info("configuration reloaded", "services", len(p.services), "authorized_keys", len(p.authorizedKeys))
+	return nil
+}
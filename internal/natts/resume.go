@@ -0,0 +1,121 @@
+package natts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// resumableStream is a stream that can be resumed and the session carrying it
+type resumableStream struct {
+	conn *tunnel.ResumableConn
+	// sess is guarded by Server.resumeMutex
+	sess *session
+}
+
+// registerResumable wraps stream of sess so that it can be resumed within
+// timeout whenever it breaks, and returns its token
+func (s *Server) registerResumable(sess *session, stream *smux.Stream, timeout time.Duration, log *slog.Logger) (*tunnel.ResumableConn, string) {
+	var buf [16]byte
+	rand.Read(buf[:])
+	token := hex.EncodeToString(buf[:])
+
+	rc := tunnel.NewResumableConn(stream, 0)
+
+	s.resumeMutex.Lock()
+	s.resumable[token] = &resumableStream{conn: rc, sess: sess}
+	s.resumeMutex.Unlock()
+
+	go s.watchResumable(rc, token, timeout, log.With("stream", token[:tunnel.MinResumeTokenLength]))
+	return rc, token
+}
+
+func (s *Server) unregisterResumable(token string) {
+	s.resumeMutex.Lock()
+	delete(s.resumable, token)
+	s.resumeMutex.Unlock()
+}
+
+// watchResumable keeps the backend connection of a broken stream open for the
+// grace period and closes the stream if it is not resumed in time
+func (s *Server) watchResumable(rc *tunnel.ResumableConn, token string, timeout time.Duration, log *slog.Logger) {
+	for {
+		select {
+		case <-rc.Broken():
+		case <-rc.Done():
+			return
+		}
+		select {
+		case <-rc.Done():
+			return
+		default:
+		}
+
+		log.Info("stream broken, waiting for it to be resumed", "timeout", timeout)
+		if !rc.WaitResumed(timeout) {
+			log.Warn("stream was not resumed in time")
+			rc.Close()
+			return
+		}
+	}
+}
+
+// closeResumable closes and forgets the resumable streams carried by sess
+func (s *Server) closeResumable(sess *session) {
+	var conns []*tunnel.ResumableConn
+	s.resumeMutex.Lock()
+	for token, rs := range s.resumable {
+		if rs.sess == sess {
+			conns = append(conns, rs.conn)
+			delete(s.resumable, token)
+		}
+	}
+	s.resumeMutex.Unlock()
+
+	for _, rc := range conns {
+		rc.Close()
+	}
+}
+
+// resumeStream continues a broken stream on a new stream of sess. It returns
+// once the new stream breaks or the resumed stream ends.
+func (s *Server) resumeStream(sess *session, log *slog.Logger, stream *smux.Stream, req *tunnel.OpenRequest) {
+	var rc *tunnel.ResumableConn
+	s.resumeMutex.Lock()
+	if rs := s.resumable[req.Resume]; rs != nil {
+		rc = rs.conn
+		rs.sess = sess
+	}
+	s.resumeMutex.Unlock()
+
+	if rc == nil {
+		log.Warn("rejected resume: unknown token")
+		tunnel.Reject(stream, fmt.Errorf("unknown or expired session token"))
+		return
+	}
+
+	received := rc.Suspend()
+	if err := tunnel.AcceptResume(stream, received); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	if err := rc.Resume(stream, req.Received); err != nil {
+		log.Warn("failed to resume stream", "stream", req.Resume[:tunnel.MinResumeTokenLength], "error", err)
+		rc.Close()
+		return
+	}
+
+	log.Info("stream resumed", "stream", req.Resume[:tunnel.MinResumeTokenLength])
+
+	// The resumed stream now owns this stream
+	select {
+	case <-rc.Broken():
+	case <-rc.Done():
+	}
+}
@@ -0,0 +1,127 @@
+package natts
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// testServer returns a natts that is not listening, to drive sessions by hand
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := New(Config{SSHTarget: "127.0.0.1:22"})
+	if err != nil {
+		t.Fatalf("failed to create natts: %v", err)
+	}
+	return s
+}
+
+// pipeSession is a session of s whose client side is driven by the test
+type pipeSession struct {
+	sess   *session
+	client *smux.Session
+}
+
+func newPipeSession(t *testing.T, s *Server) *pipeSession {
+	t.Helper()
+	c, n := net.Pipe()
+	client, err := smux.Client(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := smux.Server(n, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		mux.Close()
+	})
+	return &pipeSession{sess: s.addSession(mux, c.RemoteAddr()), client: client}
+}
+
+// stream opens a stream from the client and returns both of its ends
+func (p *pipeSession) stream(t *testing.T) (client, server *smux.Stream) {
+	t.Helper()
+	client, err := p.client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// smux only announces a stream once something is written to it
+	go client.Write(nil)
+	server, err = p.sess.mux.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestKilledSessionStreamIsNotResumed(t *testing.T) {
+	tests := []struct {
+		name        string
+		killOwner   bool
+		wantResumed bool
+	}{
+		{"session of the stream killed", true, false},
+		{"another session killed", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			owner := newPipeSession(t, s)
+			other := newPipeSession(t, s)
+
+			_, stream := owner.stream(t)
+			rc, token := s.registerResumable(owner.sess, stream, time.Minute, owner.sess.log)
+			defer s.unregisterResumable(token)
+
+			killed := other.sess
+			if tt.killOwner {
+				killed = owner.sess
+			}
+			if err := s.KillSession(killed.id); err != nil {
+				t.Fatalf("KillSession: %v", err)
+			}
+
+			select {
+			case <-rc.Done():
+				if tt.wantResumed {
+					t.Fatal("stream was closed with another session")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if !tt.wantResumed {
+					t.Fatal("stream of the killed session is still open")
+				}
+			}
+
+			// The client resumes the stream on a new session
+			next := newPipeSession(t, s)
+			client, server := next.stream(t)
+			resumed := make(chan error, 1)
+			go func() {
+				_, err := tunnel.OpenResume(client, token, 0)
+				resumed <- err
+				client.Close()
+			}()
+			req, err := tunnel.ReadOpenRequest(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.resumeStream(next.sess, next.sess.log, server, req)
+
+			err = <-resumed
+			var rerr *tunnel.RejectedError
+			switch {
+			case tt.wantResumed && err != nil:
+				t.Fatalf("resume failed: %v", err)
+			case !tt.wantResumed && !errors.As(err, &rerr):
+				t.Fatalf("resume of a killed stream was not rejected: %v", err)
+			}
+			rc.Close()
+		})
+	}
+}
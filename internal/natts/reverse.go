@@ -0,0 +1,106 @@
+package natts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// reverseAllowed reports whether clients may ask natts to listen on addr.
+// An allowed address with port "*" permits every port on that host.
+func (p *policy) reverseAllowed(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.reverseListen {
+		if allowed == addr || allowed == net.JoinHostPort(host, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveReverse opens the listener requested on a control stream and carries every
+// accepted connection back to nattc over mux. The listener lives as long as the
+// control stream.
+func (s *Server) serveReverse(sess *session, log *slog.Logger, control *smux.Stream, listenAddr string) {
+	if !s.current().reverseAllowed(listenAddr) {
+		log.Warn("rejected reverse forward: not allowed")
+		tunnel.RejectWith(control, tunnel.RejectNotAllowed, fmt.Errorf("listening on %s is not allowed", listenAddr))
+		return
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Warn("failed to start reverse listener", "error", err)
+		code := tunnel.RejectNotAllowed
+		if errors.Is(err, syscall.EADDRINUSE) {
+			code = tunnel.RejectInUse
+		}
+		tunnel.RejectWith(control, code, fmt.Errorf("failed to listen on %s", listenAddr))
+		return
+	}
+	defer listener.Close()
+
+	if err := tunnel.Accept(control); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	log.Info("reverse listener started", "address", listener.Addr().String())
+
+	// Stop listening once the client drops the control stream
+	go func() {
+		io.Copy(io.Discard, control)
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Info("reverse listener closed")
+			return
+		}
+
+		go s.handleReverseConnection(sess, log, conn, listenAddr)
+	}
+}
+
+func (s *Server) handleReverseConnection(sess *session, log *slog.Logger, conn net.Conn, listenAddr string) {
+	defer conn.Close()
+
+	log = log.With("client", conn.RemoteAddr().String())
+	defer s.trackConnection(sess, log)()
+
+	req := tunnel.OpenRequest{Listen: listenAddr}
+	service := metrics.Service(req)
+	defer metrics.Connection(service)()
+
+	log.Info("new reverse connection")
+
+	stream, err := sess.mux.OpenStream()
+	if err != nil {
+		log.Warn("failed to open reverse stream", "error", err)
+		return
+	}
+	defer stream.Close()
+
+	if err := tunnel.Open(stream, req); err != nil {
+		log.Warn("failed to open reverse stream", "error", err)
+		return
+	}
+
+	// Proxy data between the accepted connection and the stream
+	wrapped := sess.compress(s.shaper.Shape(tunnel.Until(stream.GetDieCh()), stream, sess.bandwidth, service))
+	if err := tunnel.Pipe(metrics.Count(sess.count(wrapped), service), conn, s.current().timeouts); err != nil {
+		log.Warn("proxy error", "error", err)
+	}
+}
@@ -0,0 +1,50 @@
+package natts
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func TestReverseRejectCode(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name     string
+		addr     string
+		wantCode tunnel.RejectCode
+	}{
+		{"not allowed", "127.0.0.2:2222", tunnel.RejectNotAllowed},
+		{"in use", busy.Addr().String(), tunnel.RejectInUse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Config{SSHTarget: "127.0.0.1:22", ReverseListen: []string{"127.0.0.1:*"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newPipeSession(t, s)
+			client, server := p.stream(t)
+			go func() {
+				if _, err := tunnel.ReadOpenRequest(server); err == nil {
+					s.serveReverse(p.sess, p.sess.log, server, tt.addr)
+				}
+			}()
+
+			err = tunnel.Open(client, tunnel.OpenRequest{Version: tunnel.ProtocolVersion, Listen: tt.addr})
+			var rerr *tunnel.RejectedError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("reverse forward to %s was not rejected: %v", tt.addr, err)
+			}
+			if rerr.Code != tt.wantCode {
+				t.Errorf("rejected with code %q, want %q", rerr.Code, tt.wantCode)
+			}
+		})
+	}
+}
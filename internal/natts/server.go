@@ -2,81 +2,210 @@ package natts
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Hogeyama/ddns-updater/internal/dns"
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
 	"github.com/Hogeyama/ddns-updater/internal/stun"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
 	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
 )
 
+// Loggers of the subsystems natts logs for
+var (
+	mainLog   = logging.For(logging.Main)
+	tunnelLog = logging.For(logging.Tunnel)
+	stunLog   = logging.For(logging.STUN)
+	dnsLog    = logging.For(logging.DNS)
+)
+
+// drainPollInterval is how often Shutdown checks whether connections have finished
+const drainPollInterval = time.Second
+
+// errShuttingDown is sent to clients that connect while natts shuts down
+var errShuttingDown = errors.New("natts is shutting down")
+
+// errListenerClosed is returned for UDP flows requested while the listener is closed
+var errListenerClosed = errors.New("natts is not listening")
+
+// ErrUnknownSession is returned by KillSession for IDs of sessions that are not open
+var ErrUnknownSession = errors.New("no such session")
+
 type Server struct {
-	cfToken    string
-	sshTarget  string
 	targetFQDN string
-	listener   *kcp.Listener
+	kcpOptions tunnel.KCPOptions
+	// listenerMutex serializes starting, restarting and closing the listener
+	listenerMutex sync.Mutex
+	listener      *kcp.Listener
+	// udpConn is the socket shared by the KCP listener and UDP flows
+	udpConn *tunnel.DatagramConn
+	// fec adapts the parity sent to each client, if adaptive FEC is on
+	fec *tunnel.AdaptiveFEC
+
+	// Settings that Reload replaces
+	policyMutex sync.RWMutex
+	policy      *policy
+
+	// UDP flows by flow ID
+	flowMutex sync.Mutex
+	flows     map[uint32]*udpFlow
+
+	// Resumable streams by token
+	resumeMutex sync.Mutex
+	resumable   map[string]*resumableStream
+
+	// Open client sessions by ID, closed when natts stops
+	sessionMutex  sync.Mutex
+	sessions      map[uint64]*session
+	lastSessionID uint64
+	// draining refuses new sessions and connections while natts shuts down
+	draining atomic.Bool
 
 	// Connection tracking
-	connMutex         sync.RWMutex
-	activeConns       int
-	lastConnTime      time.Time
-	localPort         int
-	acceptLoopCtx     context.Context
-	acceptLoopCancel  context.CancelFunc
+	connMutex        sync.RWMutex
+	activeConns      int
+	lastConnTime     time.Time
+	rediscoverAfter  time.Duration
+	localPort        int
+	acceptLoopCtx    context.Context
+	acceptLoopCancel context.CancelFunc
+
+	// Results of discovery and registration reported by Status
+	statusMutex sync.Mutex
+	status      status
+
+	// audit records every session once it ends
+	audit auditLog
+	// limiter enforces the session limits and bans of the policy
+	limiter *limiter
+	// shaper caps the bandwidth natts sends to clients
+	shaper *tunnel.Shaper
+
+	// adminListener serves the admin API, if it was started
+	adminListener net.Listener
+	// drainRequested is closed when Drain is called
+	drainRequested chan struct{}
+	drainOnce      sync.Once
 }
 
 type Config struct {
+	// SSHTarget is registered as the default "ssh" service unless Services overrides it
 	SSHTarget  string
 	TargetFQDN string
 	CFToken    string
+	// Updater publishes the records of TargetFQDN (default Cloudflare with CFToken)
+	Updater dns.Updater
+	// Services maps service names to the TCP addresses natts forwards them to
+	Services map[string]string
+	// Egress lists the destinations clients may dial by address, e.g. through SOCKS.
+	// Without rules only the addresses of configured services are reachable.
+	Egress []EgressRule
+	// ReverseListen lists the addresses clients may ask natts to listen on for
+	// reverse forwards. A port of "*" permits any port on that host.
+	ReverseListen []string
+	// UDPIdleTimeout closes UDP flows without traffic in either direction (default 2 minutes)
+	UDPIdleTimeout time.Duration
+	// Timeouts controls keepalives and how long proxied connections may live
+	Timeouts tunnel.Timeouts
+	// STUNServers are asked in order for the external address (default stun.DefaultServers)
+	STUNServers []string
+	// KCP tunes the KCP sessions; nattc must use the same FEC settings
+	KCP tunnel.KCPOptions
+	// AuthorizedKeys, if set, are the keys clients must authenticate with
+	AuthorizedKeys []tunnel.Key
+	// MarkOfflineOnShutdown replaces the published port with an offline marker
+	// in Shutdown, so that clients fail fast until natts is back
+	MarkOfflineOnShutdown bool
+	// AuditLog, if set, is the file every session is appended to as a JSON line once it ends
+	AuditLog string
+	// Limits caps the sessions natts accepts and bans peers that keep failing to authenticate
+	Limits Limits
+	// Bandwidth caps the bytes per second natts sends to clients
+	Bandwidth tunnel.BandwidthLimits
+	// Sources restricts the addresses sessions are accepted from
+	Sources SourceRules
+	// Bench serves the streams nattc bench measures the tunnel with
+	Bench bool
+	// RediscoverAfter runs STUN discovery and DNS registration again once natts
+	// has had no connections for this long (default 5 minutes)
+	RediscoverAfter time.Duration
 }
 
 func New(cfg Config) (*Server, error) {
-	return &Server{
-		cfToken:      cfg.CFToken,
-		sshTarget:    cfg.SSHTarget,
-		targetFQDN:   cfg.TargetFQDN,
-		lastConnTime: time.Now(),
-	}, nil
+	p, err := newPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rediscoverAfter := cfg.RediscoverAfter
+	if rediscoverAfter <= 0 {
+		rediscoverAfter = 5 * time.Minute
+	}
+
+	s := &Server{
+		targetFQDN:      cfg.TargetFQDN,
+		kcpOptions:      cfg.KCP,
+		fec:             cfg.KCP.NewAdaptiveFEC(),
+		policy:          p,
+		flows:           make(map[uint32]*udpFlow),
+		resumable:       make(map[string]*resumableStream),
+		sessions:        make(map[uint64]*session),
+		limiter:         newLimiter(),
+		shaper:          tunnel.NewShaper(cfg.Bandwidth),
+		lastConnTime:    time.Now(),
+		rediscoverAfter: rediscoverAfter,
+		status:          status{listener: ListenerStatus{State: ListenerStarting}},
+
+		drainRequested: make(chan struct{}),
+	}
+	if err := s.audit.open(cfg.AuditLog); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *Server) Start(ctx context.Context, listenAddr string) error {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+
 	// Parse listen address to get desired port
 	var localPort int
 	if listenAddr == ":0" {
 		// For port 0, we need to discover first, then bind to that port
-		externalIP, externalPort, err := stun.GetIPv4AndAvailablePort()
+		p := s.current()
+		externalIP, externalPort, err := stun.GetIPv4AndAvailablePort(p.stunServers)
+		s.recordDiscovery(externalIP, externalPort, err)
 		if err != nil {
 			return fmt.Errorf("failed to discover external IP and port: %w", err)
 		}
-		log.Printf("natts: discovered external IP %s, port %d", externalIP, externalPort)
-		
+		stunLog.Info("discovered external address", "ip", externalIP, "port", externalPort)
+		s.detectNAT(p, externalPort)
+
 		// Update DNS records first
-		dnsCtx := context.Background()
-		if err := dns.UpdateRecords(dnsCtx, s.cfToken, s.targetFQDN, externalIP, externalPort); err != nil {
-			return fmt.Errorf("failed to update DNS records: %w", err)
+		if err := s.register(p, externalIP, externalPort); err != nil {
+			return err
 		}
-		log.Printf("natts: DNS records updated for %s", s.targetFQDN)
-		
+
 		// Use the discovered port for KCP listener
 		listenAddr = fmt.Sprintf(":%d", externalPort)
 		localPort = externalPort
 	} else {
-		// Parse specific port from listenAddr
-		_, portStr, err := net.SplitHostPort("localhost" + listenAddr)
+		port, err := listenPort(listenAddr)
 		if err != nil {
-			return fmt.Errorf("failed to parse listen address: %w", err)
-		}
-		port, err := net.LookupPort("udp", portStr)
-		if err != nil {
-			return fmt.Errorf("failed to parse port: %w", err)
+			return err
 		}
 		localPort = port
-		
+
 		// Discover external IP and port via STUN using the specified port
 		if err := s.discoverAndRegister(localPort); err != nil {
 			return fmt.Errorf("failed to discover and register: %w", err)
@@ -86,14 +215,12 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 	s.localPort = localPort
 
 	// Start KCP listener on the determined port
-	listener, err := kcp.ListenWithOptions(listenAddr, nil, 10, 3)
-	if err != nil {
+	if err := s.listen(listenAddr); err != nil {
 		return fmt.Errorf("failed to start KCP listener: %w", err)
 	}
-	s.listener = listener
 
-	actualAddr := listener.Addr().(*net.UDPAddr)
-	log.Printf("natts: KCP listener started on %s (actual port: %d)", listenAddr, actualAddr.Port)
+	actualAddr := s.listener.Addr().(*net.UDPAddr)
+	tunnelLog.Info("KCP listener started", "address", listenAddr, "port", actualAddr.Port)
 
 	// Start connection monitoring
 	go s.connectionMonitor(ctx)
@@ -104,36 +231,124 @@ func (s *Server) Start(ctx context.Context, listenAddr string) error {
 	return nil
 }
 
+// listenPort parses the port of listenAddr
+func listenPort(listenAddr string) (int, error) {
+	_, portStr, err := net.SplitHostPort("localhost" + listenAddr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse listen address: %w", err)
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse port: %w", err)
+	}
+	return port, nil
+}
+
+// listen opens the UDP socket on listenAddr and serves KCP and UDP flows on it
+func (s *Server) listen(listenAddr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		s.setListener(ListenerFailed, "", err)
+		return err
+	}
+
+	udpConn := tunnel.NewDatagramConn(conn, s.handleDatagram)
+	if s.fec != nil {
+		udpConn.SetAdaptiveFEC(s.fec)
+	}
+	listener, err := kcp.ServeConn(nil, s.kcpOptions.DataShards, s.kcpOptions.ParityShards, udpConn)
+	if err != nil {
+		conn.Close()
+		s.setListener(ListenerFailed, "", err)
+		return err
+	}
+	if s.kcpOptions.DSCP > 0 {
+		if err := listener.SetDSCP(s.kcpOptions.DSCP); err != nil {
+			tunnelLog.Warn("failed to set DSCP", "dscp", s.kcpOptions.DSCP, "error", err)
+		}
+	}
+
+	s.udpConn = udpConn
+	s.listener = listener
+	s.setListener(ListenerListening, conn.LocalAddr().String(), nil)
+	return nil
+}
+
+// closeListener closes the KCP listener and the UDP socket it is served on
+func (s *Server) closeListener() error {
+	if s.listener == nil {
+		return nil
+	}
+	s.closeFlows()
+	s.listener.Close()
+	err := s.udpConn.Close()
+	s.listener = nil
+	s.udpConn = nil
+	s.setListener(ListenerStopped, "", nil)
+	return err
+}
+
 func (s *Server) discoverAndRegister(localPort int) error {
 	// Discover external IP and port via STUN using the same port as KCP listener
-	externalIP, externalPort, err := stun.GetIPv4FromLocalPort(localPort)
+	p := s.current()
+	externalIP, externalPort, err := stun.GetIPv4FromLocalPort(localPort, p.stunServers)
+	s.recordDiscovery(externalIP, externalPort, err)
 	if err != nil {
 		return fmt.Errorf("failed to discover external IP and port: %w", err)
 	}
 
-	log.Printf("natts: discovered external IP %s, port %d (local port: %d)", externalIP, externalPort, localPort)
+	stunLog.Info("discovered external address", "ip", externalIP, "port", externalPort, "local_port", localPort)
+	s.detectNAT(p, localPort)
 
 	// Update DNS records
+	return s.register(p, externalIP, externalPort)
+}
+
+// register publishes the external address in DNS
+func (s *Server) register(p *policy, externalIP string, externalPort int) error {
 	ctx := context.Background()
-	if err := dns.UpdateRecords(ctx, s.cfToken, s.targetFQDN, externalIP, externalPort); err != nil {
+	err := dns.UpdateRecords(ctx, p.updater, s.targetFQDN, externalIP, externalPort)
+	s.recordRegistration(metrics.Endpoint(externalIP, externalPort), err)
+	if err != nil {
 		return fmt.Errorf("failed to update DNS records: %w", err)
 	}
 
-	log.Printf("natts: DNS records updated for %s", s.targetFQDN)
+	dnsLog.Info("DNS records updated", "fqdn", s.targetFQDN, "ip", externalIP, "port", externalPort)
 	return nil
 }
 
+// detectNAT finds out how the NAT maps localPort, which must not be in use yet.
+// It needs two STUN servers and is skipped with fewer.
+func (s *Server) detectNAT(p *policy, localPort int) {
+	if len(p.stunServers) < 2 {
+		return
+	}
+	natType, err := stun.DetectNAT(localPort, p.stunServers)
+	if err != nil {
+		stunLog.Warn("failed to detect NAT type", "error", err)
+	} else if natType == stun.NATSymmetric {
+		stunLog.Warn("symmetric NAT detected, clients will likely be unable to connect", "nat_type", natType)
+	} else {
+		stunLog.Info("detected NAT type", "nat_type", natType)
+	}
+	s.recordNATType(natType)
+}
+
 func (s *Server) startAcceptLoop() {
 	// Cancel any existing accept loop
 	if s.acceptLoopCancel != nil {
 		s.acceptLoopCancel()
 	}
-	
+
 	// Create new context for accept loop
 	s.acceptLoopCtx, s.acceptLoopCancel = context.WithCancel(context.Background())
-	
+
 	// Start accept loop
-	go s.acceptLoop(s.acceptLoopCtx)
+	go s.acceptLoop(s.acceptLoopCtx, s.listener)
 }
 
 func (s *Server) stopAcceptLoop() {
@@ -143,7 +358,7 @@ func (s *Server) stopAcceptLoop() {
 	}
 }
 
-func (s *Server) acceptLoop(ctx context.Context) {
+func (s *Server) acceptLoop(ctx context.Context, listener *kcp.Listener) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -151,23 +366,37 @@ func (s *Server) acceptLoop(ctx context.Context) {
 		default:
 		}
 
-		// Check if listener is available
-		if s.listener == nil {
-			return
-		}
-
-		conn, err := s.listener.AcceptKCP()
+		conn, err := listener.AcceptKCP()
 		if err != nil {
 			// If listener is closed, exit gracefully
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				log.Printf("natts: failed to accept connection: %v", err)
+				tunnelLog.Error("failed to accept connection", "error", err)
 				return
 			}
 		}
 
+		// Refuse sessions from disallowed sources or over the limits before
+		// spending a goroutine on them
+		ip := peerIP(conn.RemoteAddr())
+		p := s.current()
+		if reason, country := p.sources.check(ip); reason != "" {
+			// Every KCP conversation of a refused peer ends up here, so the
+			// metric counts them and the log only shows them at debug level
+			tunnelLog.Debug("refused session from disallowed source", "peer", conn.RemoteAddr().String(), "country", country, "reason", reason)
+			metrics.SessionsRejected.WithLabelValues(reason).Inc()
+			conn.Close()
+			continue
+		}
+		if reason, ok := s.limiter.admit(ip, p.limits); !ok {
+			tunnelLog.Debug("refused session", "peer", conn.RemoteAddr().String(), "reason", reason)
+			metrics.SessionsRejected.WithLabelValues(reason).Inc()
+			conn.Close()
+			continue
+		}
+
 		go s.handleConnection(conn)
 	}
 }
@@ -175,10 +404,93 @@ func (s *Server) acceptLoop(ctx context.Context) {
 func (s *Server) handleConnection(kcpConn *kcp.UDPSession) {
 	defer kcpConn.Close()
 
-	log.Printf("natts: new connection from %s", kcpConn.RemoteAddr())
+	ip := peerIP(kcpConn.RemoteAddr())
+	defer s.limiter.release(ip)
+
+	s.kcpOptions.Apply(kcpConn)
+
+	// Every stream multiplexed over the session is one proxied connection.
+	// Keepalive frames close the session once the peer stops responding.
+	conn := newActivityConn(kcpConn)
+	muxConfig := tunnel.MuxConfig(s.current().timeouts)
+	mux, err := smux.Server(conn, muxConfig)
+	if err != nil {
+		tunnelLog.Error("failed to start session", "peer", kcpConn.RemoteAddr().String(), "error", err)
+		return
+	}
+	defer mux.Close()
+
+	sess := s.addSession(mux, kcpConn.RemoteAddr())
+	sess.conn, sess.keepAliveTimeout = conn, muxConfig.KeepAliveTimeout
+	sess.log.Info("new session")
+
+	agreement, err := s.handshake(mux)
+	if err != nil {
+		sess.log.Warn("handshake failed", "error", err)
+		s.endSession(sess, fmt.Errorf("handshake failed: %w", err))
+		if !errors.Is(err, errShuttingDown) {
+			metrics.HandshakeFailures.Inc()
+		}
+		if errors.Is(err, tunnel.ErrAuthFailed) {
+			metrics.AuthFailures.Inc()
+			if limits := s.current().limits; s.limiter.authFailed(ip, limits) {
+				sess.log.Warn("banned peer after repeated authentication failures", "ip", ip.String(), "duration", limits.BanDuration)
+				metrics.Bans.Inc()
+			}
+		}
+		return
+	}
+	if agreement.KeyID != "" {
+		sess.log.Info("session authenticated", "key", agreement.KeyID)
+		s.authenticated(sess, agreement.KeyID)
+	}
+	sess.adaptiveFEC = agreement.AdaptiveFEC
+	sess.compression = agreement.Compression
+	if agreement.Compression != "" {
+		sess.log.Info("compressing streams", "algorithm", agreement.Compression)
+	}
+
+	metrics.SessionsTotal.Inc()
+	metrics.SessionsActive.Inc()
+	defer metrics.SessionsActive.Dec()
+	go metrics.WatchKCP(kcpConn, mux.CloseChan())
+
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			s.endSession(sess, err)
+			return
+		}
+
+		go s.handleStream(sess, stream)
+	}
+}
+
+// handshake authenticates the client on the first stream of a session and
+// returns what was agreed with it
+func (s *Server) handshake(mux *smux.Session) (tunnel.Agreement, error) {
+	deadline := time.Now().Add(tunnel.HandshakeTimeout)
+	mux.SetDeadline(deadline)
+	stream, err := mux.AcceptStream()
+	mux.SetDeadline(time.Time{})
+	if err != nil {
+		return tunnel.Agreement{}, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(deadline)
+	if s.draining.Load() {
+		tunnel.RejectHandshake(stream, errShuttingDown)
+		return tunnel.Agreement{}, errShuttingDown
+	}
+	return tunnel.AcceptHandshake(stream, s.current().authorizedKeys, s.kcpOptions.FEC(), s.kcpOptions.CompressionOffer())
+}
 
-	// Configure KCP session timeout
-	kcpConn.SetDeadline(time.Now().Add(5 * time.Minute))
+// trackConnection records the start of a proxied connection of sess and
+// returns a function that records its end
+func (s *Server) trackConnection(sess *session, log *slog.Logger) func() {
+	sess.conns.Add(1)
+	sess.connsTotal.Add(1)
 
 	// Track connection start
 	s.connMutex.Lock()
@@ -186,50 +498,158 @@ func (s *Server) handleConnection(kcpConn *kcp.UDPSession) {
 	connCount := s.activeConns
 	s.connMutex.Unlock()
 
-	log.Printf("natts: active connections: %d", connCount)
+	log.Debug("connection opened", "active_connections", connCount)
 
 	// Track connection end
-	defer func() {
+	return func() {
 		s.connMutex.Lock()
 		s.activeConns--
 		s.lastConnTime = time.Now()
 		connCount := s.activeConns
 		s.connMutex.Unlock()
-		log.Printf("natts: connection closed, active connections: %d", connCount)
-	}()
+		sess.conns.Add(-1)
+		log.Info("connection closed", "active_connections", connCount)
+	}
+}
 
-	// Connect to local SSH server
-	sshConn, err := net.DialTimeout("tcp", s.sshTarget, 10*time.Second)
+func (s *Server) handleStream(sess *session, stream *smux.Stream) {
+	defer stream.Close()
+
+	// Read the stream header to find out where to connect to
+	req, err := tunnel.ReadOpenRequest(stream)
 	if err != nil {
-		log.Printf("natts: failed to connect to SSH server: %v", err)
+		sess.log.Warn("failed to read stream header", "error", err)
+		return
+	}
+	log := sess.log.With("service", req.Target())
+	if req.Control {
+		s.serveControl(sess, log, stream)
 		return
 	}
-	defer sshConn.Close()
+	if req.Echo {
+		s.serveEcho(sess, log, stream)
+		return
+	}
+	if req.Resume == "" {
+		s.useService(sess, req.Target())
+	}
 
-	log.Printf("natts: connected to SSH server %s", s.sshTarget)
+	// Resumed streams continue a connection that is already tracked
+	if req.Resume != "" {
+		s.resumeStream(sess, log, stream, req)
+		return
+	}
 
-	// Proxy data between KCP and SSH connections
-	done := make(chan error, 2)
+	if s.draining.Load() {
+		tunnel.Reject(stream, errShuttingDown)
+		return
+	}
+
+	// Control streams for reverse forwards are not proxied connections themselves
+	if req.Listen != "" {
+		s.serveReverse(sess, log, stream, req.Listen)
+		return
+	}
+
+	if req.UDP {
+		s.serveFlow(sess, log, stream, req)
+		return
+	}
 
-	go func() {
-		_, err := io.Copy(sshConn, kcpConn)
-		done <- err
-	}()
+	if req.Bench {
+		s.serveBench(sess, log, stream)
+		return
+	}
+
+	defer s.trackConnection(sess, log)()
+
+	p := s.current()
+	target, err := p.resolveTarget(req)
+	if err != nil {
+		log.Warn("rejected connection", "error", err)
+		tunnel.RejectWith(stream, rejectCode(err), err)
+		return
+	}
 
-	go func() {
-		_, err := io.Copy(kcpConn, sshConn)
-		done <- err
-	}()
+	// Only requests for a configured service are counted, so that made-up
+	// service names cannot add label values
+	service := metrics.Service(*req)
+	defer metrics.Connection(service)()
 
-	// Wait for either direction to complete
-	err = <-done
+	// Connect to the requested backend
+	backendConn, err := net.DialTimeout("tcp", target, 10*time.Second)
 	if err != nil {
-		log.Printf("natts: proxy error: %v", err)
+		log.Warn("failed to connect to backend", "backend", target, "error", err)
+		tunnel.RejectWith(stream, rejectCode(err), fmt.Errorf("%s is unavailable", req.Target()))
+		return
+	}
+	defer backendConn.Close()
+
+	// A resumable stream keeps the backend connection open while nattc reconnects
+	var conn io.ReadWriter = stream
+	done := stream.GetDieCh()
+	if req.Resumable && p.timeouts.ResumeTimeout > 0 {
+		rc, token := s.registerResumable(sess, stream, p.timeouts.ResumeTimeout, log)
+		defer s.unregisterResumable(token)
+		defer rc.Close()
+
+		if err := tunnel.AcceptResumable(stream, token); err != nil {
+			log.Warn("failed to send stream response", "error", err)
+			return
+		}
+		conn, done = rc, rc.Done()
+	} else if err := tunnel.Accept(stream); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	log.Info("connected to backend", "backend", target)
+
+	// Proxy data between the stream and the backend connection
+	// Resumed streams keep the compression of the session they were opened on
+	conn = sess.compress(s.shaper.Shape(tunnel.Until(done), conn, sess.bandwidth, service))
+	if err := tunnel.Pipe(metrics.Count(sess.count(conn), service), backendConn, p.timeouts); err != nil {
+		log.Warn("proxy error", "error", err)
+	}
+}
+
+// resolveTarget maps a stream header to the TCP address to dial.
+// Raw addresses are only accepted if they belong to a configured service
+// or are permitted by the egress rules.
+func (p *policy) resolveTarget(req *tunnel.OpenRequest) (string, error) {
+	if req.Address == "" {
+		target, ok := p.services[req.Service]
+		if !ok {
+			return "", fmt.Errorf("unknown service %q", req.Service)
+		}
+		return target, nil
+	}
+
+	for _, addr := range p.services {
+		if addr == req.Address {
+			return addr, nil
+		}
+	}
+	return p.resolveEgress(req.Address)
+}
+
+// rejectCode tells nattc whether the target of a stream was refused by the
+// policy, could not be resolved or reached, or refused the connection itself
+func rejectCode(err error) tunnel.RejectCode {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return tunnel.RejectRefused
+	case errors.As(err, &dnsErr), errors.As(err, &opErr):
+		return tunnel.RejectUnreachable
+	default:
+		return tunnel.RejectNotAllowed
 	}
 }
 
 func (s *Server) connectionMonitor(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
+	ticker := time.NewTicker(s.rediscoverAfter / 10) // Check every 30 seconds by default
 	defer ticker.Stop()
 
 	for {
@@ -242,56 +662,201 @@ func (s *Server) connectionMonitor(ctx context.Context) {
 			lastConnTime := s.lastConnTime
 			s.connMutex.RUnlock()
 
-			// If no active connections and it's been 5 minutes since last connection
-			if activeConns == 0 && time.Since(lastConnTime) > 5*time.Minute {
-				log.Printf("natts: no connections for 5 minutes, restarting STUN discovery")
-
-				// Stop accept loop to prevent panic
-				s.stopAcceptLoop()
-
-				// Close current listener to free up the port
-				if s.listener != nil {
-					s.listener.Close()
-					s.listener = nil
-				}
-
-				// Restart STUN discovery and DNS registration
-				if err := s.discoverAndRegister(s.localPort); err != nil {
-					log.Printf("natts: failed to restart STUN discovery: %v", err)
-				} else {
-					log.Printf("natts: STUN discovery completed")
-				}
-
-				// Restart KCP listener on the same port
-				listenAddr := fmt.Sprintf(":%d", s.localPort)
-				listener, err := kcp.ListenWithOptions(listenAddr, nil, 10, 3)
-				if err != nil {
-					log.Printf("natts: failed to restart KCP listener: %v", err)
-				} else {
-					s.listener = listener
-					log.Printf("natts: KCP listener restarted on %s", listenAddr)
-					
-					// Restart accept loop
-					s.startAcceptLoop()
-				}
-
-				// Update last connection time to prevent immediate re-trigger
-				s.connMutex.Lock()
-				s.lastConnTime = time.Now()
-				s.connMutex.Unlock()
+			// If no active connections and it's been a while since last connection
+			if activeConns == 0 && !s.draining.Load() && time.Since(lastConnTime) > s.rediscoverAfter {
+				stunLog.Info("no connections, restarting STUN discovery", "idle", s.rediscoverAfter)
+				s.restart()
 			}
 		}
 	}
 }
 
-func (s *Server) Close() error {
-	// Stop accept loop first
+// restart closes the listener, runs STUN discovery and DNS registration again
+// on the same port and listens again. Sessions on the old listener break;
+// nattc resumes their connections on a new session.
+func (s *Server) restart() error {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+
+	if s.draining.Load() {
+		return errShuttingDown
+	}
+	if s.localPort == 0 {
+		return fmt.Errorf("natts has not started listening yet")
+	}
+
+	// Stop accept loop to prevent panic
 	s.stopAcceptLoop()
-	
-	// Then close listener
-	if s.listener != nil {
-		return s.listener.Close()
+
+	// Close current listener to free up the port. The sessions on it cannot
+	// send anymore; their resumable streams wait for nattc on the new one.
+	s.closeListener()
+	for _, sess := range s.openSessions() {
+		s.closeMux(sess, closeRestart)
+	}
+	s.setListener(ListenerRestarting, "", nil)
+
+	// Restart STUN discovery and DNS registration
+	discoverErr := s.discoverAndRegister(s.localPort)
+	if discoverErr != nil {
+		stunLog.Error("failed to restart STUN discovery", "error", discoverErr)
+	} else {
+		stunLog.Info("STUN discovery completed")
 	}
+
+	// Restart KCP listener on the same port
+	listenAddr := fmt.Sprintf(":%d", s.localPort)
+	listenErr := s.listen(listenAddr)
+	if listenErr != nil {
+		tunnelLog.Error("failed to restart KCP listener", "error", listenErr)
+		listenErr = fmt.Errorf("failed to restart KCP listener: %w", listenErr)
+	} else {
+		tunnelLog.Info("KCP listener restarted", "address", listenAddr)
+
+		// Restart accept loop
+		s.startAcceptLoop()
+	}
+
+	// Update last connection time to prevent immediate re-trigger
+	s.connMutex.Lock()
+	s.lastConnTime = time.Now()
+	s.connMutex.Unlock()
+
+	return errors.Join(discoverErr, listenErr)
+}
+
+// Drain refuses new sessions and connections and asks the owner of the
+// Server to shut it down, as if natts had received SIGTERM
+func (s *Server) Drain() {
+	s.draining.Store(true)
+	s.drainOnce.Do(func() {
+		mainLog.Info("drain requested")
+		close(s.drainRequested)
+	})
+}
+
+// DrainRequested is closed once Drain has been called
+func (s *Server) DrainRequested() <-chan struct{} {
+	return s.drainRequested
+}
+
+// Rediscover runs STUN discovery and updates DNS now instead of waiting for
+// natts to be idle. The listener is reopened, so active sessions break and
+// nattc resumes their connections.
+func (s *Server) Rediscover() error {
+	mainLog.Info("rediscovery requested")
+	return s.restart()
+}
+
+// KillSession closes the session with the given ID and all of its connections
+func (s *Server) KillSession(id uint64) error {
+	s.sessionMutex.Lock()
+	sess := s.sessions[id]
+	s.sessionMutex.Unlock()
+
+	if sess == nil {
+		return fmt.Errorf("%w: %d", ErrUnknownSession, id)
+	}
+
+	sess.log.Info("killing session")
+	return s.closeSession(sess, closeKilled)
+}
+
+// Bandwidth returns the bandwidth limits in effect
+func (s *Server) Bandwidth() tunnel.BandwidthLimits {
+	return s.shaper.Limits()
+}
+
+// SetBandwidth replaces the bandwidth limits, including for the connections
+// already running. The next Reload goes back to the configured limits.
+func (s *Server) SetBandwidth(limits tunnel.BandwidthLimits) error {
+	if limits.Global < 0 || limits.PerSession < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	for service, rate := range limits.Services {
+		if rate < 0 {
+			return fmt.Errorf("bandwidth limit of service %q must not be negative", service)
+		}
+	}
+	s.shaper.SetLimits(limits)
+	mainLog.Info("bandwidth limits changed", "global", limits.Global, "per_session", limits.PerSession, "services", len(limits.Services))
 	return nil
 }
 
+// Shutdown stops natts gracefully. New sessions and connections are refused,
+// the DNS record is marked offline if configured, and active connections get
+// until ctx is done to finish. Whatever is left then is closed by Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	p := s.current()
+	if p.markOffline {
+		err := dns.MarkOffline(ctx, p.updater, s.targetFQDN)
+		s.recordRegistration("offline", err)
+		if err != nil {
+			dnsLog.Error("failed to mark natts offline", "fqdn", s.targetFQDN, "error", err)
+		} else {
+			dnsLog.Info("marked natts offline in DNS", "fqdn", s.targetFQDN)
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	logged := -1
+	for {
+		s.connMutex.RLock()
+		activeConns := s.activeConns
+		s.connMutex.RUnlock()
+
+		if activeConns == 0 {
+			break
+		}
+		if activeConns != logged {
+			mainLog.Info("draining", "active_connections", activeConns)
+			logged = activeConns
+		}
+
+		select {
+		case <-ctx.Done():
+			mainLog.Warn("drain timed out, closing active connections", "active_connections", activeConns)
+			return errors.Join(ctx.Err(), s.Close())
+		case <-ticker.C:
+		}
+	}
+
+	return s.Close()
+}
+
+// Close stops natts immediately, closing every session and connection
+func (s *Server) Close() error {
+	s.draining.Store(true)
+
+	// Stop accept loop first
+	s.stopAcceptLoop()
+
+	sessions := s.openSessions()
+	for _, sess := range sessions {
+		s.closeSession(sess, closeShutdown)
+	}
+	// Wait for the audit records of the closed sessions
+	for _, sess := range sessions {
+		<-sess.ended
+	}
+
+	// Streams waiting to be resumed are no longer tied to a session
+	s.resumeMutex.Lock()
+	for _, rs := range s.resumable {
+		rs.conn.Close()
+	}
+	s.resumeMutex.Unlock()
+
+	if s.adminListener != nil {
+		s.adminListener.Close()
+	}
+
+	// Then close listener
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	return s.closeListener()
+}
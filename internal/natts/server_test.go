@@ -0,0 +1,36 @@
+package natts
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+)
+
+func TestUnknownServiceIsNotCounted(t *testing.T) {
+	tests := []struct {
+		name string
+		req  tunnel.OpenRequest
+	}{
+		{"TCP", tunnel.OpenRequest{Service: "made-up-tcp"}},
+		{"UDP", tunnel.OpenRequest{Service: "made-up-udp", UDP: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			p := newPipeSession(t, s)
+			client, server := p.stream(t)
+			go s.handleStream(p.sess, server)
+
+			tt.req.Version = tunnel.ProtocolVersion
+			var rerr *tunnel.RejectedError
+			if err := tunnel.Open(client, tt.req); !errors.As(err, &rerr) {
+				t.Fatalf("stream for an unknown service not rejected: %v", err)
+			}
+			if metrics.ConnectionsTotal.DeleteLabelValues(tt.req.Service) {
+				t.Errorf("connection to the unknown service %q counted", tt.req.Service)
+			}
+		})
+	}
+}
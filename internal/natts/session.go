@@ -0,0 +1,211 @@
+package natts
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// session is a client's KCP connection to natts and the streams multiplexed over it
+type session struct {
+	id      uint64
+	mux     *smux.Session
+	peer    net.Addr
+	started time.Time
+	// identity is the ID of the key the client authenticated with, guarded by Server.sessionMutex
+	identity string
+	// services are the targets of the streams opened so far, guarded by Server.sessionMutex
+	services []string
+	// closeReason explains why natts closed the session, guarded by Server.sessionMutex
+	closeReason string
+	// conn is the KCP session of the client, which tells when the client was last heard from
+	conn *activityConn
+	// keepAliveTimeout is how long smux waits for the client before closing the session
+	keepAliveTimeout time.Duration
+	// log records the session ID and peer on every line about the session
+	log *slog.Logger
+	// bandwidth limits the connections of the session together
+	bandwidth *tunnel.SessionBucket
+	// adaptiveFEC is set if the client agreed to adapt FEC in the handshake
+	adaptiveFEC bool
+	// compression is the algorithm agreed for the streams of the session, if any
+	compression string
+	// benchStreams counts the bench streams running, up to maxBenchStreams
+	benchStreams atomic.Int32
+
+	// Totals over every connection of the session
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	conns    atomic.Int64
+	// connsTotal counts every connection, including those that have ended
+	connsTotal atomic.Int64
+
+	// ended is closed once the audit record of the session is written
+	ended chan struct{}
+}
+
+// addSession registers a new session so that it shows up in the status and is closed by Close
+func (s *Server) addSession(mux *smux.Session, peer net.Addr) *session {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	s.lastSessionID++
+	sess := &session{id: s.lastSessionID, mux: mux, peer: peer, started: time.Now(), ended: make(chan struct{})}
+	sess.log = tunnelLog.With("session", sess.id, "peer", peer.String())
+	sess.bandwidth = s.shaper.NewSession()
+	s.sessions[sess.id] = sess
+	return sess
+}
+
+// openSessions returns the sessions that are open
+func (s *Server) openSessions() []*session {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// endSession removes sess once its mux is closed by err and writes its audit record
+func (s *Server) endSession(sess *session, err error) {
+	end := time.Now()
+
+	s.shaper.ReleaseSession(sess.bandwidth)
+
+	s.sessionMutex.Lock()
+	delete(s.sessions, sess.id)
+	rec := AuditRecord{
+		Session:     sess.id,
+		Identity:    sess.identity,
+		Peer:        sess.peer.String(),
+		Services:    append([]string{}, sess.services...),
+		Start:       sess.started,
+		End:         end,
+		Duration:    end.Sub(sess.started).Round(time.Second).String(),
+		BytesIn:     sess.bytesIn.Load(),
+		BytesOut:    sess.bytesOut.Load(),
+		Connections: sess.connsTotal.Load(),
+		CloseReason: sess.closeReason,
+	}
+	s.sessionMutex.Unlock()
+
+	if rec.CloseReason == "" {
+		rec.CloseReason = sess.endReason(err)
+	}
+
+	sess.log.Info("session closed", "reason", rec.CloseReason, "duration", end.Sub(sess.started).Round(time.Millisecond))
+	s.audit.write(rec)
+	close(sess.ended)
+}
+
+// endReason explains an end of sess that natts did not ask for. smux closes
+// the session itself once nothing, not even a keepalive, arrived for the
+// keepalive timeout; any other end is told by err.
+func (sess *session) endReason(err error) string {
+	if sess.conn != nil && sess.keepAliveTimeout > 0 && sess.conn.idle() >= sess.keepAliveTimeout {
+		return closeUnreachable
+	}
+	return err.Error()
+}
+
+// closeSession closes sess, recording reason for the audit log unless
+// another one was recorded first. Its resumable streams end with it rather
+// than being resumed on the next session of the client.
+func (s *Server) closeSession(sess *session, reason string) error {
+	err := s.closeMux(sess, reason)
+	s.closeResumable(sess)
+	return err
+}
+
+// closeMux closes the mux of sess, recording reason for the audit log unless
+// another one was recorded first
+func (s *Server) closeMux(sess *session, reason string) error {
+	s.sessionMutex.Lock()
+	if sess.closeReason == "" {
+		sess.closeReason = reason
+	}
+	s.sessionMutex.Unlock()
+	return sess.mux.Close()
+}
+
+// activityConn is the KCP session of a client, recording when data last
+// arrived from it
+type activityConn struct {
+	*kcp.UDPSession
+	lastRead atomic.Int64
+}
+
+func newActivityConn(conn *kcp.UDPSession) *activityConn {
+	c := &activityConn{UDPSession: conn}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.UDPSession.Read(p)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns how long ago data last arrived
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastRead.Load()))
+}
+
+// useService records that the client of sess opened a stream to target
+func (s *Server) useService(sess *session, target string) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if !slices.Contains(sess.services, target) {
+		sess.services = append(sess.services, target)
+	}
+}
+
+// authenticated records the key the client of sess proved it holds
+func (s *Server) authenticated(sess *session, identity string) {
+	s.sessionMutex.Lock()
+	sess.identity = identity
+	s.sessionMutex.Unlock()
+}
+
+// compress wraps the stream side of a connection in the compression agreed for sess
+func (sess *session) compress(rw io.ReadWriter) io.ReadWriter {
+	if sess.compression == "" {
+		return rw
+	}
+	return tunnel.Compress(rw, sess.compression, metrics.Compressed(sess.compression))
+}
+
+// count wraps the stream side of a connection so that its bytes add to the session totals
+func (sess *session) count(rw io.ReadWriter) io.ReadWriter {
+	return &sessionCounter{rw: rw, sess: sess}
+}
+
+type sessionCounter struct {
+	rw   io.ReadWriter
+	sess *session
+}
+
+func (c *sessionCounter) Read(p []byte) (int, error) {
+	n, err := c.rw.Read(p)
+	c.sess.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *sessionCounter) Write(p []byte) (int, error) {
+	n, err := c.rw.Write(p)
+	c.sess.bytesOut.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,62 @@
+package natts
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEndReason(t *testing.T) {
+	const keepAliveTimeout = 30 * time.Second
+	tests := []struct {
+		name string
+		// idle is how long ago the client was last heard from
+		idle time.Duration
+		err  error
+		want string
+	}{
+		{"keepalive timeout", keepAliveTimeout + time.Second, io.ErrClosedPipe, closeUnreachable},
+		{"closed while the client was active", time.Second, io.ErrClosedPipe, io.ErrClosedPipe.Error()},
+		{"socket error", time.Second, errors.New("read udp: use of closed network connection"), "read udp: use of closed network connection"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &activityConn{}
+			conn.lastRead.Store(time.Now().Add(-tt.idle).UnixNano())
+			sess := &session{conn: conn, keepAliveTimeout: keepAliveTimeout}
+			if got := sess.endReason(tt.err); got != tt.want {
+				t.Errorf("endReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloseReasonIsKeptFromNatts(t *testing.T) {
+	s := testServer(t)
+	p := newPipeSession(t, s)
+	s.closeMux(p.sess, closeRestart)
+	// A later close does not overwrite why natts closed the session first
+	s.closeSession(p.sess, closeShutdown)
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := s.audit.open(path); err != nil {
+		t.Fatal(err)
+	}
+	s.endSession(p.sess, io.ErrClosedPipe)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("invalid audit record %q: %v", data, err)
+	}
+	if rec.CloseReason != closeRestart {
+		t.Errorf("close reason %q, want %q", rec.CloseReason, closeRestart)
+	}
+}
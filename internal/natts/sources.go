@@ -0,0 +1,143 @@
+package natts
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// SourceRules restrict the addresses natts accepts sessions from. Deny rules
+// win over allow rules; without allow rules every source that is not denied
+// is accepted.
+type SourceRules struct {
+	// Allow and Deny list the networks of peers by their source address
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+	// GeoIPDatabase is a MaxMind or DB-IP country database (MMDB) to look up
+	// the countries of AllowCountries and DenyCountries in
+	GeoIPDatabase string
+	// AllowCountries and DenyCountries are ISO 3166-1 alpha-2 codes such as "JP".
+	// A peer allowed by network or by country is accepted.
+	AllowCountries []string
+	DenyCountries  []string
+}
+
+// Reasons a session is refused for its source, also used as metric labels
+const (
+	rejectSourceDenied     = "source_denied"
+	rejectCountryDenied    = "country_denied"
+	rejectSourceNotAllowed = "source_not_allowed"
+)
+
+// sourceFilter checks peers against SourceRules
+type sourceFilter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	allowCountries []string
+	denyCountries  []string
+	geoip          *maxminddb.Reader
+}
+
+func newSourceFilter(rules SourceRules) (*sourceFilter, error) {
+	f := &sourceFilter{
+		allow:          unmapPrefixes(rules.Allow),
+		deny:           unmapPrefixes(rules.Deny),
+		allowCountries: upper(rules.AllowCountries),
+		denyCountries:  upper(rules.DenyCountries),
+	}
+
+	countries := len(f.allowCountries) > 0 || len(f.denyCountries) > 0
+	if countries && rules.GeoIPDatabase == "" {
+		return nil, fmt.Errorf("country rules need a GeoIP database")
+	}
+	if rules.GeoIPDatabase != "" {
+		// The database is read into memory rather than mapped, so that a
+		// reload can replace it while older policies are still in use
+		data, err := os.ReadFile(rules.GeoIPDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+		}
+		f.geoip, err = maxminddb.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP database %s: %w", rules.GeoIPDatabase, err)
+		}
+	}
+	return f, nil
+}
+
+// unmapPrefixes turns IPv4-in-IPv6 networks into IPv4 ones, as peer IPs are compared unmapped
+func unmapPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+func upper(codes []string) []string {
+	out := make([]string, 0, len(codes))
+	for _, code := range codes {
+		out = append(out, strings.ToUpper(code))
+	}
+	return out
+}
+
+// check returns why a session from ip is refused, or "" if it is accepted,
+// along with the country of ip if it was looked up
+func (f *sourceFilter) check(ip netip.Addr) (reason, country string) {
+	if containsAddr(f.deny, ip) {
+		return rejectSourceDenied, ""
+	}
+
+	if len(f.allowCountries) > 0 || len(f.denyCountries) > 0 {
+		country = f.country(ip)
+		if slices.Contains(f.denyCountries, country) {
+			return rejectCountryDenied, country
+		}
+	}
+
+	if len(f.allow) == 0 && len(f.allowCountries) == 0 {
+		return "", country
+	}
+	if containsAddr(f.allow, ip) || (country != "" && slices.Contains(f.allowCountries, country)) {
+		return "", country
+	}
+	return rejectSourceNotAllowed, country
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// country looks up the ISO code of ip, or "" for addresses the database does
+// not know, such as private ones
+func (f *sourceFilter) country(ip netip.Addr) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := f.geoip.Lookup(ip.AsSlice(), &record); err != nil {
+		mainLog.Debug("GeoIP lookup failed", "ip", ip.String(), "error", err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
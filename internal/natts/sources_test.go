@@ -0,0 +1,55 @@
+package natts
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSourceFilterCheck(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		out := make([]netip.Prefix, len(s))
+		for i, p := range s {
+			out[i] = netip.MustParsePrefix(p)
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		rules SourceRules
+		ip    string
+		want  string
+	}{
+		{"no rules", SourceRules{}, "198.51.100.1", ""},
+		{"denied", SourceRules{Deny: prefixes("198.51.100.0/24")}, "198.51.100.1", rejectSourceDenied},
+		{"not denied", SourceRules{Deny: prefixes("198.51.100.0/24")}, "203.0.113.1", ""},
+		{"allowed", SourceRules{Allow: prefixes("203.0.113.0/24")}, "203.0.113.1", ""},
+		{"not allowed", SourceRules{Allow: prefixes("203.0.113.0/24")}, "198.51.100.1", rejectSourceNotAllowed},
+		{
+			"deny wins",
+			SourceRules{Allow: prefixes("203.0.113.0/24"), Deny: prefixes("203.0.113.128/25")},
+			"203.0.113.200",
+			rejectSourceDenied,
+		},
+		{"IPv6 allowed", SourceRules{Allow: prefixes("2001:db8:1::/48")}, "2001:db8:1::1", ""},
+		{"IPv6 not allowed", SourceRules{Allow: prefixes("2001:db8:1::/48")}, "2001:db8:2::1", rejectSourceNotAllowed},
+		// Peers are compared unmapped, so a rule written for IPv4-in-IPv6 applies to IPv4
+		{"mapped rule", SourceRules{Deny: prefixes("::ffff:198.51.100.0/120")}, "198.51.100.1", rejectSourceDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newSourceFilter(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason, _ := f.check(netip.MustParseAddr(tt.ip)); reason != tt.want {
+				t.Errorf("check(%s) = %q, want %q", tt.ip, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceFilterNeedsGeoIP(t *testing.T) {
+	if _, err := newSourceFilter(SourceRules{AllowCountries: []string{"JP"}}); err == nil {
+		t.Error("country rules accepted without a GeoIP database")
+	}
+}
@@ -0,0 +1,210 @@
+package natts
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/stun"
+)
+
+// Listener states reported in ListenerStatus
+const (
+	ListenerStarting   = "starting"
+	ListenerListening  = "listening"
+	ListenerRestarting = "restarting"
+	ListenerStopped    = "stopped"
+	ListenerFailed     = "failed"
+)
+
+// Status is the state of natts reported by the admin API
+type Status struct {
+	TargetFQDN string `json:"target_fqdn"`
+	// STUN is the result of the last STUN discovery, if there was one
+	STUN *STUNStatus `json:"stun,omitempty"`
+	// NATType is detected along with the external address if at least two STUN servers are configured
+	NATType stun.NATType `json:"nat_type"`
+	// DNS is the result of the last DNS update, if there was one
+	DNS               *DNSStatus      `json:"dns,omitempty"`
+	Listener          ListenerStatus  `json:"listener"`
+	Draining          bool            `json:"draining"`
+	ActiveConnections int             `json:"active_connections"`
+	Sessions          []SessionStatus `json:"sessions"`
+}
+
+type STUNStatus struct {
+	IP    string    `json:"ip,omitempty"`
+	Port  int       `json:"port,omitempty"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+type DNSStatus struct {
+	// Endpoint is the published ip:port, or "offline"
+	Endpoint string    `json:"endpoint"`
+	Time     time.Time `json:"time"`
+	Error    string    `json:"error,omitempty"`
+	// LastSuccess is when DNS was last updated successfully
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+type ListenerStatus struct {
+	State   string `json:"state"`
+	Address string `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type SessionStatus struct {
+	ID       uint64    `json:"id"`
+	Peer     string    `json:"peer"`
+	Identity string    `json:"identity,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	// Connections is the number of proxied connections in progress
+	Connections int64 `json:"connections"`
+}
+
+// status holds what Status reports about discovery, registration and the listener
+type status struct {
+	stun     *STUNStatus
+	natType  stun.NATType
+	dns      *DNSStatus
+	listener ListenerStatus
+}
+
+func (s *Server) recordDiscovery(ip string, port int, err error) {
+	st := &STUNStatus{IP: ip, Port: port, Time: time.Now()}
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	s.statusMutex.Lock()
+	s.status.stun = st
+	s.statusMutex.Unlock()
+}
+
+func (s *Server) recordNATType(natType stun.NATType) {
+	s.statusMutex.Lock()
+	s.status.natType = natType
+	s.statusMutex.Unlock()
+}
+
+func (s *Server) recordRegistration(endpoint string, err error) {
+	now := time.Now()
+	st := &DNSStatus{Endpoint: endpoint, Time: now}
+
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	if err != nil {
+		st.Error = err.Error()
+		if s.status.dns != nil {
+			st.LastSuccess = s.status.dns.LastSuccess
+		}
+	} else {
+		st.LastSuccess = &now
+	}
+	s.status.dns = st
+}
+
+func (s *Server) setListener(state, address string, err error) {
+	st := ListenerStatus{State: state, Address: address}
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	s.statusMutex.Lock()
+	s.status.listener = st
+	s.statusMutex.Unlock()
+}
+
+// Status returns the current state of natts and its sessions
+func (s *Server) Status() Status {
+	st := Status{
+		TargetFQDN: s.targetFQDN,
+		NATType:    stun.NATUnknown,
+		Draining:   s.draining.Load(),
+		Sessions:   s.Sessions(),
+	}
+
+	s.statusMutex.Lock()
+	st.STUN = s.status.stun
+	if s.status.natType != "" {
+		st.NATType = s.status.natType
+	}
+	st.DNS = s.status.dns
+	st.Listener = s.status.listener
+	s.statusMutex.Unlock()
+
+	s.connMutex.RLock()
+	st.ActiveConnections = s.activeConns
+	s.connMutex.RUnlock()
+
+	return st
+}
+
+// BanStatus is an IP that is refused for failing to authenticate
+type BanStatus struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// Sessions lists the open client sessions, oldest first
+func (s *Server) Sessions() []SessionStatus {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+
+	sessions := make([]SessionStatus, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, SessionStatus{
+			ID:          sess.id,
+			Peer:        sess.peer.String(),
+			Identity:    sess.identity,
+			Started:     sess.started,
+			Duration:    time.Since(sess.started).Round(time.Second).String(),
+			BytesIn:     sess.bytesIn.Load(),
+			BytesOut:    sess.bytesOut.Load(),
+			Connections: sess.conns.Load(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Live returns the problems that mean natts is broken: its listener failed
+// or the last DNS update did not go through. Nil means natts is live.
+func (s *Server) Live() []string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	var problems []string
+	if s.status.listener.State == ListenerFailed {
+		problems = append(problems, "listener failed: "+s.status.listener.Error)
+	}
+	if s.status.dns != nil && s.status.dns.Error != "" {
+		problems = append(problems, "DNS update failed: "+s.status.dns.Error)
+	}
+	return problems
+}
+
+// Ready returns the reasons natts cannot serve clients right now: it is not
+// live, not listening, not registered in DNS yet or shutting down. Nil means
+// natts is ready.
+func (s *Server) Ready() []string {
+	problems := s.Live()
+
+	s.statusMutex.Lock()
+	if state := s.status.listener.State; state != ListenerListening && state != ListenerFailed {
+		problems = append(problems, "listener is "+state)
+	}
+	if s.status.dns == nil {
+		problems = append(problems, "not registered in DNS yet")
+	}
+	s.statusMutex.Unlock()
+
+	if s.draining.Load() {
+		problems = append(problems, errShuttingDown.Error())
+	}
+	return problems
+}
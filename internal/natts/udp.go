@@ -0,0 +1,206 @@
+package natts
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+	"github.com/Hogeyama/ddns-updater/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// udpFlow relays datagrams between a nattc peer and a UDP backend
+type udpFlow struct {
+	id      uint32
+	peer    net.Addr
+	backend net.Conn
+	// conn is the socket the flow was opened on; it is not used once done is closed
+	conn    *tunnel.DatagramConn
+	sess    *session
+	traffic metrics.Traffic
+	// lastActive is the time of the last datagram in either direction, in Unix nanoseconds
+	lastActive atomic.Int64
+	// done is closed when the listener the flow was opened on closes
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// close ends the flow, so that nothing is sent on its socket anymore
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		f.backend.Close()
+	})
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleTime() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// serveFlow sets up a UDP flow requested on stream and relays it until
+// nattc closes the stream or the flow has been idle for too long
+func (s *Server) serveFlow(sess *session, log *slog.Logger, stream *smux.Stream, req *tunnel.OpenRequest) {
+	defer s.trackConnection(sess, log)()
+
+	target, err := s.current().resolveTarget(req)
+	if err != nil {
+		log.Warn("rejected UDP flow", "error", err)
+		tunnel.RejectWith(stream, rejectCode(err), err)
+		return
+	}
+
+	// Counted like in handleStream, once the service is known to exist
+	service := metrics.Service(*req)
+	defer metrics.Connection(service)()
+
+	backend, err := net.Dial("udp", target)
+	if err != nil {
+		log.Warn("failed to set up UDP flow", "backend", target, "error", err)
+		tunnel.RejectWith(stream, rejectCode(err), fmt.Errorf("%s is unavailable", req.Target()))
+		return
+	}
+	defer backend.Close()
+
+	flow, err := s.addFlow(sess, stream.RemoteAddr(), backend, metrics.NewTraffic(service))
+	if err != nil {
+		log.Warn("rejected UDP flow", "error", err)
+		tunnel.Reject(stream, err)
+		return
+	}
+	defer s.removeFlow(flow)
+
+	if err := tunnel.AcceptFlow(stream, flow.id); err != nil {
+		log.Warn("failed to send stream response", "error", err)
+		return
+	}
+
+	log = log.With("flow", flow.id)
+	log.Info("UDP flow opened", "backend", target)
+
+	// Relay backend datagrams to the peer, dropping those over the bandwidth limits
+	allow := s.shaper.Police(sess.bandwidth, service)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := backend.Read(buf)
+			if err != nil {
+				return
+			}
+			if n > tunnel.MaxDatagramSize {
+				log.Warn("dropped datagram: too large", "size", n)
+				continue
+			}
+			flow.touch()
+			if !allow(n) {
+				continue
+			}
+			if err := flow.conn.WriteDatagram(flow.id, buf[:n], flow.peer); err != nil {
+				select {
+				case <-flow.done:
+					return
+				default:
+				}
+				log.Warn("failed to send datagram", "error", err)
+				continue
+			}
+			flow.traffic.Out.Add(float64(n))
+			sess.bytesOut.Add(int64(n))
+		}
+	}()
+
+	// The stream carries no data; it ends when nattc drops the flow
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, stream)
+		close(closed)
+	}()
+
+	idleTimeout := s.current().udpIdleTimeout
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			log.Info("UDP flow closed by peer")
+			return
+		case <-flow.done:
+			log.Info("UDP flow closed with the listener")
+			return
+		case <-ticker.C:
+			if flow.idleTime() > idleTimeout {
+				log.Info("UDP flow idle, closing", "idle_timeout", idleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// addFlow registers a flow on the current socket. It fails if the listener is closed.
+func (s *Server) addFlow(sess *session, peer net.Addr, backend net.Conn, traffic metrics.Traffic) (*udpFlow, error) {
+	// The listener lock is held throughout, so that closeFlows sees every
+	// flow opened on the socket it is about to close
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	if s.udpConn == nil {
+		return nil, errListenerClosed
+	}
+
+	s.flowMutex.Lock()
+	defer s.flowMutex.Unlock()
+
+	flow := &udpFlow{peer: peer, backend: backend, conn: s.udpConn, sess: sess, traffic: traffic, done: make(chan struct{})}
+	flow.touch()
+	for {
+		flow.id = rand.Uint32()
+		if _, exists := s.flows[flow.id]; flow.id != 0 && !exists {
+			break
+		}
+	}
+	s.flows[flow.id] = flow
+	return flow, nil
+}
+
+func (s *Server) removeFlow(flow *udpFlow) {
+	s.flowMutex.Lock()
+	delete(s.flows, flow.id)
+	s.flowMutex.Unlock()
+}
+
+// closeFlows ends all flows. It is called with listenerMutex held, before the socket closes.
+func (s *Server) closeFlows() {
+	s.flowMutex.Lock()
+	defer s.flowMutex.Unlock()
+	for _, flow := range s.flows {
+		flow.close()
+	}
+}
+
+// handleDatagram forwards a datagram received on the KCP socket to the backend of its flow.
+// Datagrams for unknown flows or from another peer are dropped.
+func (s *Server) handleDatagram(id uint32, payload []byte, from net.Addr) {
+	s.flowMutex.Lock()
+	flow := s.flows[id]
+	s.flowMutex.Unlock()
+
+	if flow == nil || flow.peer.String() != from.String() {
+		return
+	}
+
+	flow.touch()
+	flow.traffic.In.Add(float64(len(payload)))
+	flow.sess.bytesIn.Add(int64(len(payload)))
+	if _, err := flow.backend.Write(payload); err != nil {
+		flow.sess.log.Warn("failed to forward datagram", "flow", id, "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package natts
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
+)
+
+func TestCloseListenerClosesFlows(t *testing.T) {
+	s := testServer(t)
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	p := newPipeSession(t, s)
+
+	backendConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendConn.Close()
+	backend, err := net.Dial("udp", backendConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	flow, err := s.addFlow(p.sess, peer, backend, metrics.NewTraffic("udp/test"))
+	if err != nil {
+		t.Fatalf("addFlow: %v", err)
+	}
+	defer s.removeFlow(flow)
+
+	s.listenerMutex.Lock()
+	s.closeListener()
+	s.listenerMutex.Unlock()
+
+	select {
+	case <-flow.done:
+	case <-time.After(time.Second):
+		t.Fatal("flow still open after the listener closed")
+	}
+	if _, err := backend.Read(make([]byte, 1)); err == nil {
+		t.Error("backend of a closed flow still readable")
+	}
+	if _, err := s.addFlow(p.sess, peer, backend, metrics.NewTraffic("udp/test")); !errors.Is(err, errListenerClosed) {
+		t.Errorf("flow added without a listener: %v", err)
+	}
+}
@@ -1,16 +1,38 @@
 package stun
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
+	"github.com/Hogeyama/ddns-updater/internal/logging"
+	"github.com/Hogeyama/ddns-updater/internal/metrics"
 	"github.com/pion/stun"
 )
 
-func GetIPv4AndAvailablePort() (string, int, error) {
-	const stunServer = "stunserver2025.stunprotocol.org:3478"
+var log = logging.For(logging.STUN)
+
+// DefaultServers are the STUN servers used when none are configured
+var DefaultServers = []string{"stunserver2025.stunprotocol.org:3478"}
+
+// GetIPv4AndAvailablePort asks the given STUN servers in order for the external
+// address of a fresh UDP port and returns the first answer
+func GetIPv4AndAvailablePort(servers []string) (string, int, error) {
+	var errs []error
+	for _, server := range servers {
+		start := time.Now()
+		ip, port, err := getIPv4AndAvailablePort(server)
+		observe(server, start, ip, port, err)
+		if err == nil {
+			return ip, port, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return "", 0, noAnswer(errs)
+}
 
+func getIPv4AndAvailablePort(stunServer string) (string, int, error) {
 	remoteAddr, err := net.ResolveUDPAddr("udp", stunServer)
 	if err != nil {
 		return "", 0, fmt.Errorf("failed to resolve STUN server address: %w", err)
@@ -57,10 +79,23 @@ func GetIPv4AndAvailablePort() (string, int, error) {
 	return xorAddr.IP.String(), xorAddr.Port, nil
 }
 
-// GetIPv4FromLocalPort discovers external IP and port using a specific local UDP port
-func GetIPv4FromLocalPort(localPort int) (string, int, error) {
-	const stunServer = "stunserver2025.stunprotocol.org:3478"
+// GetIPv4FromLocalPort discovers external IP and port using a specific local UDP port,
+// asking the given STUN servers in order
+func GetIPv4FromLocalPort(localPort int, servers []string) (string, int, error) {
+	var errs []error
+	for _, server := range servers {
+		start := time.Now()
+		ip, port, err := getIPv4FromLocalPort(localPort, server)
+		observe(server, start, ip, port, err)
+		if err == nil {
+			return ip, port, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return "", 0, noAnswer(errs)
+}
 
+func getIPv4FromLocalPort(localPort int, stunServer string) (string, int, error) {
 	// UDPでSTUNサーバに接続（指定されたローカルポートを使用）
 	localAddr := &net.UDPAddr{Port: localPort}
 	remoteAddr, err := net.ResolveUDPAddr("udp", stunServer)
@@ -107,3 +142,24 @@ func GetIPv4FromLocalPort(localPort int) (string, int, error) {
 
 	return xorAddr.IP.String(), xorAddr.Port, nil
 }
+
+// observe records the outcome of a request to server that began at start
+func observe(server string, start time.Time, ip string, port int, err error) {
+	elapsed := time.Since(start)
+	metrics.STUNRequests.WithLabelValues(server, metrics.Result(err)).Inc()
+	metrics.STUNDuration.WithLabelValues(server).Observe(elapsed.Seconds())
+	if err != nil {
+		log.Debug("STUN request failed", "server", server, "duration", elapsed, "error", err)
+	} else {
+		log.Debug("STUN request succeeded", "server", server, "duration", elapsed, "ip", ip, "port", port)
+		metrics.SetEndpoint(metrics.STUNEndpoint, metrics.Endpoint(ip, port))
+	}
+}
+
+// noAnswer combines the errors of every STUN server that was asked
+func noAnswer(errs []error) error {
+	if len(errs) == 0 {
+		return fmt.Errorf("no STUN servers configured")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,199 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// NATType describes how the NAT in front of a UDP port maps it to external addresses
+type NATType string
+
+const (
+	// NATUnknown means fewer than two STUN servers answered
+	NATUnknown NATType = "unknown"
+	// NATNone means the port is reachable at its own address
+	NATNone NATType = "none"
+	// NATEndpointIndependent means every destination sees the same external
+	// address (full, restricted or port-restricted cone); hole punching works
+	NATEndpointIndependent NATType = "endpoint-independent"
+	// NATSymmetric means each destination sees a different external address,
+	// so the address published in DNS is unlikely to be reachable
+	NATSymmetric NATType = "symmetric"
+)
+
+// DetectNAT asks two STUN servers for the external address of localPort and
+// compares the answers. The port must not be in use.
+func DetectNAT(localPort int, servers []string) (NATType, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: localPort})
+	if err != nil {
+		return NATUnknown, fmt.Errorf("failed to open UDP port %d: %w", localPort, err)
+	}
+	defer conn.Close()
+
+	var mapped []*net.UDPAddr
+	var errs []error
+	for _, server := range servers {
+		start := time.Now()
+		addr, err := query(conn, server)
+		if err != nil {
+			observe(server, start, "", 0, err)
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		observe(server, start, addr.IP.String(), addr.Port, nil)
+
+		mapped = append(mapped, addr)
+		if len(mapped) == 2 {
+			break
+		}
+	}
+
+	if len(mapped) < 2 {
+		if len(servers) < 2 {
+			return NATUnknown, fmt.Errorf("at least two STUN servers are needed to detect the NAT type")
+		}
+		return NATUnknown, noAnswer(errs)
+	}
+	return classify(localPort, mapped[0], mapped[1]), nil
+}
+
+// classify tells the NAT type from the addresses two servers saw localPort as
+func classify(localPort int, a, b *net.UDPAddr) NATType {
+	switch {
+	case a.Port != b.Port || !a.IP.Equal(b.IP):
+		return NATSymmetric
+	case a.Port == localPort && isLocalIP(a.IP):
+		return NATNone
+	default:
+		return NATEndpointIndependent
+	}
+}
+
+// Mapping is the external address a STUN server saw a local port as
+type Mapping struct {
+	Server string
+	Addr   *net.UDPAddr
+	RTT    time.Duration
+	Err    error
+}
+
+// ProbeResult is what Probe found out about a local port
+type ProbeResult struct {
+	LocalPort int
+	// Mappings are the answers of every server, in the order they were asked
+	Mappings []Mapping
+	// Again is the second answer of the first server that answered, or nil
+	// if none did
+	Again *Mapping
+}
+
+// NATType classifies the NAT by the first two answers
+func (r *ProbeResult) NATType() NATType {
+	var mapped []*net.UDPAddr
+	for _, m := range r.Mappings {
+		if m.Err == nil {
+			mapped = append(mapped, m.Addr)
+		}
+	}
+	if len(mapped) < 2 {
+		return NATUnknown
+	}
+	return classify(r.LocalPort, mapped[0], mapped[1])
+}
+
+// Probe asks every server for the external address of localPort from one
+// socket, then asks the first server that answered again after pause, so that
+// the answers show how the NAT maps the port and whether the mapping holds.
+// The port must not be in use; 0 picks a free one.
+func Probe(localPort int, servers []string, pause time.Duration) (*ProbeResult, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: localPort})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP port %d: %w", localPort, err)
+	}
+	defer conn.Close()
+
+	result := &ProbeResult{LocalPort: conn.LocalAddr().(*net.UDPAddr).Port}
+	ask := func(server string) Mapping {
+		start := time.Now()
+		addr, err := query(conn, server)
+		m := Mapping{Server: server, Addr: addr, RTT: time.Since(start), Err: err}
+		if err != nil {
+			observe(server, start, "", 0, err)
+		} else {
+			observe(server, start, addr.IP.String(), addr.Port, nil)
+		}
+		return m
+	}
+
+	for _, server := range servers {
+		result.Mappings = append(result.Mappings, ask(server))
+	}
+	for _, m := range result.Mappings {
+		if m.Err == nil {
+			time.Sleep(pause)
+			again := ask(m.Server)
+			result.Again = &again
+			break
+		}
+	}
+	return result, nil
+}
+
+// query sends a binding request to server from conn and returns the mapped address
+func query(conn *net.UDPConn, server string) (*net.UDPAddr, error) {
+	remoteAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server address: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := conn.WriteToUDP(message.Raw, remoteAddr); err != nil {
+		return nil, fmt.Errorf("failed to send STUN request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read STUN response: %w", err)
+		}
+		if !from.IP.Equal(remoteAddr.IP) || from.Port != remoteAddr.Port {
+			// A late answer from a server asked earlier
+			continue
+		}
+
+		var response stun.Message
+		response.Raw = buf[:n]
+		if err := response.Decode(); err != nil {
+			return nil, fmt.Errorf("failed to decode STUN response: %w", err)
+		}
+		if response.TransactionID != message.TransactionID {
+			continue
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(&response); err != nil {
+			return nil, fmt.Errorf("failed to get XOR-MAPPED-ADDRESS: %w", err)
+		}
+		return &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}, nil
+	}
+}
+
+// isLocalIP reports whether ip is assigned to an interface of this host
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// Modes of a bench stream
+const (
+	// BenchModePing echoes everything nattc sends
+	BenchModePing = "ping"
+	// BenchModeUpload discards what nattc sends for the duration and reports how much arrived
+	BenchModeUpload = "upload"
+	// BenchModeDownload sends data for the duration and closes the stream
+	BenchModeDownload = "download"
+)
+
+// MaxBenchDuration bounds how long natts sends, receives or echoes on one bench stream
+const MaxBenchDuration = time.Minute
+
+// BenchTimeout is when natts closes a bench stream: the longest run, and the
+// time to wait for its first byte and to send the result
+const BenchTimeout = MaxBenchDuration + HandshakeTimeout
+
+// benchChunk is the size of the writes of uploads and downloads
+const benchChunk = 32 * 1024
+
+// BenchRequest is sent by nattc once natts accepted a bench stream
+type BenchRequest struct {
+	Mode     string        `json:"mode"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// BenchResult is what the receiving side measured of an upload or download
+type BenchResult struct {
+	Bytes int64 `json:"bytes"`
+	// Elapsed is the time from the first byte received to the last
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// BytesPerSecond returns the throughput of the transfer
+func (r BenchResult) BytesPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// benchData returns a chunk of random data, which does not compress
+func benchData() []byte {
+	data := make([]byte, benchChunk)
+	rng := rand.NewChaCha8([32]byte{})
+	rng.Read(data)
+	return data
+}
+
+// ServeBench runs the natts side of a bench stream after it was accepted
+func ServeBench(rw io.ReadWriter) error {
+	var req BenchRequest
+	if err := ReadMessage(rw, &req); err != nil {
+		return err
+	}
+	duration := benchDuration(req.Duration)
+
+	switch req.Mode {
+	case BenchModePing:
+		return ServeEcho(rw)
+
+	case BenchModeUpload:
+		result, err := receive(rw, duration)
+		if err != nil {
+			return err
+		}
+		return WriteMessage(rw, result)
+
+	case BenchModeDownload:
+		data := benchData()
+		deadline := time.Now().Add(duration)
+		for time.Now().Before(deadline) {
+			if _, err := rw.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown bench mode %q", req.Mode)
+	}
+}
+
+// benchDuration returns how long to run for a requested duration d. Runs
+// without a duration take as long as allowed.
+func benchDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return MaxBenchDuration
+	}
+	return min(d, MaxBenchDuration)
+}
+
+// receive reads from r until d has passed since the first byte arrived, or
+// until r ends if d is 0
+func receive(r io.Reader, d time.Duration) (BenchResult, error) {
+	buf := make([]byte, benchChunk)
+	var result BenchResult
+	var first time.Time
+	for {
+		n, err := r.Read(buf)
+		now := time.Now()
+		if n > 0 {
+			if first.IsZero() {
+				first = now
+			}
+			result.Bytes += int64(n)
+			result.Elapsed = now.Sub(first)
+		}
+		if errors.Is(err, io.EOF) && d == 0 {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if d > 0 && result.Elapsed >= d {
+			return result, nil
+		}
+	}
+}
+
+// BenchPings sends count pings on rw, a ping stream, one every interval, and
+// returns their round-trip times
+func BenchPings(rw io.ReadWriter, count int, interval time.Duration) ([]time.Duration, error) {
+	if err := WriteMessage(rw, BenchRequest{Mode: BenchModePing}); err != nil {
+		return nil, err
+	}
+	return Pings(rw, count, interval)
+}
+
+// BenchUpload sends data on rw, an upload stream, for d and returns how much
+// natts received in what time. Closing rw afterwards stops the writes.
+func BenchUpload(rw io.ReadWriter, d time.Duration) (BenchResult, error) {
+	if err := WriteMessage(rw, BenchRequest{Mode: BenchModeUpload, Duration: d}); err != nil {
+		return BenchResult{}, err
+	}
+
+	// Writes fail once the stream is closed after the result arrived
+	go func() {
+		data := benchData()
+		for {
+			if _, err := rw.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	var result BenchResult
+	err := ReadMessage(rw, &result)
+	return result, err
+}
+
+// BenchDownload asks natts to send data on rw, a download stream, for d and
+// returns how much arrived in what time
+func BenchDownload(rw io.ReadWriter, d time.Duration) (BenchResult, error) {
+	if err := WriteMessage(rw, BenchRequest{Mode: BenchModeDownload, Duration: d}); err != nil {
+		return BenchResult{}, err
+	}
+	return receive(rw, 0)
+}
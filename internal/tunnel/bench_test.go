@@ -0,0 +1,25 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBenchDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want time.Duration
+	}{
+		{"requested", 5 * time.Second, 5 * time.Second},
+		{"longest", MaxBenchDuration, MaxBenchDuration},
+		{"too long", time.Hour, MaxBenchDuration},
+		{"none", 0, MaxBenchDuration},
+		{"negative", -time.Second, MaxBenchDuration},
+	}
+	for _, tt := range tests {
+		if got := benchDuration(tt.d); got != tt.want {
+			t.Errorf("%s: benchDuration(%s) = %s, want %s", tt.name, tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for the streams of a session
+const (
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// CompressionAlgorithms are the supported algorithms, the preferred first
+var CompressionAlgorithms = []string{CompressionZstd, CompressionSnappy}
+
+// CompressionOffer is what a side tells its peer about compression in the handshake
+type CompressionOffer struct {
+	// Algorithms are those the side can use, the preferred first
+	Algorithms []string `json:"algorithms"`
+	// Want is set if the side asks for compression. Streams are only
+	// compressed if either side wants it and both support an algorithm.
+	Want bool `json:"want,omitempty"`
+}
+
+// NewCompressionOffer returns the offer for a compression setting: "auto"
+// compresses if want is set, "off" disables compression and an algorithm
+// asks for it, preferring that algorithm
+func NewCompressionOffer(setting string, want bool) *CompressionOffer {
+	switch setting {
+	case "off":
+		return nil
+	case "", "auto":
+		return &CompressionOffer{Algorithms: CompressionAlgorithms, Want: want}
+	}
+	algorithms := []string{setting}
+	for _, a := range CompressionAlgorithms {
+		if a != setting {
+			algorithms = append(algorithms, a)
+		}
+	}
+	return &CompressionOffer{Algorithms: algorithms, Want: true}
+}
+
+// agreeCompression picks the algorithm for a session between natts, offering
+// local, and nattc, offering remote, or "" if its streams are not compressed
+func agreeCompression(local, remote *CompressionOffer) string {
+	if local == nil || remote == nil || !(local.Want || remote.Want) {
+		return ""
+	}
+	// The side asking for compression has its preference honoured
+	preferred, other := local, remote
+	if !local.Want {
+		preferred, other = remote, local
+	}
+	for _, a := range preferred.Algorithms {
+		if slices.Contains(other.Algorithms, a) && slices.Contains(CompressionAlgorithms, a) {
+			return a
+		}
+	}
+	return ""
+}
+
+// Compressed frames carry at most compressFrameSize bytes of stream data
+const compressFrameSize = 64 * 1024
+
+// Writes shorter than this, such as keystrokes, are not worth compressing
+const compressMinSize = 128
+
+// After compressIncompressibleFrames frames in a row did not shrink by at
+// least an eighth, the next compressSkipFrames frames are sent as they are
+const (
+	compressIncompressibleFrames = 4
+	compressSkipFrames           = 16
+)
+
+// Frame kinds
+const (
+	frameRaw        = 0
+	frameCompressed = 1
+)
+
+type codec struct {
+	encode func(dst, src []byte) []byte
+	decode func(dst, src []byte) ([]byte, error)
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(compressFrameSize))
+)
+
+var codecs = map[string]codec{
+	CompressionSnappy: {
+		encode: snappy.Encode,
+		decode: func(dst, src []byte) ([]byte, error) {
+			n, err := snappy.DecodedLen(src)
+			if err != nil {
+				return nil, err
+			}
+			if n > compressFrameSize {
+				return nil, fmt.Errorf("frame of %d bytes is too large", n)
+			}
+			return snappy.Decode(dst[:cap(dst)], src)
+		},
+	},
+	CompressionZstd: {
+		encode: func(dst, src []byte) []byte {
+			return zstdEncoder.EncodeAll(src, dst[:0])
+		},
+		decode: func(dst, src []byte) ([]byte, error) {
+			return zstdDecoder.DecodeAll(src, dst[:0])
+		},
+	},
+}
+
+// Compress wraps rw, the tunnel side of a connection, so that what is written
+// is compressed with algorithm and what is read decompressed. Data that does
+// not compress is sent as it is. stats, if not nil, is called with the size
+// of every write before and after compression. Compress returns rw itself if
+// algorithm is "".
+func Compress(rw io.ReadWriter, algorithm string, stats func(in, out int)) io.ReadWriter {
+	c, ok := codecs[algorithm]
+	if !ok {
+		return rw
+	}
+	return &compressedConn{rw: rw, r: bufio.NewReader(rw), codec: c, stats: stats}
+}
+
+type compressedConn struct {
+	rw    io.ReadWriter
+	codec codec
+	stats func(in, out int)
+
+	// Read side
+	r       *bufio.Reader
+	pending []byte
+	frame   []byte
+	decoded []byte
+
+	// Write side
+	encoded        []byte
+	out            []byte
+	incompressible int
+	skip           int
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads the next frame into pending
+func (c *compressedConn) readFrame() error {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if size > uint64(snappy.MaxEncodedLen(compressFrameSize)) {
+		return fmt.Errorf("compressed frame of %d bytes is too large", size)
+	}
+	if cap(c.frame) < int(size) {
+		c.frame = make([]byte, size)
+	}
+	c.frame = c.frame[:size]
+	if _, err := io.ReadFull(c.r, c.frame); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	switch kind {
+	case frameRaw:
+		c.pending = c.frame
+	case frameCompressed:
+		if c.decoded == nil {
+			c.decoded = make([]byte, 0, compressFrameSize)
+		}
+		c.decoded, err = c.codec.decode(c.decoded, c.frame)
+		if err != nil {
+			return fmt.Errorf("failed to decompress frame: %w", err)
+		}
+		if len(c.decoded) > compressFrameSize {
+			return fmt.Errorf("frame of %d bytes is too large", len(c.decoded))
+		}
+		c.pending = c.decoded
+	default:
+		return fmt.Errorf("unknown frame kind %d", kind)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), compressFrameSize)]
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame sends chunk compressed if that is worth it, and as it is otherwise
+func (c *compressedConn) writeFrame(chunk []byte) error {
+	kind, payload := byte(frameRaw), chunk
+	switch {
+	case len(chunk) < compressMinSize:
+	case c.skip > 0:
+		c.skip--
+	default:
+		c.encoded = c.codec.encode(c.encoded[:0], chunk)
+		if len(c.encoded) < len(chunk)-len(chunk)/8 {
+			kind, payload = frameCompressed, c.encoded
+			c.incompressible = 0
+		} else if c.incompressible++; c.incompressible >= compressIncompressibleFrames {
+			c.skip = compressSkipFrames
+			c.incompressible = 0
+		}
+	}
+
+	c.out = append(c.out[:0], kind)
+	c.out = binary.AppendUvarint(c.out, uint64(len(payload)))
+	c.out = append(c.out, payload...)
+	if _, err := c.rw.Write(c.out); err != nil {
+		return err
+	}
+	if c.stats != nil {
+		c.stats(len(chunk), len(payload))
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// compressible returns n bytes of text that compresses well
+func compressible(n int) []byte {
+	return []byte(strings.Repeat("natts forwards ssh over kcp. ", n/29+1)[:n])
+}
+
+func random(t *testing.T, n int) []byte {
+	t.Helper()
+	p := make([]byte, n)
+	if _, err := rand.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// frameKinds splits what a compressedConn wrote into frames and returns their
+// kinds and the sizes of their payloads
+func frameKinds(t *testing.T, wire []byte) (kinds []byte, sizes []int) {
+	t.Helper()
+	r := bytes.NewReader(wire)
+	for r.Len() > 0 {
+		kind, _ := r.ReadByte()
+		size, err := binary.ReadUvarint(r)
+		if err != nil || int(size) > r.Len() {
+			t.Fatalf("malformed frame after %d frames", len(kinds))
+		}
+		r.Seek(int64(size), io.SeekCurrent)
+		kinds = append(kinds, kind)
+		sizes = append(sizes, int(size))
+	}
+	return kinds, sizes
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		// writes are written one by one
+		writes [][]byte
+		// kinds are the frames expected on the wire
+		kinds []byte
+	}{
+		{"text", [][]byte{compressible(4096)}, []byte{frameCompressed}},
+		{"random", [][]byte{random(t, 4096)}, []byte{frameRaw}},
+		{"keystrokes", [][]byte{[]byte("l"), []byte("s\n")}, []byte{frameRaw, frameRaw}},
+		{"shortest compressed write", [][]byte{compressible(compressMinSize)}, []byte{frameCompressed}},
+		{"full frame", [][]byte{compressible(compressFrameSize)}, []byte{frameCompressed}},
+		{"frame and a byte", [][]byte{compressible(compressFrameSize + 1)}, []byte{frameCompressed, frameRaw}},
+		{"three frames", [][]byte{compressible(2*compressFrameSize + 1000)}, []byte{frameCompressed, frameCompressed, frameCompressed}},
+	}
+	for _, algorithm := range CompressionAlgorithms {
+		for _, tt := range tests {
+			t.Run(algorithm+"/"+tt.name, func(t *testing.T) {
+				var wire bytes.Buffer
+				var in, out int
+				w := Compress(&wire, algorithm, func(i, o int) { in, out = in+i, out+o })
+
+				var sent []byte
+				for _, p := range tt.writes {
+					n, err := w.Write(p)
+					if err != nil || n != len(p) {
+						t.Fatalf("Write = %d, %v", n, err)
+					}
+					sent = append(sent, p...)
+				}
+
+				kinds, sizes := frameKinds(t, wire.Bytes())
+				if !bytes.Equal(kinds, tt.kinds) {
+					t.Errorf("frame kinds are %v, want %v", kinds, tt.kinds)
+				}
+				total := 0
+				for _, size := range sizes {
+					total += size
+				}
+				if in != len(sent) || out != total {
+					t.Errorf("stats count %d in and %d out, want %d and %d", in, out, len(sent), total)
+				}
+
+				got, err := io.ReadAll(Compress(&wire, algorithm, nil))
+				if err != nil {
+					t.Fatalf("failed to read back: %v", err)
+				}
+				if !bytes.Equal(got, sent) {
+					t.Errorf("read back %d bytes that differ from the %d written", len(got), len(sent))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressOff(t *testing.T) {
+	var wire bytes.Buffer
+	if rw := Compress(&wire, "", nil); rw != io.ReadWriter(&wire) {
+		t.Error("Compress wrapped the stream without an algorithm")
+	}
+}
+
+func TestCompressBackoff(t *testing.T) {
+	var wire bytes.Buffer
+	w := Compress(&wire, CompressionZstd, nil)
+
+	// Four incompressible frames, then text that is only compressed again
+	// once the next 16 frames went out as they are
+	for range compressIncompressibleFrames {
+		w.Write(random(t, 1024))
+	}
+	for range compressSkipFrames + 2 {
+		w.Write(compressible(1024))
+	}
+
+	kinds, _ := frameKinds(t, wire.Bytes())
+	want := bytes.Repeat([]byte{frameRaw}, compressIncompressibleFrames+compressSkipFrames)
+	want = append(want, frameCompressed, frameCompressed)
+	if !bytes.Equal(kinds, want) {
+		t.Errorf("frame kinds are %v, want %v", kinds, want)
+	}
+}
+
+func TestCompressBackoffResets(t *testing.T) {
+	var wire bytes.Buffer
+	w := Compress(&wire, CompressionSnappy, nil)
+
+	// A compressible frame in between starts the count over
+	for range compressIncompressibleFrames - 1 {
+		w.Write(random(t, 1024))
+	}
+	w.Write(compressible(1024))
+	for range compressIncompressibleFrames - 1 {
+		w.Write(random(t, 1024))
+	}
+	w.Write(compressible(1024))
+
+	kinds, _ := frameKinds(t, wire.Bytes())
+	if last := kinds[len(kinds)-1]; last != frameCompressed {
+		t.Errorf("frame kinds are %v, want compression kept up", kinds)
+	}
+}
+
+// frame encodes a frame of kind with payload
+func frame(kind byte, payload []byte) []byte {
+	out := binary.AppendUvarint([]byte{kind}, uint64(len(payload)))
+	return append(out, payload...)
+}
+
+func TestCompressReadErrors(t *testing.T) {
+	oversized := make([]byte, compressFrameSize+1)
+	tests := []struct {
+		name      string
+		algorithm string
+		wire      []byte
+		wantErr   string
+	}{
+		{"unknown kind", CompressionZstd, frame(7, []byte("x")), "unknown frame kind"},
+		{"truncated size", CompressionZstd, []byte{frameRaw}, io.ErrUnexpectedEOF.Error()},
+		{"truncated payload", CompressionZstd, frame(frameRaw, []byte("hello"))[:4], io.ErrUnexpectedEOF.Error()},
+		{
+			"frame size over the bound",
+			CompressionZstd,
+			binary.AppendUvarint([]byte{frameCompressed}, uint64(snappy.MaxEncodedLen(compressFrameSize)+1)),
+			"too large",
+		},
+		{"corrupt zstd", CompressionZstd, frame(frameCompressed, []byte("not zstd at all")), "failed to decompress"},
+		{"corrupt snappy", CompressionSnappy, frame(frameCompressed, []byte{0xff, 0xff, 0xff}), "failed to decompress"},
+		{"oversized zstd", CompressionZstd, frame(frameCompressed, zstdEncoder.EncodeAll(oversized, nil)), "failed to decompress"},
+		{"oversized snappy", CompressionSnappy, frame(frameCompressed, snappy.Encode(nil, oversized)), "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(Compress(bytes.NewBuffer(tt.wire), tt.algorithm, nil))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("read failed with %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgreeCompression(t *testing.T) {
+	auto := func(want bool) *CompressionOffer { return NewCompressionOffer("auto", want) }
+	// zstdOnly is a peer that cannot decode snappy
+	zstdOnly := &CompressionOffer{Algorithms: []string{CompressionZstd}}
+	tests := []struct {
+		name          string
+		local, remote *CompressionOffer
+		want          string
+	}{
+		{"neither wants it", auto(false), auto(false), ""},
+		{"natts wants it", auto(true), auto(false), CompressionZstd},
+		{"nattc wants it", auto(false), auto(true), CompressionZstd},
+		{"natts off", NewCompressionOffer("off", false), auto(true), ""},
+		{"nattc off or old", auto(true), nil, ""},
+		{"nattc asks for snappy", auto(false), NewCompressionOffer(CompressionSnappy, false), CompressionSnappy},
+		{"natts asks for snappy", NewCompressionOffer(CompressionSnappy, false), auto(false), CompressionSnappy},
+		{"both ask, natts preference wins", NewCompressionOffer(CompressionSnappy, false), NewCompressionOffer(CompressionZstd, false), CompressionSnappy},
+		{"peer without snappy", NewCompressionOffer(CompressionSnappy, false), zstdOnly, CompressionZstd},
+		{"no algorithm in common", auto(true), &CompressionOffer{Algorithms: []string{"lz4"}}, ""},
+		{"unknown algorithm offered by both", &CompressionOffer{Algorithms: []string{"lz4"}, Want: true}, &CompressionOffer{Algorithms: []string{"lz4"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := agreeCompression(tt.local, tt.remote); got != tt.want {
+				t.Errorf("agreeCompression = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+// datagramMagic prefixes datagrams carried next to KCP on the same UDP socket.
+// Its fifth and sixth bytes are zero, which never occurs in KCP or FEC packets.
+var datagramMagic = []byte{'N', 'T', 'U', 'D', 0, 0}
+
+// datagramHeaderSize is the magic followed by a 4-byte flow ID
+const datagramHeaderSize = 6 + 4
+
+// MaxDatagramSize is the largest payload carried in a single datagram.
+// It keeps frames within a 1500-byte MTU, which is also the most KCP reads at once.
+const MaxDatagramSize = 1500 - 20 - 8 - datagramHeaderSize
+
+// DatagramHandler receives the payload of a datagram sent on flow.
+// The payload is only valid until the handler returns.
+type DatagramHandler func(flow uint32, payload []byte, from net.Addr)
+
+// DatagramConn is a net.PacketConn that diverts tunnel datagrams to a handler
+// and passes every other packet, i.e. KCP traffic, through to its reader
+type DatagramConn struct {
+	net.PacketConn
+	handler DatagramHandler
+	// fec, if set, measures the loss of KCP packets and thins their parity
+	fec *AdaptiveFEC
+}
+
+func NewDatagramConn(conn net.PacketConn, handler DatagramHandler) *DatagramConn {
+	return &DatagramConn{
+		PacketConn: conn,
+		handler:    handler,
+	}
+}
+
+// SetAdaptiveFEC makes the KCP traffic on the socket follow fec. It must be
+// called before the socket is used.
+func (c *DatagramConn) SetAdaptiveFEC(fec *AdaptiveFEC) {
+	c.fec = fec
+}
+
+func (c *DatagramConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || n < datagramHeaderSize || !bytes.HasPrefix(p, datagramMagic) {
+			if err == nil && c.fec != nil {
+				c.fec.received(p[:n], addr)
+			}
+			return n, addr, err
+		}
+
+		flow := binary.BigEndian.Uint32(p[len(datagramMagic):])
+		c.handler(flow, p[datagramHeaderSize:n], addr)
+	}
+}
+
+// WriteTo sends a KCP packet, unless it is a parity shard the peer did not ask for
+func (c *DatagramConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.fec != nil && !c.fec.keep(p, addr) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// WriteDatagram sends payload on flow to addr
+func (c *DatagramConn) WriteDatagram(flow uint32, payload []byte, addr net.Addr) error {
+	buf := make([]byte, datagramHeaderSize+len(payload))
+	copy(buf, datagramMagic)
+	binary.BigEndian.PutUint32(buf[len(datagramMagic):], flow)
+	copy(buf[datagramHeaderSize:], payload)
+
+	_, err := c.PacketConn.WriteTo(buf, addr)
+	return err
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ServeEcho sends back everything read from rw until it ends
+func ServeEcho(rw io.ReadWriter) error {
+	_, err := io.Copy(rw, rw)
+	return err
+}
+
+// Pings sends count pings on rw, a stream served by ServeEcho, one every
+// interval, and returns their round-trip times
+func Pings(rw io.ReadWriter, count int, interval time.Duration) ([]time.Duration, error) {
+	rtts := make([]time.Duration, 0, count)
+	var ping, pong [8]byte
+	for seq := range uint64(count) {
+		if seq > 0 {
+			time.Sleep(interval)
+		}
+		binary.BigEndian.PutUint64(ping[:], seq)
+		start := time.Now()
+		if _, err := rw.Write(ping[:]); err != nil {
+			return rtts, err
+		}
+		if _, err := io.ReadFull(rw, pong[:]); err != nil {
+			return rtts, err
+		}
+		if pong != ping {
+			return rtts, fmt.Errorf("ping %d answered out of order", seq)
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
@@ -0,0 +1,250 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// The FEC header kcp-go puts in front of every KCP packet when FEC is on
+const (
+	fecHeaderSize = 6
+	fecTypeData   = 0xf1
+	fecTypeParity = 0xf2
+)
+
+// FECSampleInterval is how often the loss of a peer is sampled
+const FECSampleInterval = 5 * time.Second
+
+// Loss is only estimated from at least this many expected data packets, and
+// smoothed over samples with this weight for the newest one
+const (
+	fecMinSamplePackets = 100
+	fecLossWeight       = 0.5
+)
+
+// FECUpdate is sent on the control stream to ask the peer to send this many
+// parity shards per group of data shards
+type FECUpdate struct {
+	ParityShards int `json:"parity"`
+}
+
+// AdaptiveFEC adapts the parity of a FEC configuration to the loss of each
+// peer. kcp-go cannot change the shard counts of a running session, so the
+// encoder keeps producing the configured parity shards and AdaptiveFEC drops
+// those a peer did not ask for before they reach the socket. The decoder of
+// the peer treats them like lost packets. Parity can therefore only go down
+// from the configured count, the data shards never change, and the dropped
+// shards are still computed.
+//
+// Loss is counted from the gaps in the FEC sequence numbers of the data shards
+// a peer sends, before FEC recovers any of them. The SNMP counters of kcp-go
+// do not fit: they add up all sessions of the process, and a packet that FEC
+// recovers is never retransmitted, so they miss exactly the losses the parity
+// has to cover.
+type AdaptiveFEC struct {
+	fec       FEC
+	minParity int
+
+	mu    sync.Mutex
+	peers map[netip.AddrPort]*fecPeer
+}
+
+// fecPeer is the state for one peer, guarded by AdaptiveFEC.mu
+type fecPeer struct {
+	// sendParity is how many parity shards per group the peer asked for
+	sendParity int
+	// Data packets received from the peer since the last sample, the lowest
+	// FEC sequence number among them and how far the highest is beyond it
+	received    int
+	first, span uint32
+	// loss is the smoothed share of data packets lost, -1 before the first sample
+	loss float64
+	// asked is the parity last asked of the peer
+	asked int
+}
+
+// NewAdaptiveFEC adapts fec, whose ParityShards is the most ever sent, down
+// to minParity parity shards on clean links
+func NewAdaptiveFEC(fec FEC, minParity int) *AdaptiveFEC {
+	return &AdaptiveFEC{
+		fec:       fec,
+		minParity: minParity,
+		peers:     make(map[netip.AddrPort]*fecPeer),
+	}
+}
+
+func (a *AdaptiveFEC) peer(addr net.Addr) *fecPeer {
+	key := addrPort(addr)
+	p := a.peers[key]
+	if p == nil {
+		p = &fecPeer{sendParity: a.fec.ParityShards, loss: -1, asked: a.fec.ParityShards}
+		a.peers[key] = p
+	}
+	return p
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// Forget drops the state of the peer at addr once its session ended
+func (a *AdaptiveFEC) Forget(addr net.Addr) {
+	a.mu.Lock()
+	delete(a.peers, addrPort(addr))
+	a.mu.Unlock()
+}
+
+// SetSendParity applies a FECUpdate from the peer at addr
+func (a *AdaptiveFEC) SetSendParity(addr net.Addr, parity int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.peer(addr).sendParity = min(max(parity, 0), a.fec.ParityShards)
+}
+
+// keep reports whether a KCP packet to addr is sent, dropping the parity
+// shards beyond what the peer asked for
+func (a *AdaptiveFEC) keep(packet []byte, addr net.Addr) bool {
+	if len(packet) < fecHeaderSize || binary.LittleEndian.Uint16(packet[4:]) != fecTypeParity {
+		return true
+	}
+	seq := binary.LittleEndian.Uint32(packet)
+	index := int(seq%uint32(a.fec.DataShards+a.fec.ParityShards)) - a.fec.DataShards
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.peers[addrPort(addr)]
+	return !ok || index < p.sendParity
+}
+
+// received counts a KCP packet from addr towards its loss
+func (a *AdaptiveFEC) received(packet []byte, addr net.Addr) {
+	if len(packet) < fecHeaderSize || binary.LittleEndian.Uint16(packet[4:]) != fecTypeData {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(packet)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.peers[addrPort(addr)]
+	if !ok {
+		return
+	}
+	if p.received == 0 {
+		p.first, p.span = seq, 0
+	} else if d := a.distance(p.first, seq); d < a.wrap()/2 {
+		p.span = max(p.span, d)
+	} else {
+		// Reordered before the first packet of the sample
+		p.span += a.wrap() - d
+		p.first = seq
+	}
+	p.received++
+}
+
+// wrap is where kcp-go starts the FEC sequence numbers over, the largest
+// multiple of the group size that fits in them
+func (a *AdaptiveFEC) wrap() uint32 {
+	group := uint32(a.fec.DataShards + a.fec.ParityShards)
+	return math.MaxUint32 / group * group
+}
+
+// distance is how many sequence numbers from follows to, across the wrap
+func (a *AdaptiveFEC) distance(from, to uint32) uint32 {
+	if to >= from {
+		return to - from
+	}
+	return a.wrap() - from + to
+}
+
+// Sample estimates the loss from the peer at addr since the last call and
+// returns the parity the peer should send for it, and whether that differs
+// from what it was last asked for
+func (a *AdaptiveFEC) Sample(addr net.Addr) (parity int, loss float64, changed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.peer(addr)
+
+	expected := a.dataPackets(p.first, p.span)
+	if p.received > 0 && expected >= fecMinSamplePackets && expected >= p.received {
+		sample := 1 - float64(p.received)/float64(expected)
+		if p.loss < 0 {
+			p.loss = sample
+		} else {
+			p.loss = fecLossWeight*sample + (1-fecLossWeight)*p.loss
+		}
+	}
+	p.received = 0
+
+	if p.loss < 0 {
+		return p.asked, 0, false
+	}
+	// Allow for twice the lost shards expected per group
+	parity = int(math.Ceil(2 * p.loss * float64(a.fec.DataShards)))
+	parity = min(max(parity, a.minParity), a.fec.ParityShards)
+	changed = parity != p.asked
+	p.asked = parity
+	return parity, p.loss, changed
+}
+
+// dataPackets counts the sequence numbers of data shards from first to span
+// beyond it. The wrap is a multiple of the group size, so groups carry on
+// across it.
+func (a *AdaptiveFEC) dataPackets(first, span uint32) int {
+	group := uint64(a.fec.DataShards + a.fec.ParityShards)
+	data := uint64(a.fec.DataShards)
+	upTo := func(seq uint64) uint64 {
+		// Data shards with a sequence number below seq
+		return seq/group*data + min(seq%group, data)
+	}
+	last := uint64(first) + uint64(span)
+	return int(upTo(last+1) - upTo(uint64(first)))
+}
+
+// Exchange runs the control stream of the session with the peer at addr
+// until it fails: FECUpdates from the peer set the parity sent to it, and
+// every interval the loss seen from the peer is sampled and the peer told if
+// it should send another parity. adjusted is called for every update sent.
+func (a *AdaptiveFEC) Exchange(stream io.ReadWriter, addr net.Addr, interval time.Duration, adjusted func(parity int, loss float64)) error {
+	a.mu.Lock()
+	a.peer(addr)
+	a.mu.Unlock()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			var update FECUpdate
+			if err := ReadMessage(stream, &update); err != nil {
+				errs <- err
+				return
+			}
+			a.SetSendParity(addr, update.ParityShards)
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+			parity, loss, changed := a.Sample(addr)
+			if !changed {
+				continue
+			}
+			if err := WriteMessage(stream, FECUpdate{ParityShards: parity}); err != nil {
+				return err
+			}
+			adjusted(parity, loss)
+		}
+	}
+}
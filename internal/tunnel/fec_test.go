@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+// fecPacket returns the FEC header of a packet with seq and flag
+func fecPacket(seq uint32, flag uint16) []byte {
+	packet := make([]byte, fecHeaderSize)
+	binary.LittleEndian.PutUint32(packet, seq)
+	binary.LittleEndian.PutUint16(packet[4:], flag)
+	return packet
+}
+
+func TestDataPackets(t *testing.T) {
+	a := NewAdaptiveFEC(FEC{DataShards: 10, ParityShards: 3}, 0)
+	wrap := a.wrap()
+	tests := []struct {
+		name        string
+		first, span uint32
+		want        int
+	}{
+		{"single data shard", 0, 0, 1},
+		{"one group", 0, 12, 10},
+		{"data shards of one group", 0, 9, 10},
+		{"from a parity shard", 10, 9, 7},
+		{"two groups from the middle", 5, 25, 20},
+		{"last group before the wrap", wrap - 13, 12, 10},
+		{"across the wrap", wrap - 13, 25, 20},
+		{"from the parity before the wrap", wrap - 1, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.dataPackets(tt.first, tt.span); got != tt.want {
+				t.Errorf("dataPackets(%d, %d) = %d, want %d", tt.first, tt.span, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	const groups = 20
+	fec := FEC{DataShards: 10, ParityShards: 3}
+	wrap := NewAdaptiveFEC(fec, 0).wrap()
+
+	// sequence returns the data shards of groups groups from start, without those lost
+	sequence := func(start uint32, lost func(i int) bool) []uint32 {
+		var seqs []uint32
+		for i := range groups * 13 {
+			seq := uint32((uint64(start) + uint64(i)) % uint64(wrap))
+			if int(seq%13) < 10 && !lost(i) {
+				seqs = append(seqs, seq)
+			}
+		}
+		return seqs
+	}
+	none := func(int) bool { return false }
+	tenth := func(i int) bool { return i%13 == 4 }
+
+	tests := []struct {
+		name       string
+		seqs       []uint32
+		minParity  int
+		wantLoss   float64
+		wantParity int
+	}{
+		{"clean link", sequence(0, none), 0, 0, 0},
+		{"clean link keeps the minimum", sequence(0, none), 1, 0, 1},
+		{"a tenth lost", sequence(0, tenth), 0, 0.1, 2},
+		{"clean across the wrap", sequence(wrap-5*13, none), 0, 0, 0},
+		{"a tenth lost across the wrap", sequence(wrap-5*13, tenth), 0, 0.1, 2},
+		{"reordered before the first", reorder(sequence(wrap-5*13, none)), 0, 0, 0},
+		{"too few packets", sequence(0, none)[:50], 0, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAdaptiveFEC(fec, tt.minParity)
+			addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+			a.Sample(addr)
+			for _, seq := range tt.seqs {
+				a.received(fecPacket(seq, fecTypeData), addr)
+				// Parity shards do not count
+				a.received(fecPacket(seq+10, fecTypeParity), addr)
+			}
+			parity, loss, _ := a.Sample(addr)
+			if math.Abs(loss-tt.wantLoss) > 0.001 {
+				t.Errorf("loss is %.4f, want %.4f", loss, tt.wantLoss)
+			}
+			if parity != tt.wantParity {
+				t.Errorf("parity is %d, want %d", parity, tt.wantParity)
+			}
+		})
+	}
+}
+
+// reorder swaps the first two packets of seqs
+func reorder(seqs []uint32) []uint32 {
+	seqs[0], seqs[1] = seqs[1], seqs[0]
+	return seqs
+}
+
+func TestSampleSmoothsLoss(t *testing.T) {
+	a := NewAdaptiveFEC(FEC{DataShards: 10, ParityShards: 5}, 0)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	a.Sample(addr)
+
+	// 200 data packets expected each time, a fifth of them lost in the first
+	// sample and none in the second
+	send := func(start uint32, lossy bool) {
+		for i := range 200 {
+			if !lossy || i%5 != 2 {
+				a.received(fecPacket(start+uint32(i/10*15+i%10), fecTypeData), addr)
+			}
+		}
+	}
+	send(0, true)
+	if parity, loss, changed := a.Sample(addr); math.Abs(loss-0.2) > 0.001 || parity != 4 || !changed {
+		t.Errorf("first sample: parity %d loss %.4f changed %v, want 4, 0.2 and changed", parity, loss, changed)
+	}
+	send(20*15, false)
+	parity, loss, changed := a.Sample(addr)
+	if math.Abs(loss-0.1) > 0.001 || parity != 2 || !changed {
+		t.Errorf("second sample: parity %d loss %.4f changed %v, want 2, 0.1 and changed", parity, loss, changed)
+	}
+}
+
+func TestSetSendParity(t *testing.T) {
+	a := NewAdaptiveFEC(FEC{DataShards: 10, ParityShards: 3}, 0)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	tests := []struct {
+		asked int
+		// sent is how many parity shards of a group reach the socket
+		sent int
+	}{
+		{0, 0},
+		{2, 2},
+		{3, 3},
+		// The configured parity is the most ever sent, however much the peer asks for
+		{8, 3},
+		{-1, 0},
+	}
+	for _, tt := range tests {
+		a.SetSendParity(addr, tt.asked)
+		sent := 0
+		for seq := range uint32(13) {
+			flag := uint16(fecTypeData)
+			if seq >= 10 {
+				flag = fecTypeParity
+			}
+			if a.keep(fecPacket(seq, flag), addr) && flag == fecTypeParity {
+				sent++
+			}
+		}
+		if sent != tt.sent {
+			t.Errorf("peer asked for %d parity shards and got %d, want %d", tt.asked, sent, tt.sent)
+		}
+	}
+}
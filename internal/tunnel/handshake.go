@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// HandshakeTimeout bounds how long the handshake at the start of a session may take
+const HandshakeTimeout = 10 * time.Second
+
+// ErrAuthFailed is returned by AcceptHandshake when nattc cannot prove it holds an authorized key
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrFECMismatch is returned by AcceptHandshake when nattc uses other FEC settings than natts
+var ErrFECMismatch = errors.New("FEC settings differ")
+
+// Key is a secret shared between nattc and natts, identified by ID
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// sign returns the MAC proving that the holder of k received nonce
+func (k Key) sign(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(k.Secret))
+	mac.Write([]byte(k.ID))
+	mac.Write([]byte{0})
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Hello is sent by nattc on the first stream of a session
+type Hello struct {
+	Version int `json:"v"`
+	// KeyID names the key nattc authenticates with, if any
+	KeyID string `json:"key_id,omitempty"`
+	// FEC is the forward error correction nattc uses. Older clients do not send it.
+	FEC *FEC `json:"fec,omitempty"`
+	// Compression is nil if nattc does not compress streams
+	Compression *CompressionOffer `json:"compression,omitempty"`
+}
+
+// Challenge is natts's answer to Hello. Nonce is empty if natts does not
+// require authentication, in which case the handshake is complete.
+type Challenge struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	// AdaptiveFEC is set if natts adapts FEC too, so nattc opens the control stream
+	AdaptiveFEC bool `json:"adaptive_fec,omitempty"`
+	// Compression is the algorithm the streams of the session are compressed with, if any
+	Compression string `json:"compression,omitempty"`
+	// Echo and Bench are set by a natts that serves echo and bench streams.
+	// Older ones would connect such streams to the default service.
+	Echo  bool `json:"echo,omitempty"`
+	Bench bool `json:"bench,omitempty"`
+}
+
+// Agreement is the outcome of a successful handshake
+type Agreement struct {
+	// KeyID is the ID of the key nattc authenticated with, if any
+	KeyID string
+	// AdaptiveFEC is set if both sides adapt the parity they send
+	AdaptiveFEC bool
+	// Compression is the algorithm both sides compress streams with, or "" if they do not
+	Compression string
+	// Echo and Bench are set if natts serves echo and bench streams
+	Echo, Bench bool
+}
+
+// Proof answers a Challenge with the MAC of its nonce
+type Proof struct {
+	MAC []byte `json:"mac"`
+}
+
+// Handshake runs the nattc side of the session handshake on rw, telling natts
+// the FEC settings of the session and the compression it offers. key may be
+// nil if natts does not require authentication.
+func Handshake(rw io.ReadWriter, key *Key, fec FEC, compression *CompressionOffer) (Agreement, error) {
+	hello := Hello{Version: ProtocolVersion, FEC: &fec, Compression: compression}
+	if key != nil {
+		hello.KeyID = key.ID
+	}
+	if err := WriteMessage(rw, hello); err != nil {
+		return Agreement{}, err
+	}
+
+	var challenge Challenge
+	if err := ReadMessage(rw, &challenge); err != nil {
+		return Agreement{}, err
+	}
+	if !challenge.OK {
+		return Agreement{}, &RejectedError{Target: "session", Reason: challenge.Error}
+	}
+	agreement := Agreement{
+		AdaptiveFEC: fec.Adaptive && challenge.AdaptiveFEC,
+		Echo:        challenge.Echo,
+		Bench:       challenge.Bench,
+	}
+	if challenge.Compression != "" {
+		if compression == nil || !slices.Contains(compression.Algorithms, challenge.Compression) {
+			return Agreement{}, fmt.Errorf("natts chose unsupported compression %q", challenge.Compression)
+		}
+		agreement.Compression = challenge.Compression
+	}
+	if len(challenge.Nonce) == 0 {
+		return agreement, nil
+	}
+	if key == nil {
+		return Agreement{}, &RejectedError{Target: "session", Reason: "natts requires an auth key"}
+	}
+	agreement.KeyID = key.ID
+
+	if err := WriteMessage(rw, Proof{MAC: key.sign(challenge.Nonce)}); err != nil {
+		return Agreement{}, err
+	}
+
+	var resp OpenResponse
+	if err := ReadMessage(rw, &resp); err != nil {
+		return Agreement{}, err
+	}
+	if !resp.OK {
+		return Agreement{}, &RejectedError{Target: "session", Reason: resp.Error}
+	}
+	return agreement, nil
+}
+
+// AcceptHandshake runs the natts side of the session handshake on rw. Without
+// keys every client is accepted and the KeyID of the Agreement is empty.
+// Clients whose FEC settings differ from fec are refused. Streams are
+// compressed if compression and the offer of the client agree on it.
+func AcceptHandshake(rw io.ReadWriter, keys []Key, fec FEC, compression *CompressionOffer) (Agreement, error) {
+	var hello Hello
+	if err := ReadMessage(rw, &hello); err != nil {
+		return Agreement{}, err
+	}
+	if hello.Version != ProtocolVersion {
+		err := fmt.Errorf("unsupported protocol version %d", hello.Version)
+		WriteMessage(rw, Challenge{Error: err.Error()})
+		return Agreement{}, err
+	}
+	// The decoders of kcp-go follow the shard counts they see, but only after
+	// dropping packets while they detect them
+	if hello.FEC != nil && (hello.FEC.DataShards != fec.DataShards || hello.FEC.ParityShards != fec.ParityShards) {
+		err := fmt.Errorf("%w: natts has %s, nattc %s", ErrFECMismatch, fec, *hello.FEC)
+		WriteMessage(rw, Challenge{Error: err.Error() + "; set the same [kcp] data_shards and parity_shards on both"})
+		return Agreement{}, err
+	}
+	agreement := Agreement{
+		AdaptiveFEC: fec.Adaptive && hello.FEC != nil && hello.FEC.Adaptive,
+		Compression: agreeCompression(compression, hello.Compression),
+		Echo:        true,
+		Bench:       true,
+	}
+	// Bench streams are offered even if natts refuses them, so that nattc
+	// bench reports that they are disabled rather than natts being too old
+	challenge := Challenge{
+		OK:          true,
+		AdaptiveFEC: agreement.AdaptiveFEC,
+		Compression: agreement.Compression,
+		Echo:        agreement.Echo,
+		Bench:       agreement.Bench,
+	}
+
+	if len(keys) == 0 {
+		return agreement, WriteMessage(rw, challenge)
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return Agreement{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	challenge.Nonce = nonce
+	if err := WriteMessage(rw, challenge); err != nil {
+		return Agreement{}, err
+	}
+
+	var proof Proof
+	if err := ReadMessage(rw, &proof); err != nil {
+		return Agreement{}, err
+	}
+
+	for _, key := range keys {
+		if key.ID == hello.KeyID && hmac.Equal(proof.MAC, key.sign(nonce)) {
+			agreement.KeyID = key.ID
+			return agreement, Accept(rw)
+		}
+	}
+
+	// Unknown keys and wrong secrets look the same to the client
+	Reject(rw, ErrAuthFailed)
+	if hello.KeyID == "" {
+		return Agreement{}, fmt.Errorf("%w: no key presented", ErrAuthFailed)
+	}
+	return Agreement{}, fmt.Errorf("%w for key %q", ErrAuthFailed, hello.KeyID)
+}
+
+// RejectHandshake refuses a session during the handshake, e.g. while natts is shutting down
+func RejectHandshake(rw io.ReadWriter, reason error) error {
+	var hello Hello
+	if err := ReadMessage(rw, &hello); err != nil {
+		return err
+	}
+	return WriteMessage(rw, Challenge{Error: reason.Error()})
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHandshakeOffersEchoAndBench(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan Agreement, 1)
+	go func() {
+		agreement, err := AcceptHandshake(server, nil, FEC{}, nil)
+		if err != nil {
+			t.Errorf("AcceptHandshake: %v", err)
+		}
+		accepted <- agreement
+	}()
+	agreement, err := Handshake(client, nil, FEC{}, nil)
+	if err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if !agreement.Echo || !agreement.Bench {
+		t.Errorf("nattc sees echo %v and bench %v, want both offered", agreement.Echo, agreement.Bench)
+	}
+	if natts := <-accepted; !natts.Echo || !natts.Bench {
+		t.Errorf("natts agreed on echo %v and bench %v, want both", natts.Echo, natts.Bench)
+	}
+}
+
+func TestHandshakeWithOldNatts(t *testing.T) {
+	// natts from before echo and bench streams answers without offering them
+	var challenge bytes.Buffer
+	if err := WriteMessage(&challenge, Challenge{OK: true}); err != nil {
+		t.Fatal(err)
+	}
+	agreement, err := Handshake(peer{Reader: &challenge, Writer: &bytes.Buffer{}}, nil, FEC{}, nil)
+	if err != nil {
+		t.Fatalf("Handshake: %v", err)
+	}
+	if agreement.Echo || agreement.Bench {
+		t.Errorf("old natts taken to serve echo %v and bench %v", agreement.Echo, agreement.Bench)
+	}
+}
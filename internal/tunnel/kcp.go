@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// KCPOptions tunes the KCP sessions between nattc and natts
+type KCPOptions struct {
+	// DataShards and ParityShards configure Reed-Solomon forward error correction.
+	// Both must be zero to disable it, and both peers must use the same values.
+	DataShards   int
+	ParityShards int
+	// Profile controls how eagerly lost packets are retransmitted
+	Profile KCPProfile
+	// SendWindow and RecvWindow are the window sizes in packets
+	SendWindow int
+	RecvWindow int
+	// MTU is the largest UDP payload KCP sends, including the FEC header
+	MTU int
+	// DSCP marks the packets of the UDP socket for QoS; 0 leaves them unmarked
+	DSCP int
+	// ACKNoDelay acknowledges packets as soon as they arrive instead of on the next tick
+	ACKNoDelay bool
+	// AdaptiveFEC sends only as many of the ParityShards as the loss of the
+	// peer calls for, but at least MinParityShards. It never sends more than
+	// ParityShards and never changes DataShards.
+	AdaptiveFEC     bool
+	MinParityShards int
+	// Compression is "auto", "off" or one of CompressionAlgorithms. "auto"
+	// compresses the streams of low-bandwidth profiles.
+	Compression string
+}
+
+// KCPProfile is the retransmission behaviour set by SetNoDelay
+type KCPProfile struct {
+	// NoDelay retransmits on a shorter, non-doubling timeout
+	NoDelay bool
+	// Interval is how often KCP flushes and checks for losses
+	Interval time.Duration
+	// Resend retransmits a packet once this many later ones were acknowledged; 0 disables fast resend
+	Resend int
+	// NoCongestion turns off congestion control, trading fairness for throughput
+	NoCongestion bool
+	// LowBandwidth is set for profiles meant for slow links, whose streams are compressed by default
+	LowBandwidth bool
+}
+
+// KCPProfiles are the named profiles, from the most conservative to the most
+// aggressive. "standard" keeps the settings of kcp-go, the others match those
+// of kcptun and turn off congestion control.
+var KCPProfiles = map[string]KCPProfile{
+	"standard": {NoDelay: false, Interval: 100 * time.Millisecond, Resend: 0, NoCongestion: false},
+	"normal":   {NoDelay: false, Interval: 40 * time.Millisecond, Resend: 2, NoCongestion: true, LowBandwidth: true},
+	"fast":     {NoDelay: false, Interval: 30 * time.Millisecond, Resend: 2, NoCongestion: true},
+	"fast2":    {NoDelay: true, Interval: 20 * time.Millisecond, Resend: 2, NoCongestion: true},
+	"fast3":    {NoDelay: true, Interval: 10 * time.Millisecond, Resend: 2, NoCongestion: true},
+}
+
+// DefaultKCPOptions are used when nothing else is configured. They keep the
+// retransmission, windows and MTU of kcp-go, so that a tunnel backs off on a
+// congested link unless a faster profile is chosen.
+var DefaultKCPOptions = KCPOptions{
+	DataShards:   10,
+	ParityShards: 3,
+	Profile:      KCPProfiles["standard"],
+	SendWindow:   32,
+	RecvWindow:   32,
+	MTU:          1400,
+	Compression:  "auto",
+}
+
+// FEC is the forward error correction of a session, which both peers must agree on
+type FEC struct {
+	DataShards   int `json:"data"`
+	ParityShards int `json:"parity"`
+	// Adaptive offers to send fewer parity shards as the loss allows
+	Adaptive bool `json:"adaptive,omitempty"`
+}
+
+func (f FEC) String() string {
+	if f.DataShards == 0 && f.ParityShards == 0 {
+		return "FEC off"
+	}
+	return fmt.Sprintf("FEC with %d data and %d parity shards", f.DataShards, f.ParityShards)
+}
+
+func (o KCPOptions) FEC() FEC {
+	return FEC{DataShards: o.DataShards, ParityShards: o.ParityShards, Adaptive: o.AdaptiveFEC && o.DataShards > 0}
+}
+
+// NewAdaptiveFEC returns the AdaptiveFEC for the options, or nil if it is off
+func (o KCPOptions) NewAdaptiveFEC() *AdaptiveFEC {
+	if !o.FEC().Adaptive {
+		return nil
+	}
+	return NewAdaptiveFEC(o.FEC(), o.MinParityShards)
+}
+
+// CompressionOffer returns what the side offers about compression in the handshake
+func (o KCPOptions) CompressionOffer() *CompressionOffer {
+	return NewCompressionOffer(o.Compression, o.Profile.LowBandwidth)
+}
+
+// Apply tunes a KCP session. The DSCP is set on the UDP socket instead, see SetDSCP.
+func (o KCPOptions) Apply(conn *kcp.UDPSession) {
+	// smux frames are a byte stream, so packets may carry several of them
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+	conn.SetNoDelay(boolToInt(o.Profile.NoDelay), int(o.Profile.Interval/time.Millisecond), o.Profile.Resend, boolToInt(o.Profile.NoCongestion))
+	if o.SendWindow > 0 || o.RecvWindow > 0 {
+		conn.SetWindowSize(o.SendWindow, o.RecvWindow)
+	}
+	if o.MTU > 0 {
+		conn.SetMtu(o.MTU)
+	}
+	conn.SetACKNoDelay(o.ACKNoDelay)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SetDSCP marks the packets sent on the socket with dscp. kcp-go calls it for
+// the sessions and listeners the DatagramConn carries.
+func (c *DatagramConn) SetDSCP(dscp int) error {
+	conn, ok := c.PacketConn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("cannot set DSCP on %T", c.PacketConn)
+	}
+	// The socket may be IPv4 or IPv6, so one of them is expected to fail
+	err4 := ipv4.NewPacketConn(conn).SetTOS(dscp << 2)
+	err6 := ipv6.NewPacketConn(conn).SetTrafficClass(dscp << 2)
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("failed to set DSCP: %w", err4)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	DefaultKeepAliveInterval = 10 * time.Second
+	DefaultKeepAliveTimeout  = 30 * time.Second
+	DefaultResumeTimeout     = 2 * time.Minute
+)
+
+var (
+	ErrIdleTimeout = errors.New("idle timeout")
+	ErrMaxLifetime = errors.New("maximum lifetime reached")
+)
+
+// Timeouts controls keepalives on a session and how long its streams may live
+type Timeouts struct {
+	// KeepAliveInterval is how often a keepalive frame is sent (default 10s)
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout closes the session if nothing, not even a keepalive,
+	// arrived for this long (default 30s)
+	KeepAliveTimeout time.Duration
+	// IdleTimeout closes a stream without traffic in either direction; zero disables it
+	IdleTimeout time.Duration
+	// MaxLifetime closes a stream this long after it was opened; zero disables it
+	MaxLifetime time.Duration
+	// ResumeTimeout is how long a stream whose session broke waits to be
+	// resumed on a new session; zero disables resumption
+	ResumeTimeout time.Duration
+}
+
+// MuxConfig returns the smux configuration shared by nattc and natts.
+// Both sides must agree on the protocol version.
+func MuxConfig(t Timeouts) *smux.Config {
+	cfg := smux.DefaultConfig()
+	cfg.Version = 2
+	cfg.KeepAliveInterval = DefaultKeepAliveInterval
+	cfg.KeepAliveTimeout = DefaultKeepAliveTimeout
+	if t.KeepAliveInterval > 0 {
+		cfg.KeepAliveInterval = t.KeepAliveInterval
+	}
+	if t.KeepAliveTimeout > 0 {
+		cfg.KeepAliveTimeout = t.KeepAliveTimeout
+	}
+	return cfg
+}
+
+// activityReader records the time of every successful read
+type activityReader struct {
+	r          io.Reader
+	lastActive *atomic.Int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Pipe copies data in both directions until either side finishes and returns the first error.
+// It gives up with ErrIdleTimeout or ErrMaxLifetime according to t; the caller is
+// expected to close both sides afterwards.
+func Pipe(a, b io.ReadWriter, t Timeouts) error {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(a, &activityReader{b, &lastActive})
+		done <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(b, &activityReader{a, &lastActive})
+		done <- err
+	}()
+
+	var idleCheck <-chan time.Time
+	if t.IdleTimeout > 0 {
+		ticker := time.NewTicker(t.IdleTimeout / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	var lifetimeExpired <-chan time.Time
+	if t.MaxLifetime > 0 {
+		timer := time.NewTimer(t.MaxLifetime)
+		defer timer.Stop()
+		lifetimeExpired = timer.C
+	}
+
+	for {
+		select {
+		case err := <-done:
+			// Wait for either direction to complete
+			if errors.Is(err, io.EOF) {
+				// smux streams report a closed peer as EOF
+				return nil
+			}
+			return err
+		case <-idleCheck:
+			if time.Since(time.Unix(0, lastActive.Load())) > t.IdleTimeout {
+				return ErrIdleTimeout
+			}
+		case <-lifetimeExpired:
+			return ErrMaxLifetime
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ProtocolVersion is the version of the handshake and stream headers exchanged between nattc and natts
+const ProtocolVersion = 2
+
+// DefaultService is the service selected when a client does not name one
+const DefaultService = "ssh"
+
+// maxMessageSize bounds the size of a single header message to what its
+// 16-bit length prefix can hold
+const maxMessageSize = math.MaxUint16
+
+// OpenRequest is sent at the start of a stream to select what the peer connects it to.
+// Exactly one of Service, Address, Listen, Resume, Control, Bench or Echo is set.
+type OpenRequest struct {
+	Version int    `json:"v"`
+	Service string `json:"service,omitempty"`
+	Address string `json:"addr,omitempty"`
+	// Listen asks natts to open a listener for a reverse forward. natts sets it on
+	// the streams it opens towards nattc to name the forward a connection belongs to.
+	Listen string `json:"listen,omitempty"`
+	// UDP asks for a datagram flow to Service or Address instead of a TCP connection
+	UDP bool `json:"udp,omitempty"`
+	// Resumable asks natts to issue a token with which the stream can be resumed
+	Resumable bool `json:"resumable,omitempty"`
+	// Resume continues the stream identified by a token on this stream.
+	// Received is the number of bytes nattc has received on it.
+	Resume   string `json:"resume,omitempty"`
+	Received uint64 `json:"received,omitempty"`
+	// Control opens the stream adaptive FEC sends its FECUpdates on. nattc
+	// only opens it if natts agreed to adaptive FEC in the handshake.
+	Control bool `json:"control,omitempty"`
+	// Bench opens a stream to the sink and source natts serves for nattc bench
+	Bench bool `json:"bench,omitempty"`
+	// Echo opens a stream natts sends back what it reads from, for nattc ping
+	Echo bool `json:"echo,omitempty"`
+}
+
+// Target returns the service name or address the request points at
+func (r *OpenRequest) Target() string {
+	switch {
+	case r.Control:
+		return "control stream"
+	case r.Bench:
+		return "bench"
+	case r.Echo:
+		return "echo"
+	case r.Resume != "":
+		return "resumed stream"
+	case r.Listen != "":
+		return "reverse " + r.Listen
+	case r.Address != "":
+		return r.Address
+	default:
+		return r.Service
+	}
+}
+
+// setDefaultService selects DefaultService if r names no target
+func (r *OpenRequest) setDefaultService() {
+	if r.Service == "" && r.Address == "" && r.Listen == "" && r.Resume == "" && !r.Control && !r.Bench && !r.Echo {
+		r.Service = DefaultService
+	}
+}
+
+// RejectCode tells why a stream was rejected, so that a client can tell a
+// policy denial from a target that could not be reached
+type RejectCode string
+
+const (
+	// RejectNotAllowed is a target the policy of the peer does not permit
+	RejectNotAllowed RejectCode = "not_allowed"
+	// RejectRefused is a target that refused the connection
+	RejectRefused RejectCode = "refused"
+	// RejectUnreachable is a target that could not be resolved or reached
+	RejectUnreachable RejectCode = "unreachable"
+	// RejectInUse is a reverse forward address something else listens on
+	RejectInUse RejectCode = "in_use"
+)
+
+// OpenResponse is natts's answer to an OpenRequest
+type OpenResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Code classifies Error; it is empty for other rejections and from older peers
+	Code RejectCode `json:"code,omitempty"`
+	// Flow identifies the datagrams of an accepted UDP request
+	Flow uint32 `json:"flow,omitempty"`
+	// Token identifies a resumable stream
+	Token string `json:"token,omitempty"`
+	// Received is the number of bytes natts has received on a resumed stream
+	Received uint64 `json:"received,omitempty"`
+}
+
+// RejectedError is returned by Open when natts refuses to serve a stream
+type RejectedError struct {
+	Target string
+	Reason string
+	Code   RejectCode
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("natts rejected %s: %s", e.Target, e.Reason)
+}
+
+// WriteMessage writes v as a length-prefixed JSON message
+func WriteMessage(w io.Writer, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if len(payload) > maxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(payload))
+	}
+
+	buf := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buf, uint16(len(payload)))
+	copy(buf[2:], payload)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// ReadMessage reads a length-prefixed JSON message into v
+func ReadMessage(r io.Reader, v any) error {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return fmt.Errorf("failed to read message length: %w", err)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("failed to decode message: %w", err)
+	}
+	return nil
+}
+
+// Open asks the peer to connect the stream to the requested target and waits for its answer
+func Open(rw io.ReadWriter, req OpenRequest) error {
+	_, err := open(rw, req)
+	return err
+}
+
+// MinResumeTokenLength is the length of the shortest resume token accepted;
+// logs tell streams apart by that many characters of their token
+const MinResumeTokenLength = 8
+
+// OpenResumable opens a stream like Open and returns the token with which it can be resumed.
+// The token is empty if natts does not support resumption.
+func OpenResumable(rw io.ReadWriter, req OpenRequest) (string, error) {
+	req.Resumable = true
+	resp, err := open(rw, req)
+	if err != nil {
+		return "", err
+	}
+	if resp.Token != "" && len(resp.Token) < MinResumeTokenLength {
+		return "", fmt.Errorf("invalid resume token of %d characters", len(resp.Token))
+	}
+	return resp.Token, nil
+}
+
+// OpenResume asks natts to continue the stream identified by token and returns
+// the number of bytes natts has received on it
+func OpenResume(rw io.ReadWriter, token string, received uint64) (uint64, error) {
+	resp, err := open(rw, OpenRequest{Resume: token, Received: received})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Received, nil
+}
+
+// OpenFlow asks natts for a UDP flow to the requested target and returns its flow ID.
+// The flow lives as long as the stream.
+func OpenFlow(rw io.ReadWriter, req OpenRequest) (uint32, error) {
+	req.UDP = true
+	resp, err := open(rw, req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Flow, nil
+}
+
+func open(rw io.ReadWriter, req OpenRequest) (*OpenResponse, error) {
+	req.Version = ProtocolVersion
+	req.setDefaultService()
+
+	if err := WriteMessage(rw, req); err != nil {
+		return nil, err
+	}
+
+	var resp OpenResponse
+	if err := ReadMessage(rw, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return nil, &RejectedError{Target: req.Target(), Reason: resp.Error, Code: resp.Code}
+	}
+	return &resp, nil
+}
+
+// ReadOpenRequest reads the stream header sent by Open
+func ReadOpenRequest(r io.Reader) (*OpenRequest, error) {
+	var req OpenRequest
+	if err := ReadMessage(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d", req.Version)
+	}
+	req.setDefaultService()
+	return &req, nil
+}
+
+// Accept tells the peer that the stream has been connected to its backend
+func Accept(w io.Writer) error {
+	return WriteMessage(w, OpenResponse{OK: true})
+}
+
+// AcceptResumable tells nattc that the stream has been connected and can be resumed with token
+func AcceptResumable(w io.Writer, token string) error {
+	return WriteMessage(w, OpenResponse{OK: true, Token: token})
+}
+
+// AcceptResume tells nattc that the stream continues, and how many bytes natts has received on it
+func AcceptResume(w io.Writer, received uint64) error {
+	return WriteMessage(w, OpenResponse{OK: true, Received: received})
+}
+
+// AcceptFlow tells nattc that a UDP flow has been set up
+func AcceptFlow(w io.Writer, flow uint32) error {
+	return WriteMessage(w, OpenResponse{OK: true, Flow: flow})
+}
+
+// Reject tells the peer that the stream cannot be served
+func Reject(w io.Writer, reason error) error {
+	return WriteMessage(w, OpenResponse{OK: false, Error: reason.Error()})
+}
+
+// RejectWith tells the peer that the stream cannot be served, and why
+func RejectWith(w io.Writer, code RejectCode, reason error) error {
+	return WriteMessage(w, OpenResponse{OK: false, Error: reason.Error(), Code: code})
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// paddedRequest returns a request whose JSON encoding is exactly size bytes
+func paddedRequest(t *testing.T, size int) OpenRequest {
+	t.Helper()
+	empty, err := json.Marshal(OpenRequest{Service: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "service" is omitted while empty, so it adds its key as well
+	overhead := len(empty) + len(`,"service":""`)
+	req := OpenRequest{Service: strings.Repeat("s", size-overhead)}
+	if payload, _ := json.Marshal(req); len(payload) != size {
+		t.Fatalf("padded request is %d bytes, want %d", len(payload), size)
+	}
+	return req
+}
+
+func TestWriteMessageBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"small", 64, false},
+		{"largest", maxMessageSize, false},
+		{"length prefix overflows", maxMessageSize + 1, true},
+		{"old bound", 64 * 1024, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := paddedRequest(t, tt.size)
+			var buf bytes.Buffer
+			err := WriteMessage(&buf, req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("WriteMessage accepted a message its length prefix cannot hold")
+				}
+				if buf.Len() != 0 {
+					t.Errorf("WriteMessage wrote %d bytes of a rejected message", buf.Len())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WriteMessage: %v", err)
+			}
+			if got := int(binary.BigEndian.Uint16(buf.Bytes())); got != tt.size {
+				t.Errorf("length prefix is %d, want %d", got, tt.size)
+			}
+
+			var got OpenRequest
+			if err := ReadMessage(&buf, &got); err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if got.Service != req.Service {
+				t.Error("message changed in the round trip")
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left after the message", buf.Len())
+			}
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short length", []byte{0}},
+		{"truncated payload", []byte{0, 10, '{', '}'}},
+		{"invalid JSON", append([]byte{0, 3}, "{x}"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req OpenRequest
+			if err := ReadMessage(bytes.NewReader(tt.input), &req); err == nil {
+				t.Error("ReadMessage accepted a malformed message")
+			}
+		})
+	}
+}
+
+func TestReadOpenRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         OpenRequest
+		wantErr     bool
+		wantService string
+	}{
+		{"default service", OpenRequest{Version: ProtocolVersion}, false, DefaultService},
+		{"named service", OpenRequest{Version: ProtocolVersion, Service: "web"}, false, "web"},
+		{"address", OpenRequest{Version: ProtocolVersion, Address: "10.0.0.1:80"}, false, ""},
+		{"echo", OpenRequest{Version: ProtocolVersion, Echo: true}, false, ""},
+		{"old version", OpenRequest{Version: ProtocolVersion - 1}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteMessage(&buf, tt.req); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadOpenRequest(&buf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ReadOpenRequest accepted an unsupported version")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadOpenRequest: %v", err)
+			}
+			if got.Service != tt.wantService {
+				t.Errorf("service is %q, want %q", got.Service, tt.wantService)
+			}
+		})
+	}
+}
+
+// peer answers the request of Open with resp
+type peer struct {
+	io.Reader
+	io.Writer
+}
+
+func newPeer(t *testing.T, resp OpenResponse) peer {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	return peer{Reader: &buf, Writer: io.Discard}
+}
+
+func TestOpenResumableToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"issued token", "0123456789abcdef0123456789abcdef", false},
+		{"shortest token", "01234567", false},
+		{"no resumption", "", false},
+		{"short token", "0123", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := OpenResumable(newPeer(t, OpenResponse{OK: true, Token: tt.token}), OpenRequest{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("OpenResumable accepted token %q", tt.token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenResumable: %v", err)
+			}
+			if token != tt.token {
+				t.Errorf("token is %q, want %q", token, tt.token)
+			}
+		})
+	}
+}
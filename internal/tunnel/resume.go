@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultReplayBufferSize is how many recently sent bytes a resumable stream keeps.
+// It must cover everything that may still be in flight when a session breaks,
+// which smux's per-stream flow control keeps well below this.
+const DefaultReplayBufferSize = 1 << 20
+
+var ErrResumableClosed = errors.New("resumable stream closed")
+
+// ResumableConn is a stream that survives the loss of the session carrying it.
+// It counts the bytes it has received and keeps the bytes it recently sent, so
+// that the stream can be continued on a new session from where the peer left off.
+// Reads and writes block while the stream is detached.
+type ResumableConn struct {
+	// readMu is held while reading from the underlying stream, so that
+	// received is stable once the reader has let go of a detached stream
+	readMu   sync.Mutex
+	received uint64
+
+	// writeMu serializes writes and retransmissions
+	writeMu sync.Mutex
+	sent    uint64
+	replay  []byte
+	maxSize int
+
+	mu       sync.Mutex
+	attached *sync.Cond
+	conn     io.ReadWriteCloser
+	broken   chan struct{}
+	closed   bool
+	done     chan struct{}
+}
+
+func NewResumableConn(conn io.ReadWriteCloser, replayBufferSize int) *ResumableConn {
+	if replayBufferSize <= 0 {
+		replayBufferSize = DefaultReplayBufferSize
+	}
+	c := &ResumableConn{
+		maxSize: replayBufferSize,
+		conn:    conn,
+		broken:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	c.attached = sync.NewCond(&c.mu)
+	return c
+}
+
+// current waits until the stream is attached and returns the underlying stream
+func (c *ResumableConn) current() (io.ReadWriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.conn == nil && !c.closed {
+		c.attached.Wait()
+	}
+	if c.closed {
+		return nil, ErrResumableClosed
+	}
+	return c.conn, nil
+}
+
+// detach marks the stream as broken if conn is still the current underlying stream
+func (c *ResumableConn) detach(conn io.ReadWriteCloser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+	c.conn = nil
+	close(c.broken)
+	conn.Close()
+}
+
+func (c *ResumableConn) Read(p []byte) (int, error) {
+	for {
+		conn, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+
+		c.readMu.Lock()
+		n, err := conn.Read(p)
+		c.received += uint64(n)
+		c.readMu.Unlock()
+
+		if n > 0 {
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) {
+			// The peer closed the stream on purpose
+			return 0, io.EOF
+		}
+		c.detach(conn)
+	}
+}
+
+func (c *ResumableConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+	if closed {
+		c.writeMu.Unlock()
+		return 0, ErrResumableClosed
+	}
+
+	// Everything written is kept until it falls out of the replay buffer, so
+	// a write that fails is retransmitted once the stream is resumed
+	c.replay = append(c.replay, p...)
+	if len(c.replay) > c.maxSize {
+		c.replay = c.replay[len(c.replay)-c.maxSize:]
+	}
+	c.sent += uint64(len(p))
+
+	if conn != nil {
+		if _, err := conn.Write(p); err == nil {
+			c.writeMu.Unlock()
+			return len(p), nil
+		}
+		c.detach(conn)
+	}
+	c.writeMu.Unlock()
+
+	if _, err := c.current(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Broken returns a channel that is closed when the current underlying stream breaks
+func (c *ResumableConn) Broken() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.broken
+}
+
+// Done returns a channel that is closed when the stream is closed for good
+func (c *ResumableConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Suspend detaches the current underlying stream, if any, and returns the
+// number of bytes received so far. Nothing more is read until Resume.
+func (c *ResumableConn) Suspend() uint64 {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.detach(conn)
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.received
+}
+
+// Resume continues the stream on conn. peerReceived is the number of bytes the
+// peer has received; everything it is missing is sent again first.
+func (c *ResumableConn) Resume(conn io.ReadWriteCloser, peerReceived uint64) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	oldest := c.sent - uint64(len(c.replay))
+	if peerReceived > c.sent || peerReceived < oldest {
+		return fmt.Errorf("cannot resume from byte %d: only bytes %d to %d are available", peerReceived, oldest, c.sent)
+	}
+
+	// Let readers continue before retransmitting, since the peer may be
+	// retransmitting at the same time and both sides need to drain
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrResumableClosed
+	}
+	c.conn = conn
+	c.broken = make(chan struct{})
+	c.attached.Broadcast()
+	c.mu.Unlock()
+
+	// An empty write would reach the peer as a read of nothing, which it
+	// takes for a broken stream
+	if missing := c.replay[peerReceived-oldest:]; len(missing) > 0 {
+		if _, err := conn.Write(missing); err != nil {
+			c.detach(conn)
+			return fmt.Errorf("failed to retransmit: %w", err)
+		}
+	}
+	return nil
+}
+
+// WaitResumed waits up to timeout for the stream to be attached again
+func (c *ResumableConn) WaitResumed(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		attached, closed := c.conn != nil, c.closed
+		c.mu.Unlock()
+		if attached {
+			return true
+		}
+		if closed {
+			return false
+		}
+
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.attached.Broadcast()
+
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		close(c.broken)
+		return err
+	}
+	return nil
+}
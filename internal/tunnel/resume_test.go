@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lostConn is a stream whose writes are lost with the session that carried them
+type lostConn struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newLostConn() *lostConn {
+	return &lostConn{closed: make(chan struct{})}
+}
+
+func (c *lostConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *lostConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *lostConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestResumeRetransmits(t *testing.T) {
+	tests := []struct {
+		name         string
+		replaySize   int
+		peerReceived uint64
+		want         string
+		wantErr      bool
+	}{
+		{"nothing received", 0, 0, "hello world", false},
+		{"part received", 0, 6, "world", false},
+		{"all received", 0, 11, "", false},
+		{"more than sent", 0, 12, "", true},
+		{"tail still buffered", 5, 6, "world", false},
+		{"fell out of the buffer", 5, 5, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := NewResumableConn(newLostConn(), tt.replaySize)
+			defer rc.Close()
+			if _, err := rc.Write([]byte("hello world")); err != nil {
+				t.Fatal(err)
+			}
+			rc.Suspend()
+
+			local, remote := net.Pipe()
+			defer remote.Close()
+			got := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(remote)
+				got <- b
+			}()
+
+			err := rc.Resume(local, tt.peerReceived)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resumed from byte %d", tt.peerReceived)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resume: %v", err)
+			}
+			local.Close()
+			if b := <-got; string(b) != tt.want {
+				t.Errorf("retransmitted %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeContinuesStream(t *testing.T) {
+	a, b := net.Pipe()
+	x, y := NewResumableConn(a, 0), NewResumableConn(b, 0)
+	defer x.Close()
+	defer y.Close()
+
+	go x.Write([]byte("hello "))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(y, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session breaks, and x writes while it is gone
+	xReceived, yReceived := x.Suspend(), y.Suspend()
+	written := make(chan error, 1)
+	go func() {
+		_, err := x.Write([]byte("world"))
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Both sides retransmit at once, so x has to read as well
+	go io.Copy(io.Discard, x)
+	a, b = net.Pipe()
+	resumed := make(chan error, 1)
+	go func() { resumed <- x.Resume(a, yReceived) }()
+	if err := y.Resume(b, xReceived); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(y, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Errorf("read %q after resuming, want %q", buf, "world")
+	}
+	if err := <-resumed; err != nil {
+		t.Errorf("Resume: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Errorf("write while detached failed: %v", err)
+	}
+}
+
+func TestResumeClosed(t *testing.T) {
+	rc := NewResumableConn(newLostConn(), 0)
+	rc.Suspend()
+	rc.Close()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if err := rc.Resume(local, 0); !errors.Is(err, ErrResumableClosed) {
+		t.Errorf("Resume of a closed stream returned %v, want ErrResumableClosed", err)
+	}
+	if _, err := rc.Read(make([]byte, 1)); !errors.Is(err, ErrResumableClosed) {
+		t.Errorf("Read of a closed stream returned %v, want ErrResumableClosed", err)
+	}
+}
@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// shapeChunk is the largest write that waits for the buckets at once, so
+// that slow limits still let data through smoothly
+const shapeChunk = 16 * 1024
+
+// BandwidthLimits caps the bytes per second a side sends through the tunnel.
+// A rate of 0 means unlimited.
+type BandwidthLimits struct {
+	Global     int64 `json:"global"`
+	PerSession int64 `json:"per_session"`
+	// Services limits connections by the service label of metrics.Service
+	Services map[string]int64 `json:"services"`
+}
+
+// bucket is a token bucket of bytes shared by the connections it limits
+type bucket struct {
+	lim *rate.Limiter
+}
+
+func newBucket(bytesPerSecond int64) *bucket {
+	b := &bucket{lim: rate.NewLimiter(rate.Inf, 0)}
+	b.setRate(bytesPerSecond)
+	return b
+}
+
+// setRate changes the rate; waiting writers pick it up with their next chunk
+func (b *bucket) setRate(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		b.lim.SetLimit(rate.Inf)
+		return
+	}
+	// Allow bursts of a tenth of a second, but at least one chunk
+	b.lim.SetBurst(max(shapeChunk, int(bytesPerSecond/10)))
+	b.lim.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+func (b *bucket) wait(ctx context.Context, n int) error {
+	if b == nil || b.lim.Limit() == rate.Inf {
+		return nil
+	}
+	return b.lim.WaitN(ctx, n)
+}
+
+// Shaper holds the buckets for a set of BandwidthLimits, which can be
+// changed while connections are running
+type Shaper struct {
+	mu       sync.Mutex
+	limits   BandwidthLimits
+	global   *bucket
+	services map[string]*bucket
+	sessions map[*SessionBucket]struct{}
+}
+
+// SessionBucket limits the connections of one session together
+type SessionBucket struct {
+	bucket *bucket
+}
+
+func NewShaper(limits BandwidthLimits) *Shaper {
+	s := &Shaper{
+		global:   newBucket(0),
+		services: make(map[string]*bucket),
+		sessions: make(map[*SessionBucket]struct{}),
+	}
+	s.SetLimits(limits)
+	return s
+}
+
+// Limits returns the limits in effect
+func (s *Shaper) Limits() BandwidthLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.limits
+	l.Services = maps.Clone(s.limits.Services)
+	return l
+}
+
+// SetLimits applies new limits to running connections as well as new ones
+func (s *Shaper) SetLimits(limits BandwidthLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits.Services = maps.Clone(limits.Services)
+	if limits.Services == nil {
+		limits.Services = map[string]int64{}
+	}
+	s.limits = limits
+
+	s.global.setRate(limits.Global)
+	for sess := range s.sessions {
+		sess.bucket.setRate(limits.PerSession)
+	}
+	// Buckets of services that lost their limit stay, unlimited, for the
+	// connections still holding them
+	for name, b := range s.services {
+		b.setRate(limits.Services[name])
+	}
+	for name, rate := range limits.Services {
+		if s.services[name] == nil {
+			s.services[name] = newBucket(rate)
+		}
+	}
+}
+
+// NewSession returns the bucket for the connections of a new session. It
+// must be released with ReleaseSession once the session ends.
+func (s *Shaper) NewSession() *SessionBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := &SessionBucket{bucket: newBucket(s.limits.PerSession)}
+	s.sessions[sess] = struct{}{}
+	return sess
+}
+
+func (s *Shaper) ReleaseSession(sess *SessionBucket) {
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+}
+
+// Shape limits the writes to rw, the tunnel side of a connection of service
+// in sess, by the global, per-session and per-service rates. Reads pass through.
+// A write waiting for the buckets fails once ctx is done, which should be when
+// the stream or its session closes.
+func (s *Shaper) Shape(ctx context.Context, rw io.ReadWriter, sess *SessionBucket, service string) io.ReadWriter {
+	return &shapedWriter{ctx: ctx, rw: rw, buckets: s.buckets(sess, service)}
+}
+
+// Police returns a check for the datagrams of a UDP flow of service in sess.
+// Datagrams cannot wait for the buckets without holding up the flow, so
+// those over the limits are to be dropped, as a congested link would.
+func (s *Shaper) Police(sess *SessionBucket, service string) func(n int) bool {
+	buckets := s.buckets(sess, service)
+	return func(n int) bool {
+		return allow(buckets, n)
+	}
+}
+
+func (s *Shaper) buckets(sess *SessionBucket, service string) []*bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.services[service] == nil {
+		s.services[service] = newBucket(0)
+	}
+	buckets := []*bucket{s.global, s.services[service]}
+	if sess != nil {
+		buckets = append(buckets, sess.bucket)
+	}
+	return buckets
+}
+
+// allow takes n tokens from every limited bucket if all of them have them now,
+// and none otherwise
+func allow(buckets []*bucket, n int) bool {
+	now := time.Now()
+	var taken []*rate.Reservation
+	for _, b := range buckets {
+		if b == nil || b.lim.Limit() == rate.Inf {
+			continue
+		}
+		r := b.lim.ReserveN(now, n)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, t := range taken {
+				t.CancelAt(now)
+			}
+			return false
+		}
+		taken = append(taken, r)
+	}
+	return true
+}
+
+// Until returns a context that is cancelled once done is closed, such as the
+// die channel of a stream
+func Until(done <-chan struct{}) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+	return ctx
+}
+
+type shapedWriter struct {
+	ctx     context.Context
+	rw      io.ReadWriter
+	buckets []*bucket
+}
+
+func (w *shapedWriter) Read(p []byte) (int, error) {
+	return w.rw.Read(p)
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), shapeChunk)]
+		for _, b := range w.buckets {
+			if err := b.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.rw.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
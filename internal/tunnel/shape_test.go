@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShapedWriteEndsWithContext(t *testing.T) {
+	// A chunk at 1 KB/s takes 16 seconds once the burst is spent
+	s := NewShaper(BandwidthLimits{Global: 1024})
+	done := make(chan struct{})
+	var dst bytes.Buffer
+	w := s.Shape(Until(done), &dst, nil, "ssh")
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, 3*shapeChunk))
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("write ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still waits for the bucket after the stream closed")
+	}
+	if dst.Len() != shapeChunk {
+		t.Errorf("wrote %d bytes, want the burst of %d", dst.Len(), shapeChunk)
+	}
+}
+
+func TestPolice(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  BandwidthLimits
+		sizes   []int
+		allowed []bool
+	}{
+		{
+			"unlimited",
+			BandwidthLimits{},
+			[]int{MaxDatagramSize, MaxDatagramSize},
+			[]bool{true, true},
+		},
+		{
+			"over the burst",
+			BandwidthLimits{Global: 1024},
+			[]int{shapeChunk - 100, 200, 100},
+			[]bool{true, false, true},
+		},
+		{
+			// The global bucket keeps its tokens when the service bucket refuses
+			"tightest bucket refuses",
+			BandwidthLimits{Global: 1 << 20, Services: map[string]int64{"dns": 1024}},
+			[]int{shapeChunk, 1},
+			[]bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShaper(tt.limits)
+			allow := s.Police(s.NewSession(), "dns")
+			for i, n := range tt.sizes {
+				if got := allow(n); got != tt.allowed[i] {
+					t.Errorf("datagram %d of %d bytes allowed: %v, want %v", i, n, got, tt.allowed[i])
+				}
+			}
+			if tt.limits.Services == nil {
+				return
+			}
+			// The refused datagram did not take tokens from the global bucket
+			if got := s.global.lim.TokensAt(time.Now()); got < float64(s.global.lim.Burst()-shapeChunk) {
+				t.Errorf("global bucket has %.0f tokens, want at least %d", got, s.global.lim.Burst()-shapeChunk)
+			}
+		})
+	}
+}